@@ -4,64 +4,243 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
 
 	"github.com/homemade/jgforce"
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/jgforce/metrics"
+	"github.com/homemade/jgforce/schedule"
+)
+
+// electionInterval is how often a standby clock tries to become the leader (and the leader checks it still is)
+const electionInterval = 15 * time.Second
+
+// retryInterval is how long the leader waits before retrying a run it failed to add a job for
+const retryInterval = 30 * time.Second
+
+var (
+	scheduledRuns = metrics.NewCounter("jgforce_clock_runs_total", "Scheduled runs, by schedule and outcome (added, skipped or failed).",
+		"schedule", "outcome")
+	isLeader = metrics.NewGauge("jgforce_clock_leader", "1 if this clock is the leader, 0 if it is standing by.")
 )
 
 func main() {
 
-	// read heartbeat
-	htbt, err := strconv.Atoi(os.Getenv("HEARTBEAT"))
-	if htbt < 1 || err != nil {
-		log.WithField("HEARTBEAT", htbt).Fatal(fmt.Sprintf("Unable to setup heartbeat %v", err))
+	// Load the config (reporting every problem with it, rather than just the first)
+	cfg, err := config.Load(config.DatabaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// read schedules
+	schedules, err := schedule.Load(cfg)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Unable to setup schedules %v", err))
 	}
 
 	// Setup queue / database
-	dbURL := os.Getenv("DATABASE_URL")
+	dbURL := cfg.DatabaseURL
 	pgxpool, qc, err := jgforce.Setup(dbURL)
 	if err != nil {
-		log.WithField("DATABASE_URL", dbURL).Fatal("Unable to setup queue / database")
+		log.WithField("DATABASE_URL", dbURL).Fatal("Unable to setup queue / database: ", err)
+	}
+
+	// Serve metrics on METRICS_PORT (default 9091)
+	metricsPort := cfg.MetricsPort
+	if metricsPort == "" {
+		metricsPort = "9091"
 	}
+	jgforce.CollectQueueDepth(pgxpool)
+	metrics.Serve(":" + metricsPort)
+
+	// Only one clock (the leader) adds jobs, so we can safely run more than one clock process
+	// (e.g. when a deploy overlaps old and new dynos) - the others stand by and take over if the leader dies
+	leader := jgforce.NewLeader(pgxpool, "clock")
 
 	// Catch signals so we can shutdown gracefully
 	// (Heroku will cycle processes daily sending a SIGTERM)
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 
-	// Kick off timer
-	ticker := time.NewTicker(time.Minute * time.Duration(htbt))
+	// Work out the next run time of each schedule
+	// (when we become the leader these are recalculated from the last runs recorded in the database)
+	next := make(map[string]time.Time)
+	for _, s := range schedules {
+		next[s.Name] = s.Next(time.Now())
+	}
+	// The runs the leader failed to add a job for, by schedule, these are retried every retryInterval
+	// (rather than being skipped, a later run would be recorded as the last run and the failed run never caught up)
+	failed := make(map[string]time.Time)
+
+	// Then loop, holding an election every electionInterval and adding the jobs that are due,
+	// sleeping in between until whichever of these comes first
+	stop := make(chan struct{})
+	done := make(chan struct{})
 	go func() {
-		for t := range ticker.C {
-			// add heartbeat event to our 2 queues
-			log.WithField("tick", t).Info(fmt.Sprintf("Adding heartbeat event to queue %s", jgforce.JustGivingQueue))
-			j1 := que.Job{
-				Queue: jgforce.JustGivingQueue,
-				Type:  jgforce.HeartbeatJob,
+		defer close(done)
+		var election time.Time
+		for {
+			if !time.Now().Before(election) {
+				wasLeader := leader.IsLeader()
+				elected, err := leader.Elect()
+				if err != nil {
+					log.Error(err)
+				}
+				if elected {
+					isLeader.Set(1)
+				} else {
+					isLeader.Set(0)
+				}
+				if elected && !wasLeader {
+					log.Info("Elected leader, this clock will add scheduled jobs")
+					catchUp(pgxpool, qc, schedules, next, failed)
+				}
+				if !elected && wasLeader {
+					log.Warn("No longer the leader, this clock is standing by")
+				}
+				if !elected && !wasLeader && election.IsZero() {
+					log.Info("Another clock is the leader, this clock is standing by")
+				}
+				election = time.Now().Add(electionInterval)
 			}
-			if err := qc.Enqueue(&j1); err != nil {
-				log.Error(fmt.Errorf("Unable to add heartbeat event to queue %s, error %v", jgforce.JustGivingQueue, err))
+
+			now := time.Now()
+			for _, s := range schedules {
+				if next[s.Name].After(now) {
+					continue
+				}
+				if !leader.IsLeader() {
+					delete(failed, s.Name)
+					next[s.Name] = s.Next(now)
+					continue
+				}
+				runAt, retrying := failed[s.Name]
+				if !retrying {
+					runAt = next[s.Name]
+				}
+				if !run(pgxpool, qc, s, runAt, true) {
+					failed[s.Name] = runAt
+					next[s.Name] = now.Add(retryInterval)
+					continue
+				}
+				delete(failed, s.Name)
+				if retrying {
+					// the runs due while we were retrying are caught up as for a restart
+					catchUpSchedule(pgxpool, qc, s, runAt, now, next, failed)
+				} else {
+					next[s.Name] = s.Next(now)
+				}
 			}
-			log.WithField("tick", t).Info(fmt.Sprintf("Adding heartbeat event to queue %s", jgforce.SalesForceQueue))
-			j2 := que.Job{
-				Queue: jgforce.SalesForceQueue,
-				Type:  jgforce.HeartbeatJob,
+
+			wake := election
+			for _, s := range schedules {
+				if next[s.Name].Before(wake) {
+					wake = next[s.Name]
+				}
 			}
-			if err := qc.Enqueue(&j2); err != nil {
-				log.Error(fmt.Errorf("Unable to add heartbeat event to queue %s, error %v", jgforce.SalesForceQueue, err))
+			timer := time.NewTimer(wake.Sub(time.Now()))
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
 			}
 		}
-
 	}()
 
-	// Wait for signals and handle them gracefully by closing the postgres connection pool and stopping the ticker
+	// Wait for signals and handle them gracefully by stopping the schedules, resigning leadership
+	// (so a standby clock can take over straight away) and closing the postgres connection pool
 	sig := <-sigCh
 	log.WithField("signal", sig).Info("Signal received. Shutting down.")
+	close(stop)
+	<-done
+	if err := leader.Resign(); err != nil {
+		log.Error(err)
+	}
 	pgxpool.Close()
-	ticker.Stop()
+}
+
+// catchUp adds jobs for any runs missed since the last recorded run of each schedule (according to its catch up policy)
+// and then sets the next run time of each schedule
+func catchUp(pgxpool *pgx.ConnPool, qc *que.Client, schedules []*schedule.Schedule, next map[string]time.Time, failed map[string]time.Time) {
+	lastRuns, err := schedule.LastRuns(pgxpool)
+	if err != nil {
+		log.Error(fmt.Errorf("Unable to catch up missed runs, error %v", err))
+		return
+	}
+	now := time.Now()
+	for _, s := range schedules {
+		delete(failed, s.Name)
+		last, ok := lastRuns[s.Name]
+		if !ok {
+			// never run, just wait for the next run time
+			continue
+		}
+		catchUpSchedule(pgxpool, qc, s, last, now, next, failed)
+	}
+}
+
+// catchUpSchedule adds jobs for the runs of the schedule missed since last (according to its catch up policy)
+// and then sets its next run time, if a job can't be added its run is retried from there
+func catchUpSchedule(pgxpool *pgx.ConnPool, qc *que.Client, s *schedule.Schedule, last time.Time, now time.Time,
+	next map[string]time.Time, failed map[string]time.Time) {
+	var missed []time.Time
+	missed, next[s.Name] = s.Missed(last, now)
+	if len(missed) > 0 {
+		log.WithField("schedule", s.Name).WithField("catchup", s.CatchUp).Info(fmt.Sprintf("Catching up %d missed run(s) since %v", len(missed), last))
+	}
+	for _, runAt := range missed {
+		// when catching up every missed run, each run is a job in its own right rather than a duplicate
+		if !run(pgxpool, qc, s, runAt, s.CatchUp != schedule.CatchUpAll) {
+			failed[s.Name] = runAt
+			next[s.Name] = now.Add(retryInterval)
+			return
+		}
+	}
+}
+
+// run adds the scheduled job to run at runAt, and records the run, ok is false if the job couldn't be added
+func run(pgxpool *pgx.ConnPool, qc *que.Client, s *schedule.Schedule, runAt time.Time, unique bool) (ok bool) {
+	log.WithField("schedule", s.Name).WithField("run_at", runAt).Info(fmt.Sprintf("Adding %s job to queue %s", s.Job, s.Queue))
+	// runAt has already come (we only add a job once its run is due) so the job is worked straight away,
+	// its run_at just records which run it is for
+	j := que.Job{
+		Queue: s.Queue,
+		Type:  s.Job,
+		Args:  s.Args,
+		RunAt: runAt,
+	}
+	if unique {
+		// only keep one pending job of each type per queue, a waiting (or retrying) job is replaced by this one
+		// and if the previous job is still running we skip this one
+		added, err := jgforce.EnqueueUnique(pgxpool, qc, &j, jgforce.ReplaceDuplicate)
+		if err != nil {
+			scheduledRuns.Inc(s.Name, "failed")
+			log.Error(fmt.Errorf("Unable to add %s job to queue %s, error %v", s.Job, s.Queue, err))
+			return false
+		}
+		if added {
+			scheduledRuns.Inc(s.Name, "added")
+		} else {
+			scheduledRuns.Inc(s.Name, "skipped")
+			log.WithField("schedule", s.Name).WithField("skipped", jgforce.SkippedEnqueues()).Warn(fmt.Sprintf("Skipped %s job for queue %s, the previous job is still running", s.Job, s.Queue))
+		}
+	} else {
+		if err := qc.Enqueue(&j); err != nil {
+			scheduledRuns.Inc(s.Name, "failed")
+			log.Error(fmt.Errorf("Unable to add %s job to queue %s, error %v", s.Job, s.Queue, err))
+			return false
+		}
+		scheduledRuns.Inc(s.Name, "added")
+	}
+	// (a run which failed to enqueue isn't recorded, the caller retries it)
+	if err := schedule.SaveLastRun(pgxpool, s.Name, runAt); err != nil {
+		log.Error(err)
+	}
+	return true
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/jgforce/migrations"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jackc/pgx"
+)
+
+const usage = `usage: migrate [up | down [n] | status | rekey]
+
+  up        apply every pending migration (the default)
+  down [n]  revert the latest n applied migrations (default 1)
+  status    list every migration and when it was applied
+  rekey     restore the idempotency keys of salesforce.donation_stats__c (after heroku connect remaps it)`
+
+func main() {
+	cmd := "up"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	cfg, err := config.Load(config.DatabaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbURL := cfg.DatabaseURL
+	connCfg, err := pgx.ParseURI(dbURL)
+	if err != nil {
+		log.WithField("DATABASE_URL", dbURL).Fatal("Unable to configure connection to database: ", err)
+	}
+	conn, err := pgx.Connect(connCfg)
+	if err != nil {
+		log.WithField("DATABASE_URL", dbURL).Fatal("Unable to connect to database: ", err)
+	}
+	defer conn.Close()
+
+	switch cmd {
+	case "up":
+		applied, err := migrations.Up(conn)
+		for _, m := range applied {
+			log.WithField("version", m.Version).Infof("Applied migration %s", m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			log.Info("Database is up to date")
+		}
+
+	case "down":
+		n := 1
+		if len(os.Args) > 2 {
+			n, err = strconv.Atoi(os.Args[2])
+			if err != nil || n < 1 {
+				log.Fatal(fmt.Sprintf("Invalid number of migrations to revert %q, expected integer value >= 1", os.Args[2]))
+			}
+		}
+		reverted, err := migrations.Down(conn, n)
+		for _, m := range reverted {
+			log.WithField("version", m.Version).Infof("Reverted migration %s", m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "status":
+		statuses, err := migrations.Statuses(conn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%03d %-24s %s\n", s.Version, s.Name, applied)
+		}
+
+	case "rekey":
+		if err := migrations.Rekey(conn); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Rekeyed salesforce.donation_stats__c")
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAPIKey only lets through the requests which carry the key, as a bearer token (Authorization: Bearer <key>)
+// or as the password of basic auth (any user name), all others get a 401. With an empty key every request is refused.
+func requireAPIKey(key string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key == "" || !validAPIKey(key, r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jgforce"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid api key")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func validAPIKey(key string, r *http.Request) bool {
+	given := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1
+}
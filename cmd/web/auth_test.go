@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		key    string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"no key given", "secret", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bearer token", "secret", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"wrong bearer token", "secret", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"basic auth", "secret", func(r *http.Request) { r.SetBasicAuth("ops", "secret") }, http.StatusOK},
+		{"wrong basic auth", "secret", func(r *http.Request) { r.SetBasicAuth("secret", "") }, http.StatusUnauthorized},
+		{"no key configured", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") }, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/queues", nil)
+		tc.auth(r)
+		w := httptest.NewRecorder()
+		requireAPIKey(tc.key, ok).ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected %d but have %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+
+	"github.com/homemade/jgforce"
+	"github.com/homemade/jgforce/config"
+)
+
+var (
+	qc      *que.Client
+	pgxpool *pgx.ConnPool
+)
+
+// job is a row from que_jobs as returned by the api
+type job struct {
+	ID         int64           `json:"job_id"`
+	Queue      string          `json:"queue"`
+	Priority   int16           `json:"priority"`
+	RunAt      time.Time       `json:"run_at"`
+	Type       string          `json:"job_class"`
+	Args       json.RawMessage `json:"args"`
+	ErrorCount int32           `json:"error_count"`
+	LastError  *string         `json:"last_error,omitempty"`
+}
+
+// deadJob is a row from que_dead_jobs as returned by the api
+type deadJob struct {
+	jgforce.DeadJob
+	Args json.RawMessage `json:"args"`
+}
+
+// queueDepth summarises the que_jobs waiting on a queue
+type queueDepth struct {
+	Queue       string     `json:"queue"`
+	Count       int64      `json:"count"`
+	Failed      int64      `json:"failed"`
+	OldestRunAt *time.Time `json:"oldest_run_at,omitempty"`
+}
+
+func main() {
+	var err error
+
+	// Load the config (reporting every problem with it, rather than just the first)
+	// (WEB_API_KEY is required, so the api is never served without auth)
+	cfg, err := config.Load(config.Port, config.DatabaseURL, config.WebAPIKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	port := cfg.Port
+	dbURL := cfg.DatabaseURL
+	pgxpool, qc, err = jgforce.Setup(dbURL)
+	if err != nil {
+		log.WithField("DATABASE_URL", dbURL).Fatal("Unable to setup queue / database: ", err)
+	}
+	defer pgxpool.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs/refresh-page", handleRefreshPage)
+	mux.HandleFunc("/jobs/sync-event", handleSyncEvent)
+	mux.HandleFunc("/jobs/resync-contact", handleResyncContact)
+	mux.HandleFunc("/jobs", handleJobs)
+	mux.HandleFunc("/queues", handleQueues)
+	mux.HandleFunc("/dead-jobs", handleDeadJobs)
+	mux.HandleFunc("/dead-jobs/requeue", handleRequeueDeadJob)
+	mux.HandleFunc("/dead-jobs/purge", handlePurgeDeadJobs)
+	mux.HandleFunc("/runs", handleRuns)
+	mux.HandleFunc("/donation-stats/duplicates", handleDonationStatsDuplicates)
+
+	log.WithField("PORT", port).Info("Starting web process")
+	if err = http.ListenAndServe(":"+port, requireAPIKey(cfg.WebAPIKey, mux)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// handleRefreshPage enqueues a RefreshPageResultsJob, expects a body of {"page_id": 123}
+func handleRefreshPage(w http.ResponseWriter, r *http.Request) {
+	var args jgforce.RefreshPageResultsArgs
+	if !decodeArgs(w, r, &args) {
+		return
+	}
+	if args.PageID == 0 {
+		writeError(w, http.StatusBadRequest, "missing page_id")
+		return
+	}
+	enqueue(w, jgforce.JustGivingQueue, jgforce.RefreshPageResultsJob, args)
+}
+
+// handleSyncEvent enqueues a SyncEventPagesJob, expects a body of {"event_id": 123}
+func handleSyncEvent(w http.ResponseWriter, r *http.Request) {
+	var args jgforce.SyncEventPagesArgs
+	if !decodeArgs(w, r, &args) {
+		return
+	}
+	if args.EventID == 0 {
+		writeError(w, http.StatusBadRequest, "missing event_id")
+		return
+	}
+	enqueue(w, jgforce.JustGivingQueue, jgforce.SyncEventPagesJob, args)
+}
+
+// handleResyncContact enqueues a ResyncContactJob, expects a body of {"contact_id": "<salesforce id>"}
+func handleResyncContact(w http.ResponseWriter, r *http.Request) {
+	var args jgforce.ResyncContactArgs
+	if !decodeArgs(w, r, &args) {
+		return
+	}
+	if args.ContactID == "" {
+		writeError(w, http.StatusBadRequest, "missing contact_id")
+		return
+	}
+	enqueue(w, jgforce.SalesForceQueue, jgforce.ResyncContactJob, args)
+}
+
+// handleJobs lists the rows in que_jobs, optionally filtered with the query params
+// state (pending or failed), queue and limit (defaults to 100)
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "expected GET")
+		return
+	}
+
+	q := r.URL.Query()
+	var failed bool
+	switch q.Get("state") {
+	case "", "pending":
+		failed = false
+	case "failed":
+		failed = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid state, expected pending or failed")
+		return
+	}
+	limit, ok := parseLimit(w, q.Get("limit"))
+	if !ok {
+		return
+	}
+
+	rows, err := pgxpool.Query(`SELECT job_id, queue, priority, run_at, job_class, args, error_count, last_error FROM que_jobs
+ WHERE ($1 = '' OR queue = $1) AND (error_count > 0) = $2
+ ORDER BY run_at, job_id LIMIT $3`, q.Get("queue"), failed, limit)
+	if err != nil {
+		log.Errorf("error querying que_jobs %v", err)
+		writeError(w, http.StatusInternalServerError, "error querying que_jobs")
+		return
+	}
+	defer rows.Close()
+
+	jobs := []job{}
+	for rows.Next() {
+		var j job
+		var args []byte
+		if err = rows.Scan(&j.ID, &j.Queue, &j.Priority, &j.RunAt, &j.Type, &args, &j.ErrorCount, &j.LastError); err != nil {
+			log.Errorf("error reading from que_jobs %v", err)
+			writeError(w, http.StatusInternalServerError, "error reading from que_jobs")
+			return
+		}
+		j.Args = json.RawMessage(args)
+		jobs = append(jobs, j)
+	}
+	if rows.Err() != nil {
+		log.Errorf("error reading from que_jobs %v", rows.Err())
+		writeError(w, http.StatusInternalServerError, "error reading from que_jobs")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleQueues returns the depth of each queue
+func handleQueues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "expected GET")
+		return
+	}
+
+	rows, err := pgxpool.Query(`SELECT queue, count(*), sum((error_count > 0)::int)::bigint, min(run_at) FROM que_jobs
+ GROUP BY queue ORDER BY queue`)
+	if err != nil {
+		log.Errorf("error querying que_jobs %v", err)
+		writeError(w, http.StatusInternalServerError, "error querying que_jobs")
+		return
+	}
+	defer rows.Close()
+
+	depths := []queueDepth{}
+	for rows.Next() {
+		var d queueDepth
+		if err = rows.Scan(&d.Queue, &d.Count, &d.Failed, &d.OldestRunAt); err != nil {
+			log.Errorf("error reading from que_jobs %v", err)
+			writeError(w, http.StatusInternalServerError, "error reading from que_jobs")
+			return
+		}
+		depths = append(depths, d)
+	}
+	if rows.Err() != nil {
+		log.Errorf("error reading from que_jobs %v", rows.Err())
+		writeError(w, http.StatusInternalServerError, "error reading from que_jobs")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, depths)
+}
+
+// handleDeadJobs lists the jobs in que_dead_jobs, optionally filtered with the query params queue and limit (defaults to 100)
+func handleDeadJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "expected GET")
+		return
+	}
+
+	q := r.URL.Query()
+	limit, ok := parseLimit(w, q.Get("limit"))
+	if !ok {
+		return
+	}
+
+	dead, err := jgforce.ListDeadJobs(pgxpool, q.Get("queue"), limit)
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusInternalServerError, "error querying que_dead_jobs")
+		return
+	}
+
+	jobs := []deadJob{}
+	for _, d := range dead {
+		jobs = append(jobs, deadJob{DeadJob: d, Args: json.RawMessage(d.Args)})
+	}
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleRuns lists the most recent runs from jgforce.run_history, optionally filtered by queue and / or type
+func handleRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "expected GET")
+		return
+	}
+
+	q := r.URL.Query()
+	limit, ok := parseLimit(w, q.Get("limit"))
+	if !ok {
+		return
+	}
+
+	runs, err := jgforce.RecentRuns(pgxpool, q.Get("queue"), q.Get("type"), limit)
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusInternalServerError, "error querying jgforce.run_history")
+		return
+	}
+	if runs == nil {
+		runs = []jgforce.Run{}
+	}
+
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handleDonationStatsDuplicates lists the duplicated salesforce.donation_stats__c records, the worst first,
+// optionally limited with the query param limit (defaults to 100)
+func handleDonationStatsDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "expected GET")
+		return
+	}
+
+	limit, ok := parseLimit(w, r.URL.Query().Get("limit"))
+	if !ok {
+		return
+	}
+
+	dups, err := jgforce.DonationStatsDuplicates(pgxpool, limit)
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusInternalServerError, "error querying jgforce.donation_stats_duplicates")
+		return
+	}
+	if dups == nil {
+		dups = []jgforce.DonationStatsDuplicate{}
+	}
+
+	writeJSON(w, http.StatusOK, dups)
+}
+
+// handleRequeueDeadJob moves a dead job back onto its queue, expects a body of {"job_id": 123}
+func handleRequeueDeadJob(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID int64 `json:"job_id"`
+	}
+	if !decodeArgs(w, r, &body) {
+		return
+	}
+	if body.ID == 0 {
+		writeError(w, http.StatusBadRequest, "missing job_id")
+		return
+	}
+
+	err := jgforce.RequeueDeadJob(pgxpool, body.ID)
+	if err == jgforce.ErrDeadJobNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusInternalServerError, "error requeueing dead job")
+		return
+	}
+	log.WithField("job_id", body.ID).Info("Requeued dead job")
+	writeJSON(w, http.StatusAccepted, body)
+}
+
+// handlePurgeDeadJobs deletes dead jobs, expects a body of either {"job_id": 123} to purge a single job
+// or {"before": "2016-10-01T00:00:00Z"} to purge every job which died before then
+func handlePurgeDeadJobs(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID     int64      `json:"job_id"`
+		Before *time.Time `json:"before"`
+	}
+	if !decodeArgs(w, r, &body) {
+		return
+	}
+
+	switch {
+	case body.ID != 0:
+		err := jgforce.PurgeDeadJob(pgxpool, body.ID)
+		if err == jgforce.ErrDeadJobNotFound {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			writeError(w, http.StatusInternalServerError, "error purging dead job")
+			return
+		}
+		log.WithField("job_id", body.ID).Info("Purged dead job")
+		writeJSON(w, http.StatusOK, map[string]int64{"purged": 1})
+	case body.Before != nil:
+		n, err := jgforce.PurgeDeadJobs(pgxpool, *body.Before)
+		if err != nil {
+			log.Error(err)
+			writeError(w, http.StatusInternalServerError, "error purging dead jobs")
+			return
+		}
+		log.WithField("before", *body.Before).Infof("Purged %d dead jobs", n)
+		writeJSON(w, http.StatusOK, map[string]int64{"purged": n})
+	default:
+		writeError(w, http.StatusBadRequest, "missing job_id or before")
+	}
+}
+
+func parseLimit(w http.ResponseWriter, l string) (int, bool) {
+	if l == "" {
+		return 100, true
+	}
+	limit, err := strconv.Atoi(l)
+	if err != nil || limit < 1 {
+		writeError(w, http.StatusBadRequest, "invalid limit, expected integer value >= 1")
+		return 0, false
+	}
+	return limit, true
+}
+
+func decodeArgs(w http.ResponseWriter, r *http.Request, args interface{}) bool {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "expected POST")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body %v", err))
+		return false
+	}
+	return true
+}
+
+func enqueue(w http.ResponseWriter, queue string, jobType string, args interface{}) {
+	if err := jgforce.Enqueue(qc, queue, jobType, args); err != nil {
+		log.Errorf("error adding %s job to queue %s %v", jobType, queue, err)
+		writeError(w, http.StatusInternalServerError, "error adding job to queue")
+		return
+	}
+	log.WithField("args", args).Infof("Added %s job to queue %s", jobType, queue)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"queue":     queue,
+		"job_class": jobType,
+		"args":      args,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("error writing response %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package justgiving
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/homemade/justin"
+	"github.com/homemade/justin/api"
+)
+
+// fundraisingPageResults mirrors justin's FundraisingPageResults but addresses the page by short name alone,
+// justin only accepts a FundraisingPageRef which can't be built outside of a page search
+// (and a RefreshPageResultsJob only carries the page id, so we read the short name from our own database),
+// it also reads the page's currency. The request is cancelled if ctx is done
+func fundraisingPageResults(ctx context.Context, svc *justin.Service, shortName string) (PageResults, error) {
+	res, resBody, err := getPage(ctx, svc, "FundraisingPageResults", "pages/"+shortName)
+	if err != nil {
+		return PageResults{}, err
+	}
+	return readPageResults(res, resBody)
+}
+
+// fundraisingPageResultsByID is fundraisingPageResults for a page without a short name, addressed by its id instead.
+// PageNotFound is set if justgiving doesn't know the page
+func fundraisingPageResultsByID(ctx context.Context, svc *justin.Service, pageID uint) (PageResults, error) {
+	res, resBody, err := getPage(ctx, svc, "FundraisingPageResultsByID", "pagebyid/"+strconv.FormatUint(uint64(pageID), 10))
+	if err != nil {
+		return PageResults{}, err
+	}
+	if res.StatusCode == 404 {
+		return PageResults{PageNotFound: true}, nil
+	}
+	return readPageResults(res, resBody)
+}
+
+// getPage requests the page at /v1/fundraising/{page}, the request is cancelled if ctx is done
+func getPage(ctx context.Context, svc *justin.Service, name string, page string) (*http.Response, string, error) {
+
+	method := "GET"
+	path := bytes.NewBuffer([]byte(svc.BasePath))
+	path.WriteString("/")
+	path.WriteString(svc.APIKey)
+	path.WriteString("/v1/fundraising/")
+	path.WriteString(page)
+
+	req, err := api.BuildRequest(justin.UserAgent, justin.ContentType, method, path.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Cancel = ctx.Done()
+
+	client := &http.Client{Timeout: svc.Timeout}
+	res, resBody, err := api.Do(client, "", name, req, "", svc.HTTPLogger)
+	if err != nil {
+		return nil, "", err
+	}
+	return res, resBody, nil
+}
+
+// readPageResults from the response for a page, a cancelled page (410 Gone) has PageCancelled set
+func readPageResults(res *http.Response, resBody string) (PageResults, error) {
+
+	var result PageResults
+	if res.StatusCode == 410 {
+		result.PageCancelled = true
+		return result, nil
+	}
+
+	if res.StatusCode != 200 {
+		return result, fmt.Errorf("invalid response %s", res.Status)
+	}
+
+	if err := json.Unmarshal([]byte(resBody), &result); err != nil {
+		return result, fmt.Errorf("invalid response %v", err)
+	}
+
+	return result, nil
+}
+
+// team fetches the team with the short name, justin has no support for teams. It returns nil if there is no such team,
+// the request is cancelled if ctx is done
+func team(ctx context.Context, svc *justin.Service, shortName string) (*Team, error) {
+
+	method := "GET"
+	path := bytes.NewBuffer([]byte(svc.BasePath))
+	path.WriteString("/")
+	path.WriteString(svc.APIKey)
+	path.WriteString("/v1/team/")
+	path.WriteString(shortName)
+
+	req, err := api.BuildRequest(justin.UserAgent, justin.ContentType, method, path.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = ctx.Done()
+
+	client := &http.Client{Timeout: svc.Timeout}
+	res, resBody, err := api.Do(client, "", "Team", req, "", svc.HTTPLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("invalid response %s", res.Status)
+	}
+
+	var result Team
+	if err = json.Unmarshal([]byte(resBody), &result); err != nil {
+		return nil, fmt.Errorf("invalid response %v", err)
+	}
+
+	return &result, nil
+}
+
+// page fetches the details of the page with the short name (from the same endpoint as fundraisingPageResults), justin can only
+// find a page by searching. It returns nil if there is no such page or it is cancelled, the request is cancelled if ctx is done
+func page(ctx context.Context, svc *justin.Service, shortName string) (*Page, error) {
+
+	res, resBody, err := getPage(ctx, svc, "Page", "pages/"+shortName)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == 404 || res.StatusCode == 410 {
+		return nil, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("invalid response %s", res.Status)
+	}
+
+	var result struct {
+		PageID    uint   `json:"pageId"`
+		EventID   uint   `json:"eventId"`
+		ShortName string `json:"pageShortName"`
+		Charity   struct {
+			ID uint `json:"id"`
+		} `json:"charity"`
+	}
+	if err = json.Unmarshal([]byte(resBody), &result); err != nil {
+		return nil, fmt.Errorf("invalid response %v", err)
+	}
+
+	return &Page{CharityID: result.Charity.ID, EventID: result.EventID, ID: result.PageID, ShortName: result.ShortName}, nil
+}
@@ -0,0 +1,181 @@
+package justgiving
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/justin"
+	justin_models "github.com/homemade/justin/models"
+)
+
+// Page is a justgiving fundraising page, as found by the page searches
+// (we use our own type as justin's FundraisingPageRef can't be built outside of justin)
+type Page struct {
+	CharityID uint
+	EventID   uint
+	ID        uint
+	ShortName string
+}
+
+// PageResults are the current results of a page along with the page's currency (an ISO 4217 code e.g. GBP) and short name,
+// which justin's FundraisingResults leaves out (PageNotFound is set by FundraisingPageResultsByID for a page justgiving doesn't know)
+type PageResults struct {
+	justin_models.FundraisingResults
+	CurrencyCode string `json:"currencyCode"`
+	ShortName    string `json:"pageShortName"`
+	PageNotFound bool   `json:"-"`
+}
+
+// Team is a justgiving team, its amounts are strings (as justin's FundraisingResults are) in the team's currency
+type Team struct {
+	ID           uint         `json:"id"`
+	ShortName    string       `json:"teamShortName"`
+	Name         string       `json:"name"`
+	Target       string       `json:"teamTarget"`
+	RaisedSoFar  string       `json:"raisedSoFar"`
+	CurrencyCode string       `json:"currencyCode"`
+	Members      []TeamMember `json:"teamMembers"`
+}
+
+// TeamMember is the fundraising page of a member of a team
+type TeamMember struct {
+	PageID    uint   `json:"pageId"`
+	ShortName string `json:"pageShortName"`
+}
+
+// Client is the part of the justgiving api used by the workers, it is created once by the worker (see NewClient)
+// and passed to the jobs, so tests can substitute a fake and it can be wrapped with decorators.
+// Every call is bounded by ctx, a call is abandoned (returning ctx.Err()) once ctx is done.
+type Client interface {
+	// FundraisingPagesForEvent returns every page registered for the event
+	FundraisingPagesForEvent(ctx context.Context, eventID uint) ([]Page, error)
+
+	// FundraisingPageResults returns the current results of the page, PageCancelled is set for a cancelled page
+	FundraisingPageResults(ctx context.Context, shortName string) (PageResults, error)
+
+	// FundraisingPageResultsByID is FundraisingPageResults for a page without a short name, PageNotFound is set if there is no such page
+	FundraisingPageResultsByID(ctx context.Context, pageID uint) (PageResults, error)
+
+	// FundraisingPagesForCharityAndUser returns the charity's pages registered with the user account
+	FundraisingPagesForCharityAndUser(ctx context.Context, charityID uint, account mail.Address) ([]Page, error)
+
+	// Page returns the page with the short name, or nil if there is no such page (or it is cancelled)
+	Page(ctx context.Context, shortName string) (*Page, error)
+
+	// Event returns the event, or nil if there is no such event
+	Event(ctx context.Context, eventID uint) (*justin_models.Event, error)
+
+	// Team returns the team with the short name along with its members, or nil if there is no such team
+	Team(ctx context.Context, shortName string) (*Team, error)
+}
+
+// NewClient creates a Client for the live justgiving api (or the configured JUSTIN_BASE_URL) using the configured api key,
+// its calls share the JGRL rate limiter and are recorded by APILogger
+func NewClient(cfg *config.Config) (Client, error) {
+	if cfg.JustinAPIKey == "" {
+		return nil, errors.New("missing justin api key")
+	}
+	ctx := justin.APIKeyContext{
+		APIKey:         cfg.JustinAPIKey,
+		Env:            justin.Live,
+		Timeout:        (time.Second * 20),
+		HTTPLogger:     APILogger,
+		SkipValidation: true,
+	}
+	svc, err := justin.CreateWithAPIKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating justin service %v", err)
+	}
+	if cfg.JustinBaseURL != "" {
+		svc.BasePath = cfg.JustinBaseURL
+	}
+	return &apiClient{svc: svc}, nil
+}
+
+// apiClient calls the justgiving api with justin
+type apiClient struct {
+	svc *justin.Service
+}
+
+func (c *apiClient) FundraisingPagesForEvent(ctx context.Context, eventID uint) ([]Page, error) {
+	v, err := Call(ctx, func() (interface{}, error) {
+		return c.svc.FundraisingPagesForEvent(eventID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pages(v.([]*justin.FundraisingPageRef)), nil
+}
+
+func (c *apiClient) FundraisingPageResults(ctx context.Context, shortName string) (PageResults, error) {
+	v, err := Call(ctx, func() (interface{}, error) {
+		return fundraisingPageResults(ctx, c.svc, shortName)
+	})
+	if err != nil {
+		return PageResults{}, err
+	}
+	return v.(PageResults), nil
+}
+
+func (c *apiClient) FundraisingPageResultsByID(ctx context.Context, pageID uint) (PageResults, error) {
+	v, err := Call(ctx, func() (interface{}, error) {
+		return fundraisingPageResultsByID(ctx, c.svc, pageID)
+	})
+	if err != nil {
+		return PageResults{}, err
+	}
+	return v.(PageResults), nil
+}
+
+func (c *apiClient) FundraisingPagesForCharityAndUser(ctx context.Context, charityID uint, account mail.Address) ([]Page, error) {
+	v, err := Call(ctx, func() (interface{}, error) {
+		return c.svc.FundraisingPagesForCharityAndUser(charityID, account)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pages(v.([]*justin.FundraisingPageRef)), nil
+}
+
+func (c *apiClient) Page(ctx context.Context, shortName string) (*Page, error) {
+	v, err := Call(ctx, func() (interface{}, error) {
+		return page(ctx, c.svc, shortName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Page), nil
+}
+
+func (c *apiClient) Event(ctx context.Context, eventID uint) (*justin_models.Event, error) {
+	v, err := Call(ctx, func() (interface{}, error) {
+		return c.svc.Event(eventID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*justin_models.Event), nil
+}
+
+func (c *apiClient) Team(ctx context.Context, shortName string) (*Team, error) {
+	v, err := Call(ctx, func() (interface{}, error) {
+		return team(ctx, c.svc, shortName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Team), nil
+}
+
+func pages(refs []*justin.FundraisingPageRef) []Page {
+	pages := make([]Page, 0, len(refs))
+	for _, r := range refs {
+		pages = append(pages, Page{CharityID: r.CharityID(), EventID: r.EventID(), ID: r.ID(), ShortName: r.ShortName()})
+	}
+	return pages
+}
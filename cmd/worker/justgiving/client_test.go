@@ -0,0 +1,127 @@
+package justgiving
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce/cmd/worker/justgiving/jgtest"
+	"github.com/homemade/jgforce/config"
+)
+
+func TestClient(t *testing.T) {
+	fixtures, err := jgtest.ReadFixtures("../../../testdata/justgiving.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := jgtest.NewServer(fixtures)
+	defer srv.Close()
+	srv.PageSize = 2
+
+	jg, err := NewClient(&config.Config{JustinAPIKey: "test", JustinBaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	pages, err := jg.FundraisingPagesForEvent(ctx, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 3 || srv.Requests("FundraisingPagesForEvent") != 2 {
+		t.Errorf("expected 3 pages over 2 requests but have %v over %d", pages, srv.Requests("FundraisingPagesForEvent"))
+	}
+	if len(pages) > 0 && (pages[0] != Page{CharityID: 1000, EventID: 2000, ID: 1, ShortName: "alice-runs"}) {
+		t.Errorf("unexpected page %+v", pages[0])
+	}
+
+	fr, err := jg.FundraisingPageResults(ctx, "alice-runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.TotalRaisedOnline != "100.00" || fr.CurrencyCode != "GBP" || fr.PageCancelled {
+		t.Errorf("unexpected results %+v", fr)
+	}
+	fr, err = jg.FundraisingPageResults(ctx, "carol-runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fr.PageCancelled {
+		t.Errorf("expected carol-runs to be cancelled")
+	}
+
+	account, _ := mail.ParseAddress("bob@example.com")
+	pages, err = jg.FundraisingPagesForCharityAndUser(ctx, 1000, *account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || pages[0].ID != 2 {
+		t.Errorf("expected bob's page but have %v", pages)
+	}
+	account, _ = mail.ParseAddress("nobody@example.com")
+	pages, err = jg.FundraisingPagesForCharityAndUser(ctx, 1000, *account)
+	if err != nil || len(pages) != 0 {
+		t.Errorf("expected no pages but have %v %v", pages, err)
+	}
+
+	event, err := jg.Event(ctx, 2001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil || event.Name != "Great North Run" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	event, err = jg.Event(ctx, 9999)
+	if err != nil || event != nil {
+		t.Errorf("expected no event but have %+v %v", event, err)
+	}
+
+	team, err := jg.Team(ctx, "park-runners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if team == nil || team.ID != 3000 || team.RaisedSoFar != "200.00" || len(team.Members) != 2 || team.Members[1].ShortName != "bob-runs" {
+		t.Errorf("unexpected team %+v", team)
+	}
+	team, err = jg.Team(ctx, "nobody")
+	if err != nil || team != nil {
+		t.Errorf("expected no team but have %+v %v", team, err)
+	}
+
+	page, err := jg.Page(ctx, "bob-runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page == nil || page.ID != 2 || page.EventID != 2000 || page.CharityID != 1000 {
+		t.Errorf("unexpected page %+v", page)
+	}
+	page, err = jg.Page(ctx, "nobody-runs")
+	if err != nil || page != nil {
+		t.Errorf("expected no page but have %+v %v", page, err)
+	}
+}
+
+func TestCallGivenUp(t *testing.T) {
+	// an api which doesn't answer until the test is over (the timeout leaves time to wait on the rate limiter, so the call itself is given up on)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	jg, err := NewClient(&config.Config{JustinAPIKey: "test", JustinBaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fr, err := jg.FundraisingPageResults(ctx, "alice-runs")
+	if err != context.DeadlineExceeded || fr.PageCancelled || fr.CurrencyCode != "" {
+		t.Errorf("expected the call to be given up on with no results but have %+v %v", fr, err)
+	}
+}
@@ -0,0 +1,264 @@
+// Package jgtest provides a fake justgiving api for tests, it serves the endpoints used by the workers from fixtures.
+// Point the workers at it with the JUSTIN_BASE_URL setting (the api key in the path is ignored).
+package jgtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	justin_models "github.com/homemade/justin/models"
+)
+
+// Page fixture, a fundraising page registered by the owner (an email address) for an event
+// (CurrencyCode is served with the page's results, left out if blank)
+type Page struct {
+	CharityID    uint                             `json:"charityId"`
+	EventID      uint                             `json:"eventId"`
+	ID           uint                             `json:"pageId"`
+	ShortName    string                           `json:"pageShortName"`
+	Owner        string                           `json:"owner"`
+	Cancelled    bool                             `json:"cancelled"`
+	CurrencyCode string                           `json:"currencyCode,omitempty"`
+	Results      justin_models.FundraisingResults `json:"results"`
+}
+
+// Team fixture, its members are the page fixtures with the ids in MemberPageIDs
+type Team struct {
+	ID            uint   `json:"id"`
+	ShortName     string `json:"teamShortName"`
+	Name          string `json:"name"`
+	Target        string `json:"teamTarget"`
+	RaisedSoFar   string `json:"raisedSoFar"`
+	CurrencyCode  string `json:"currencyCode"`
+	MemberPageIDs []uint `json:"memberPageIds"`
+}
+
+// Fixtures served by the fake api
+type Fixtures struct {
+	Events []justin_models.Event `json:"events"`
+	Pages  []Page                `json:"pages"`
+	Teams  []Team                `json:"teams"`
+}
+
+// ReadFixtures from a json file
+func ReadFixtures(name string) (Fixtures, error) {
+	var f Fixtures
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return f, fmt.Errorf("error reading fixtures %s %v", name, err)
+	}
+	if err = json.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("error reading fixtures %s %v", name, err)
+	}
+	return f, nil
+}
+
+// Server is a fake justgiving api, its fixtures can be changed while it is running
+type Server struct {
+	*httptest.Server
+
+	// PageSize caps the pages returned per request for an event's pages (so tests can exercise pagination)
+	PageSize int
+
+	mu       sync.Mutex
+	fixtures Fixtures
+	requests map[string]int
+}
+
+// NewServer starts a fake justgiving api serving the fixtures, call Close when done
+func NewServer(f Fixtures) *Server {
+	s := &Server{
+		PageSize: 100,
+		fixtures: f,
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// SetResults of the page with the short name, or cancels it
+func (s *Server) SetResults(shortName string, results justin_models.FundraisingResults, cancelled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.fixtures.Pages {
+		if p.ShortName == shortName {
+			s.fixtures.Pages[i].Results = results
+			s.fixtures.Pages[i].Cancelled = cancelled
+		}
+	}
+}
+
+// SetTeamRaised sets the amount raised so far by the team with the short name
+func (s *Server) SetTeamRaised(shortName string, raised string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.fixtures.Teams {
+		if t.ShortName == shortName {
+			s.fixtures.Teams[i].RaisedSoFar = raised
+		}
+	}
+}
+
+// Requests returns the number of requests made for the named endpoint
+// (Event, FundraisingPagesForEvent, FundraisingPageResults, FundraisingPageResultsByID, FundraisingPagesForCharityAndUser or Team,
+// a Page lookup counts as FundraisingPageResults as they share an endpoint)
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// serve routes /{apikey}/v1/... to the endpoints
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[1] != "v1" || r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case parts[2] == "event" && len(parts) == 4:
+		s.requests["Event"]++
+		s.event(w, parts[3])
+	case parts[2] == "event" && len(parts) == 5 && parts[4] == "pages":
+		s.requests["FundraisingPagesForEvent"]++
+		s.eventPages(w, r, parts[3])
+	case parts[2] == "fundraising" && len(parts) == 5 && parts[3] == "pages":
+		s.requests["FundraisingPageResults"]++
+		// (justgiving ignores the case of short names)
+		s.pageResults(w, func(p Page) bool { return strings.EqualFold(p.ShortName, parts[4]) })
+	case parts[2] == "fundraising" && len(parts) == 5 && parts[3] == "pagebyid":
+		s.requests["FundraisingPageResultsByID"]++
+		s.pageResults(w, func(p Page) bool { return strconv.FormatUint(uint64(p.ID), 10) == parts[4] })
+	case parts[2] == "account" && len(parts) == 5 && parts[4] == "pages":
+		s.requests["FundraisingPagesForCharityAndUser"]++
+		s.accountPages(w, r, parts[3])
+	case parts[2] == "team" && len(parts) == 4:
+		s.requests["Team"]++
+		s.team(w, parts[3])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) event(w http.ResponseWriter, id string) {
+	for _, e := range s.fixtures.Events {
+		if strconv.FormatUint(uint64(e.ID), 10) == id {
+			writeJSON(w, e)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) eventPages(w http.ResponseWriter, r *http.Request, id string) {
+	var pages []Page
+	for _, p := range s.fixtures.Pages {
+		if strconv.FormatUint(uint64(p.EventID), 10) == id {
+			pages = append(pages, p)
+		}
+	}
+	size, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if size < 1 || size > s.PageSize {
+		size = s.PageSize
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	totalPages := (len(pages) + size - 1) / size
+	if totalPages == 0 {
+		totalPages = 1
+	}
+	from, to := (page-1)*size, page*size
+	if from > len(pages) {
+		from = len(pages)
+	}
+	if to > len(pages) {
+		to = len(pages)
+	}
+	writeJSON(w, struct {
+		TotalPages            int    `json:"totalPages"`
+		TotalFundraisingPages int    `json:"totalFundraisingPages"`
+		FundraisingPages      []Page `json:"fundraisingPages"`
+	}{totalPages, len(pages), pages[from:to]})
+}
+
+// pageResults serves the results of the first page matching
+func (s *Server) pageResults(w http.ResponseWriter, match func(Page) bool) {
+	for _, p := range s.fixtures.Pages {
+		if match(p) {
+			if p.Cancelled {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			type charity struct {
+				ID uint `json:"id"`
+			}
+			writeJSON(w, struct {
+				justin_models.FundraisingResults
+				CurrencyCode string  `json:"currencyCode,omitempty"`
+				PageID       uint    `json:"pageId"`
+				EventID      uint    `json:"eventId"`
+				ShortName    string  `json:"pageShortName"`
+				Charity      charity `json:"charity"`
+			}{p.Results, p.CurrencyCode, p.ID, p.EventID, p.ShortName, charity{p.CharityID}})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) accountPages(w http.ResponseWriter, r *http.Request, email string) {
+	charityID := r.URL.Query().Get("charityId")
+	var pages []Page
+	for _, p := range s.fixtures.Pages {
+		if strings.EqualFold(p.Owner, email) && strconv.FormatUint(uint64(p.CharityID), 10) == charityID {
+			pages = append(pages, p)
+		}
+	}
+	if len(pages) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, pages)
+}
+
+func (s *Server) team(w http.ResponseWriter, shortName string) {
+	type member struct {
+		PageID    uint   `json:"pageId"`
+		ShortName string `json:"pageShortName"`
+	}
+	for _, t := range s.fixtures.Teams {
+		if !strings.EqualFold(t.ShortName, shortName) {
+			continue
+		}
+		members := []member{}
+		for _, p := range s.fixtures.Pages {
+			for _, id := range t.MemberPageIDs {
+				if p.ID == id {
+					members = append(members, member{p.ID, p.ShortName})
+				}
+			}
+		}
+		writeJSON(w, struct {
+			Team
+			Members []member `json:"teamMembers"`
+		}{t, members})
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -3,284 +3,294 @@ package justgiving
 import (
 	"errors"
 	"fmt"
-	"os"
-	"strconv"
 	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/time/rate"
 
-	"github.com/jackc/pgx"
+	log "github.com/Sirupsen/logrus"
+	que "github.com/bgentry/que-go"
 
-	"github.com/homemade/justin"
-	justin_models "github.com/homemade/justin/models"
+	"github.com/homemade/jgforce"
+	"github.com/homemade/jgforce/cmd/worker/store"
+	"github.com/homemade/jgforce/config"
 )
 
+// JGRL rate limits our calls to the justgiving api, it is shared by every go routine in the worker
 var JGRL *rate.Limiter
-var JGRLCtx context.Context
-var JGRLCanc context.CancelFunc
 
 func init() {
 	// we setup a rate limit for JG API calls of 3 per second
 	// TODO calculate this based on batch size and heartbeat env vars - once we discover JG API tolerances
 	JGRL = rate.NewLimiter(rate.Limit(3), 3)
-	JGRLCtx, JGRLCanc = context.WithCancel(context.Background())
 }
 
-func Shutdown() {
-	// cancel any pending rate limiter
-	JGRLCanc()
-
-}
-
-func HeartBeat() error {
-
-	// create justin service
-	key := os.Getenv("JUSTIN_APIKEY")
-	if key == "" {
-		return errors.New("missing justin api key")
+// Call the justgiving api with f once the rate limiter allows, returning f's result, giving up if ctx is done first
+// (justin doesn't support contexts so a call given up on carries on in the background until the client timeout,
+// but the caller is free to move on). f's result is passed back over a channel so a call given up on never shares
+// anything with the caller.
+func Call(ctx context.Context, f func() (interface{}, error)) (interface{}, error) {
+	stopwatch := time.Now()
+	err := JGRL.Wait(ctx)
+	rateLimiterWait.Observe(time.Since(stopwatch).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error waiting on justgiving api rate limiter %v", err)
 	}
-	ctx := justin.APIKeyContext{
-		APIKey:         key,
-		Env:            justin.Live,
-		Timeout:        (time.Second * 20),
-		SkipValidation: true,
+	type result struct {
+		v   interface{}
+		err error
 	}
-	svc, err := justin.CreateWithAPIKey(ctx)
-	if err != nil {
-		return fmt.Errorf("error creating justin service %v", err)
+	resc := make(chan result, 1)
+	go func() {
+		v, err := f()
+		resc <- result{v, err}
+	}()
+	select {
+	case res := <-resc:
+		return res.v, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+}
 
-	// connect to justgiving database
-	dbURL := os.Getenv("DATABASE_URL")
-	connCfg, err := pgx.ParseURI(dbURL)
-	if err != nil {
-		return fmt.Errorf("error configuring connection to justgiving database %v", err)
-	}
-	conn, err := pgx.Connect(connCfg)
+// HeartBeat fans out the justgiving work onto the justgiving queue,
+// it enqueues a SyncEventPagesJob for every active event and a RefreshPageResultsJob for each page in the next batch
+// (each job is then worked, and retried on error, independently)
+// ctx bounds the database queries, cancelling it stops the heartbeat
+func HeartBeat(ctx context.Context, cfg *config.Config, qc *que.Client) error {
+
+	st, disconnect, err := store.Connect(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("error connecting to justgiving database %v", err)
+		return err
 	}
-	defer conn.Close()
+	defer disconnect()
 
-	defaultPagePriority := 0
-	defaultPagePriority, err = getDefaultPagePriority(conn)
+	return heartBeat(ctx, cfg, st, qc)
+}
+
+func heartBeat(ctx context.Context, cfg *config.Config, st store.Store, qc *que.Client) error {
+
+	defaultPagePriority, err := st.DefaultPagePriority()
 	if err != nil {
-		return fmt.Errorf("error fetching default page priority from justgiving database %v", err)
+		return err
 	}
 	maxPriority := defaultPagePriority + 10 // every error on a page bumps the priority by 1 (this is in effect max retry for errors)
 
 	// we update results in batches so as not to overload the justgiving api
-	batchSize, err := strconv.Atoi(os.Getenv("JUSTIN_RESULTS_BATCH"))
-	if batchSize < 1 || err != nil {
-		return errors.New("missing or invalid JUSTIN_RESULTS_BATCH env var, expected integer value >= 1")
+	batchSize := cfg.JustinResultsBatch
+	if batchSize < 1 {
+		return errors.New("missing JUSTIN_RESULTS_BATCH, expected integer value >= 1")
 	}
-	// retrieve the batch - this searches for non cancelled pages not updated in the last 2 hours
+	// retrieve the batch - non cancelled pages of active events not updated in the last 2 hours
 	// TODO calculate this based on batch size and heartbeat env vars - once we discover JG API tolerances
-	// results are then ordered on priority followed by the last updated timestamp
-	// (the COALESCE postgres function handles null values)
-	// finally the results are limited based on the batch size
-	batch, err := conn.Query(`SELECT page_id FROM justgiving.page_priority
- WHERE priority > 0 AND priority <= $1 AND (fundraising_result_timestamp IS NULL OR fundraising_result_timestamp < (CURRENT_TIMESTAMP - INTERVAL '2 hours'))
- ORDER BY priority, COALESCE(fundraising_result_timestamp, TIMESTAMP '1970-01-01 00:00') LIMIT $2;`, maxPriority, batchSize)
+	nextBatch, err := st.PagesToRefresh(maxPriority, batchSize)
 	if err != nil {
-		return fmt.Errorf("error querying justgiving.page_priority %v", err)
+		return err
 	}
-	var nextBatch []uint
-	for batch.Next() {
-		var pageID uint
-		if err = batch.Scan(&pageID); err != nil {
-			return fmt.Errorf("error reading from justgiving.page_priority %v", err)
-		}
-		if pageID > 0 {
-			nextBatch = append(nextBatch, pageID)
+	// any room left in the batch goes on re-checking unserviceable pages (each at most once a day), they are revived once justgiving has their results
+	var recheck []uint
+	if len(nextBatch) < batchSize {
+		if recheck, err = st.UnserviceablePages(batchSize - len(nextBatch)); err != nil {
+			return err
 		}
 	}
-	batch.Close()
 
 	// next, retrieve events to sync
-	rows, err := conn.Query("SELECT event_id FROM justgiving.event WHERE priority > 0 ORDER BY priority;")
+	events, err := st.EventsToSync()
 	if err != nil {
-		return fmt.Errorf("error querying justgiving.event %v", err)
+		return err
 	}
-	var events []uint
-	for rows.Next() {
-		var eventID uint
-		if err = rows.Scan(&eventID); err != nil {
-			return fmt.Errorf("error reading from justgiving.event %v", err)
+	jgforce.AddProgress(ctx, jgforce.EventsScanned, len(events))
+	jgforce.AddProgress(ctx, "pages to refresh", len(nextBatch))
+	jgforce.AddProgress(ctx, "unserviceable pages to recheck", len(recheck))
+
+	for _, e := range events {
+		if err = ctx.Err(); err != nil {
+			return err
 		}
-		if eventID > 0 {
-			events = append(events, eventID)
+		if err = jgforce.Enqueue(qc, jgforce.JustGivingQueue, jgforce.SyncEventPagesJob, jgforce.SyncEventPagesArgs{EventID: e}); err != nil {
+			return fmt.Errorf("error enqueuing sync of pages for event id %d %v", e, err)
 		}
+		jgforce.AddProgress(ctx, "events enqueued", 1)
 	}
-	rows.Close()
-
-	// if we have some events to sync...
-	if len(events) > 0 {
-		// retrieve pages for the events
-		for _, e := range events {
-
-			// we rate limit this call to the justgiving api
-			if err = JGRL.Wait(JGRLCtx); err != nil {
-				// just return on error - probably a legitimate shutdown by Heroku
-				// (we don't want to fill up the job queue with these errors)
-				return nil
-			}
 
-			next, err := svc.FundraisingPagesForEvent(e)
-			if err != nil {
-				return fmt.Errorf("error fetching pages for event id %d %v", e, err)
-			}
-			for _, p := range next {
-				// check if we have already created records for this page
-				sql := `SELECT page_short_name FROM justgiving.page WHERE page_id=$1`
-				var shortName string
-				err = conn.QueryRow(sql, p.ID()).Scan(&shortName)
-				if err != nil {
-					if err == pgx.ErrNoRows {
-						// if not create them
-						sql = `INSERT INTO justgiving.page (charity_id, event_id, page_id, page_short_name) VALUES($1,$2,$3,$4);`
-						_, err = conn.Exec(sql, p.CharityID(), p.EventID(), p.ID(), p.ShortName())
-						if err != nil {
-							return fmt.Errorf("error creating justgiving.page %v", err)
-						}
-						sql = `INSERT INTO justgiving.page_priority (page_id) VALUES($1);`
-						_, err = conn.Exec(sql, p.ID())
-						if err != nil {
-							return fmt.Errorf("error creating justgiving.page_priority %v", err)
-						}
-					} else {
-						return fmt.Errorf("error querying justgiving.page %v", err)
-					}
-				} else {
-					// if we have already stored the page, check if the short name has changed...
-					if shortName != p.ShortName() { // ...and if it has, update it
-						sql = `UPDATE justgiving.page SET page_short_name=$1,updated_timestamp=CURRENT_TIMESTAMP WHERE page_id=$2`
-						_, err = conn.Exec(sql, p.ShortName(), p.ID())
-						if err != nil {
-							return fmt.Errorf("error updating justgiving.page %v", err)
-						}
-					}
-				}
+	for _, p := range append(nextBatch, recheck...) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = jgforce.Enqueue(qc, jgforce.JustGivingQueue, jgforce.RefreshPageResultsJob, jgforce.RefreshPageResultsArgs{PageID: p}); err != nil {
+			return fmt.Errorf("error enqueuing refresh of results for page id %d %v", p, err)
+		}
+		jgforce.AddProgress(ctx, "pages enqueued", 1)
+	}
 
-				// check if the current page is in the batch
-				if inBatch(nextBatch, p.ID()) {
-
-					// get the current year, month, day
-					now := time.Now()
-					day := now.Day()
-					month := now.Month()
-					year := now.Year()
-
-					// retrieve the latest results (we rate limit this call to the justgiving api)
-					if err = JGRL.Wait(JGRLCtx); err != nil {
-						// just return on error - probably a legitimate shutdown by Heroku
-						// (we don't want to fill up the job queue with these errors)
-						return nil
-					}
-
-					serviceable := (p.ShortName() != "") // TODO investigate handling pages wih no short names
-					var fr justin_models.FundraisingResults
-					if serviceable {
-						fr, err = svc.FundraisingPageResults(p)
-						if err != nil {
-							// if there was an error try and bump the priority of the page (except if the page is cancelled or unserviceable i.e. priority is 0 - need to handle pages manually set to unserviceable here too!)
-							sql = `UPDATE justgiving.page_priority SET priority=priority+1 WHERE page_id=$1 AND priority <> 0`
-							conn.Exec(sql, p.ID())
-							return fmt.Errorf("error fetching justgiving results for page id %d with short name `%s` %v", p.ID(), p.ShortName(), err)
-						}
-					}
-
-					// if the page is cancelled or unserviceable set the priority to 0
-					if fr.PageCancelled || !serviceable {
-						sql = `UPDATE justgiving.page_priority SET priority=0 WHERE page_id=$1`
-						_, err = conn.Exec(sql, p.ID())
-						if err != nil {
-							return fmt.Errorf("error updating justgiving.page_priority for cancelled page %v", err)
-						}
-					} else { // update the results
-						// check if we have already created an initial results record for this page
-						var res uint
-						sql = `SELECT 1 FROM justgiving.fundraising_result WHERE page_id=$1 AND year = 0 and month = 0 and day = 0`
-						err = conn.QueryRow(sql, p.ID()).Scan(&res)
-						if err != nil {
-							if err == pgx.ErrNoRows { // if not create one
-								sql = `INSERT INTO justgiving.fundraising_result (page_id,year,month,day,target,total_raised_percentage_of_target,total_raised_offline,total_raised_online,total_raised_sms,total_estimated_gift_aid)
-	 VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10);`
-								_, err = conn.Exec(sql, p.ID(), 0, 0, 0, fr.Target, fr.TotalRaisedPercentageOfTarget, fr.TotalRaisedOffline, fr.TotalRaisedOnline, fr.TotalRaisedSMS, fr.TotalEstimatedGiftAid)
-								if err != nil {
-									return fmt.Errorf("error creating initial justgiving.fundraising_result %v", err)
-								}
-							} else {
-								return fmt.Errorf("error querying initial justgiving.fundraising_result %v", err)
-							}
-						}
-
-						// check if we have already created a results record for this year/month/day
-						sql = `SELECT 1 FROM justgiving.fundraising_result WHERE page_id=$1 AND year = $2 and month = $3 and day = $4`
-						err = conn.QueryRow(sql, p.ID(), year, month, day).Scan(&res)
-						if err != nil {
-							if err == pgx.ErrNoRows { // if not create one
-								sql = `INSERT INTO justgiving.fundraising_result (page_id,year,month,day,target,total_raised_percentage_of_target,total_raised_offline,total_raised_online,total_raised_sms,total_estimated_gift_aid)
-	 VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10);`
-								_, err = conn.Exec(sql, p.ID(), year, month, day, fr.Target, fr.TotalRaisedPercentageOfTarget, fr.TotalRaisedOffline, fr.TotalRaisedOnline, fr.TotalRaisedSMS, fr.TotalEstimatedGiftAid)
-								if err != nil {
-									return fmt.Errorf("error creating justgiving.fundraising_result %v", err)
-								}
-							} else {
-								return fmt.Errorf("error querying justgiving.fundraising_result %v", err)
-							}
-						} else { // otherwise update the existing record
-							sql = `UPDATE justgiving.fundraising_result
-	 SET target=$1,total_raised_percentage_of_target=$2,total_raised_offline=$3,total_raised_online=$4,total_raised_sms=$5,total_estimated_gift_aid=$6,updated_timestamp=CURRENT_TIMESTAMP
-	 WHERE page_id=$7 AND year=$8 AND month=$9 AND day=$10`
-							_, err = conn.Exec(sql, fr.Target, fr.TotalRaisedPercentageOfTarget, fr.TotalRaisedOffline, fr.TotalRaisedOnline, fr.TotalRaisedSMS, fr.TotalEstimatedGiftAid, p.ID(), year, month, day)
-							if err != nil {
-								return fmt.Errorf("error updating justgiving.fundraising_result %v", err)
-							}
-						}
-					}
-
-					// update result timestamp
-					sql = `UPDATE justgiving.page_priority SET fundraising_result_timestamp=CURRENT_TIMESTAMP WHERE page_id=$1`
-					_, err = conn.Exec(sql, p.ID())
-					if err != nil {
-						return fmt.Errorf("error updating fundraising_result_timestamp on justgiving.page_priority %v", err)
-					}
-
-					// reset any pages which had their priority bumped due to a previous error but have now succeeded
-					sql = `UPDATE justgiving.page_priority SET priority=$1 WHERE page_id=$2 AND priority > $3`
-					_, err = conn.Exec(sql, defaultPagePriority, p.ID(), defaultPagePriority)
-					if err != nil {
-						return fmt.Errorf("error updating fundraising_result_timestamp on justgiving.page_priority %v", err)
-					}
+	return nil
 
-				}
+}
+
+// SyncEventPages retrieves the fundraising pages for the event and creates (or updates) the matching justgiving.page records,
+// ctx bounds the justgiving api call and database queries
+func SyncEventPages(ctx context.Context, cfg *config.Config, jg Client, eventID uint) error {
+
+	st, disconnect, err := store.Connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
 
+	return syncEventPages(ctx, st, jg, eventID)
+}
+
+func syncEventPages(ctx context.Context, st store.Store, jg Client, eventID uint) error {
+
+	next, err := jg.FundraisingPagesForEvent(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("error fetching pages for event id %d %v", eventID, err)
+	}
+	jgforce.AddProgress(ctx, "pages fetched", len(next))
+	for _, p := range next {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		// each page is synced as a unit, so a page is never left without its priority
+		added := false
+		err = st.Transact(func(tx store.Store) error {
+			// check if we have already created records for this page
+			shortName, found, err := tx.PageShortName(p.ID)
+			if err != nil {
+				return err
+			}
+			if !found {
+				// if not create them
+				added = true
+				return tx.AddPage(p.CharityID, p.EventID, p.ID, p.ShortName)
+			}
+			// if we have already stored the page, check if the short name has changed...
+			if shortName != p.ShortName { // ...and if it has, update it
+				return tx.UpdatePageShortName(p.ID, p.ShortName)
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
+		if added {
+			jgforce.AddProgress(ctx, jgforce.PagesDiscovered, 1)
+		}
+		jgforce.AddProgress(ctx, "pages synced", 1)
 	}
 
 	return nil
+}
+
+// RefreshPageResults retrieves the latest fundraising results for the page and stores them against the current day
+// (a page without a short name is looked up by its id), ctx bounds the justgiving api call and database queries
+func RefreshPageResults(ctx context.Context, cfg *config.Config, jg Client, pageID uint) error {
+
+	st, disconnect, err := store.Connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
 
+	return refreshPageResults(ctx, st, jg, pageID)
 }
 
-func inBatch(batch []uint, search uint) bool {
-	for _, p := range batch {
-		if search == p {
-			return true
+func refreshPageResults(ctx context.Context, st store.Store, jg Client, pageID uint) error {
+
+	defaultPagePriority, err := st.DefaultPagePriority()
+	if err != nil {
+		return err
+	}
+
+	shortName, found, err := st.PageShortName(pageID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// nothing to refresh, the page has been removed since the job was enqueued
+		return nil
+	}
+
+	// get the current year, month, day
+	now := time.Now()
+
+	// retrieve the latest results, justin addresses pages by short name so a page without one is looked up by its id
+	var fr PageResults
+	if shortName != "" {
+		fr, err = jg.FundraisingPageResults(ctx, shortName)
+	} else {
+		fr, err = jg.FundraisingPageResultsByID(ctx, pageID)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// being cancelled isn't an error on the page, so leave its priority alone
+			return ctx.Err()
 		}
+		// if there was an error try and bump the priority of the page so it is refreshed later (except if the page is cancelled or unserviceable i.e. priority is 0)
+		// (failing to is logged, the error fetching the results is the one the job fails with)
+		if berr := st.BumpPagePriority(pageID); berr != nil {
+			log.WithField("page_id", pageID).Errorf("error bumping page priority %v", berr)
+		}
+		return fmt.Errorf("error fetching justgiving results for page id %d with short name `%s` %v", pageID, shortName, err)
 	}
-	return false
-}
+	jgforce.AddProgress(ctx, "results fetched", 1)
+	// the page is unserviceable if justgiving doesn't know it by its id either
+	serviceable := !fr.PageNotFound
 
-func getDefaultPagePriority(conn *pgx.Conn) (int, error) {
-	sql := `SELECT CAST(COALESCE(adsrc, '0') AS INTEGER) AS default_value
- FROM pg_catalog.pg_attrdef pad, pg_catalog.pg_attribute pat, pg_catalog.pg_class pc
- WHERE pc.relname='page_priority'
- AND pc.oid=pat.attrelid AND pat.attname='priority'
- AND pat.attrelid=pad.adrelid AND pat.attnum=pad.adnum;`
-	var result int
-	err := conn.QueryRow(sql).Scan(&result)
-	return result, err
+	// the results are then stored as a unit (once the api call is done, so the transaction is short)
+	// so the page's results, its result timestamp and its priority always change together
+	revived := false
+	err = st.Transact(func(tx store.Store) error {
+		switch {
+		case fr.PageCancelled: // if the page is cancelled set the priority to 0
+			if err := tx.SetPagePriority(pageID, 0); err != nil {
+				return err
+			}
+		case !serviceable: // as for an unserviceable page, which is re-checked every so often
+			if err := tx.SetPageUnserviceable(pageID); err != nil {
+				return err
+			}
+		default: // update the results
+			// a page looked up by its id may have a short name by now, use it from now on
+			if shortName == "" && fr.ShortName != "" {
+				if err := tx.UpdatePageShortName(pageID, fr.ShortName); err != nil {
+					return err
+				}
+			}
+			if err := tx.SaveResults(pageID, now.Year(), int(now.Month()), now.Day(), fr.CurrencyCode, fr.FundraisingResults); err != nil {
+				return err
+			}
+			// and revive the page if it was unserviceable
+			var err error
+			if revived, err = tx.RevivePage(pageID, defaultPagePriority); err != nil {
+				return err
+			}
+		}
+
+		// update result timestamp
+		if err := tx.SetResultsRefreshed(pageID); err != nil {
+			return err
+		}
+
+		// reset any pages which had their priority bumped due to a previous error but have now succeeded
+		return tx.ResetPagePriority(pageID, defaultPagePriority)
+	})
+	if err != nil {
+		return err
+	}
+
+	if fr.PageCancelled {
+		pagesCancelled.Inc()
+		jgforce.AddProgress(ctx, jgforce.PagesCancelled, 1)
+	}
+	if serviceable && !fr.PageCancelled {
+		pagesRefreshed.Inc()
+		jgforce.AddProgress(ctx, jgforce.PagesRefreshed, 1)
+	}
+	if revived {
+		jgforce.AddProgress(ctx, "pages revived", 1)
+	}
+
+	return nil
 }
@@ -0,0 +1,105 @@
+package justgiving
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce/cmd/worker/justgiving/jgtest"
+	"github.com/homemade/jgforce/cmd/worker/store"
+	"github.com/homemade/jgforce/config"
+)
+
+func TestSyncAndRefresh(t *testing.T) {
+	fixtures, err := jgtest.ReadFixtures("../../../testdata/justgiving.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := jgtest.NewServer(fixtures)
+	defer srv.Close()
+	jg, err := NewClient(&config.Config{JustinAPIKey: "test", JustinBaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	st := store.NewMemory()
+	st.AddEvent(store.Event{CharityID: 1000, ID: 2000, Name: "Royal Parks Half Marathon"})
+
+	if err = syncEventPages(ctx, st, jg, 2000); err != nil {
+		t.Fatal(err)
+	}
+	pages, _ := st.PagesToRefresh(store.DefaultPriority+10, 10)
+	if len(pages) != 3 {
+		t.Fatalf("expected the 3 pages of event 2000 to need refreshing but have %v", pages)
+	}
+	// syncing again doesn't add the pages twice
+	if err = syncEventPages(ctx, st, jg, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if pages, _ = st.PagesToRefresh(store.DefaultPriority+10, 10); len(pages) != 3 {
+		t.Errorf("expected 3 pages after syncing again but have %v", pages)
+	}
+
+	for _, p := range pages {
+		if err = refreshPageResults(ctx, st, jg, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, _ := st.Results(1, 0)
+	if len(results) != 2 || results[0].TotalRaised.String() != "100.00" || results[0].EventName != "Royal Parks Half Marathon" || results[1].Year != 0 {
+		t.Errorf("expected daily and initial results for page 1 but have %+v", results)
+	}
+	if priority, _, _ := st.PagePriority(3); priority != 0 {
+		t.Errorf("expected cancelled page 3 to have priority 0 but have %d", priority)
+	}
+	if pages, _ = st.PagesToRefresh(store.DefaultPriority+10, 10); len(pages) != 0 {
+		t.Errorf("expected no pages to need refreshing once refreshed but have %v", pages)
+	}
+
+	// a page justgiving doesn't know has its priority bumped
+	st.AddPage(1000, 2000, 99, "nobody-runs")
+	if err = refreshPageResults(ctx, st, jg, 99); err == nil {
+		t.Error("expected an error refreshing an unknown page")
+	}
+	if priority, _, _ := st.PagePriority(99); priority != store.DefaultPriority+1 {
+		t.Errorf("expected page 99 to have its priority bumped but have %d", priority)
+	}
+	// and pages removed since the job was enqueued are skipped
+	if err = refreshPageResults(ctx, st, jg, 100); err != nil {
+		t.Error(err)
+	}
+
+	// a page without a short name justgiving doesn't know by its id either is unserviceable
+	st.AddPage(1000, 2000, 98, "")
+	if err = refreshPageResults(ctx, st, jg, 98); err != nil {
+		t.Fatal(err)
+	}
+	if priority, _, _ := st.PagePriority(98); priority != 0 {
+		t.Errorf("expected unserviceable page 98 to have priority 0 but have %d", priority)
+	}
+	// an unserviceable page is re-checked (though not straight away) and revived once justgiving has its results
+	st.AddEvent(store.Event{CharityID: 1000, ID: 2001, Name: "Great North Run"})
+	st.AddPage(1000, 2001, 4, "")
+	st.SetPageUnserviceable(4)
+	if pages, _ = st.UnserviceablePages(10); len(pages) != 1 || pages[0] != 4 {
+		t.Fatalf("expected unserviceable page 4 to need re-checking but have %v", pages)
+	}
+	if err = refreshPageResults(ctx, st, jg, 4); err != nil {
+		t.Fatal(err)
+	}
+	if priority, _, _ := st.PagePriority(4); priority != store.DefaultPriority {
+		t.Errorf("expected revived page 4 to have the default priority but have %d", priority)
+	}
+	if shortName, _, _ := st.PageShortName(4); shortName != "dave-runs" {
+		t.Errorf("expected page 4 to have the short name from justgiving but have %q", shortName)
+	}
+	if results, _ = st.Results(4, 1); len(results) != 1 || results[0].TotalRaised.String() != "10.00" {
+		t.Errorf("expected results for page 4 but have %+v", results)
+	}
+	if pages, _ = st.UnserviceablePages(10); len(pages) != 0 {
+		t.Errorf("expected no unserviceable pages to re-check but have %v", pages)
+	}
+	if n := srv.Requests("FundraisingPageResultsByID"); n != 2 {
+		t.Errorf("expected pages 98 and 4 to be looked up by id but have %d requests", n)
+	}
+}
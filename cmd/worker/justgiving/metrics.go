@@ -0,0 +1,38 @@
+package justgiving
+
+import (
+	"strings"
+
+	"github.com/homemade/justin/api"
+
+	"github.com/homemade/jgforce/metrics"
+)
+
+var (
+	apiCalls = metrics.NewCounter("jgforce_justgiving_api_calls_total", "JustGiving api calls, by method and response status (or error).",
+		"method", "status")
+	rateLimiterWait = metrics.NewHistogram("jgforce_justgiving_rate_limiter_wait_seconds", "Time spent waiting on the JustGiving api rate limiter.",
+		metrics.DefBuckets)
+	pagesRefreshed = metrics.NewCounter("jgforce_pages_refreshed_total", "Fundraising pages with refreshed results.")
+	pagesCancelled = metrics.NewCounter("jgforce_pages_cancelled_total", "Fundraising pages found to be cancelled when refreshing their results.")
+)
+
+// APILogger counts the justgiving api calls, it is the HTTPLogger of our justin services
+var APILogger api.Logger = api.LoggerFunc(countAPICall)
+
+func countAPICall(c api.Call) {
+	apiCalls.Inc(c.CalleeID, callStatus(c))
+}
+
+// callStatus reads the status code from the call, justin only gives us the response formatted with %v
+// i.e. &{200 OK 200 HTTP/1.1 ...
+func callStatus(c api.Call) string {
+	if c.Err != "" && c.Err != "<nil>" {
+		return "error"
+	}
+	fields := strings.Fields(strings.TrimPrefix(c.Res, "&{"))
+	if len(fields) == 0 || c.Res == "<nil>" {
+		return "unknown"
+	}
+	return fields[0]
+}
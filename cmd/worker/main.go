@@ -1,38 +1,94 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/homemade/jgforce"
 	"github.com/homemade/jgforce/cmd/worker/justgiving"
 	"github.com/homemade/jgforce/cmd/worker/salesforce"
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/jgforce/metrics"
+	"github.com/homemade/jgforce/migrations"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/bgentry/que-go"
 	"github.com/jackc/pgx"
 )
 
-func jgJob(j *que.Job) error {
-	stopwatch := time.Now()
-	err := justgiving.HeartBeat()
-	if err != nil {
-		log.Errorf("error in justgiving worker after running for %v %v", time.Since(stopwatch), err)
+func jgJob(cfg *config.Config, qc *que.Client) jgforce.JobFunc {
+	return func(ctx context.Context, j *que.Job) error {
+		stopwatch := time.Now()
+		err := justgiving.HeartBeat(ctx, cfg, qc)
+		if err != nil {
+			log.Errorf("error in justgiving worker after running for %v %v", time.Since(stopwatch), err)
+		}
+		log.Infof("justgiving worker took %v to complete", time.Since(stopwatch))
+		return err
 	}
-	log.Infof("justgiving worker took %v to complete", time.Since(stopwatch))
-	return err
 }
 
-func sfJob(j *que.Job) error {
-	stopwatch := time.Now()
-	err := salesforce.HeartBeat()
-	if err != nil {
-		log.Errorf("error in salesforce worker after running for %v %v", time.Since(stopwatch), err)
+func jgSyncEventPagesJob(cfg *config.Config, jg justgiving.Client) jgforce.JobFunc {
+	return func(ctx context.Context, j *que.Job) error {
+		var args jgforce.SyncEventPagesArgs
+		if err := json.Unmarshal(j.Args, &args); err != nil {
+			return fmt.Errorf("invalid args for %s job %v", j.Type, err)
+		}
+		stopwatch := time.Now()
+		err := justgiving.SyncEventPages(ctx, cfg, jg, args.EventID)
+		if err != nil {
+			log.Errorf("error in justgiving worker syncing pages for event id %d after running for %v %v", args.EventID, time.Since(stopwatch), err)
+		}
+		return err
+	}
+}
+
+func jgRefreshPageResultsJob(cfg *config.Config, jg justgiving.Client) jgforce.JobFunc {
+	return func(ctx context.Context, j *que.Job) error {
+		var args jgforce.RefreshPageResultsArgs
+		if err := json.Unmarshal(j.Args, &args); err != nil {
+			return fmt.Errorf("invalid args for %s job %v", j.Type, err)
+		}
+		stopwatch := time.Now()
+		err := justgiving.RefreshPageResults(ctx, cfg, jg, args.PageID)
+		if err != nil {
+			log.Errorf("error in justgiving worker refreshing results for page id %d after running for %v %v", args.PageID, time.Since(stopwatch), err)
+		}
+		return err
+	}
+}
+
+func sfJob(cfg *config.Config, jg justgiving.Client) jgforce.JobFunc {
+	return func(ctx context.Context, j *que.Job) error {
+		stopwatch := time.Now()
+		err := salesforce.HeartBeat(ctx, cfg, jg)
+		if err != nil {
+			log.Errorf("error in salesforce worker after running for %v %v", time.Since(stopwatch), err)
+		}
+		log.Infof("salesforce worker took %v to complete", time.Since(stopwatch))
+		return err
+	}
+}
+
+func sfResyncContactJob(cfg *config.Config, jg justgiving.Client) jgforce.JobFunc {
+	return func(ctx context.Context, j *que.Job) error {
+		var args jgforce.ResyncContactArgs
+		if err := json.Unmarshal(j.Args, &args); err != nil {
+			return fmt.Errorf("invalid args for %s job %v", j.Type, err)
+		}
+		stopwatch := time.Now()
+		err := salesforce.ResyncContact(ctx, cfg, jg, args.ContactID)
+		if err != nil {
+			log.Errorf("error in salesforce worker resyncing contact %s after running for %v %v", args.ContactID, time.Since(stopwatch), err)
+		}
+		return err
 	}
-	log.Infof("salesforce worker took %v to complete", time.Since(stopwatch))
-	return err
 }
 
 func main() {
@@ -40,38 +96,99 @@ func main() {
 	var pgxpool *pgx.ConnPool
 	var err error
 
-	dbURL := os.Getenv("DATABASE_URL")
-	pgxpool, qc, err = jgforce.Setup(dbURL)
+	// Load the config (reporting every problem with it, rather than just the first)
+	cfg, err := config.Load(config.DatabaseURL, config.JustinAPIKey, config.JustinResultsBatch)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Every job calls the justgiving api through the one client (sharing its rate limiter)
+	jg, err := justgiving.NewClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Read the number of go routines and poll interval for each queue
+	jgCount := cfg.JustGivingWorkers
+	jgInterval := cfg.JustGivingPollInterval
+	sfCount := cfg.SalesForceWorkers
+	sfInterval := cfg.SalesForcePollInterval
+
+	// Bring the database schema up to date before we start working jobs
+	// (the migrations are run holding a lock, so only one worker applies them when several start at once)
+	dbURL := cfg.DatabaseURL
+	if err = migrations.Migrate(dbURL); err != nil {
+		log.WithField("DATABASE_URL", dbURL).Fatal("Error migrating the database: ", err)
+	}
+
+	// Each go routine holds a connection while working a job, plus we leave a couple spare for enqueueing
+	pgxpool, qc, err = jgforce.SetupWithMaxConnections(dbURL, jgCount+sfCount+2)
 	if err != nil {
 		log.WithField("DATABASE_URL", dbURL).Fatal("Error setting up the queue / database: ", err)
 	}
 	defer pgxpool.Close()
 
-	// Just 1 worker / go routines in each pool (1 for each queue)
-	jgWorkers := que.NewWorkerPool(qc, que.WorkMap{
-		jgforce.HeartbeatJob: jgJob,
-	}, 1)
+	// Every job runs with this context, cancelling it on shutdown stops the jobs mid-run
+	// (their database queries and justgiving api calls are abandoned, and que retries the jobs later)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Each job is also cancelled if it runs past the timeout for its type, these can be overridden with JOB_TIMEOUTS
+	// e.g. Heartbeat=1h,RefreshPageResults=1m
+	for jobType, t := range cfg.JobTimeouts {
+		jgforce.JobTimeouts[jobType] = t
+	}
+
+	// The justgiving heartbeat fans out into a job per event and per page, so we spread these across JUSTGIVING_WORKERS go routines
+	// (the justgiving api rate limiter is shared by all of them, and by the salesforce go routines, so adding more
+	// go routines never increases our api usage beyond the limit)
+	// (jobs which fail on their final attempt, including by timing out, are moved to the dead jobs table rather than retried forever,
+	// except for jobs cancelled as the worker shuts down, which que retries)
+	// (every job is recorded in the jgforce.run_history table)
+	jgWorkers := jgforce.NewWorkerPool(qc, jgforce.WithDeadLetter(ctx, jgforce.WithMetrics(jgforce.WithTimeout(ctx, jgforce.WithRunHistory(jgforce.JobMap{
+		jgforce.HeartbeatJob:          jgJob(cfg, qc),
+		jgforce.SyncEventPagesJob:     jgSyncEventPagesJob(cfg, jg),
+		jgforce.RefreshPageResultsJob: jgRefreshPageResultsJob(cfg, jg),
+	})))), jgCount)
 	jgWorkers.Queue = jgforce.JustGivingQueue
-	jgWorkers.Interval = 30 * time.Second // our heartbeat is set in minutes so no point polling too often
-	sfWorkers := que.NewWorkerPool(qc, que.WorkMap{
-		jgforce.HeartbeatJob: sfJob,
-	}, 1)
+	jgWorkers.Interval = jgInterval // the listener wakes us when jobs are added, so polling is just a fallback
+	// And SALESFORCE_WORKERS go routines for the salesforce queue
+	sfWorkers := jgforce.NewWorkerPool(qc, jgforce.WithDeadLetter(ctx, jgforce.WithMetrics(jgforce.WithTimeout(ctx, jgforce.WithRunHistory(jgforce.JobMap{
+		jgforce.HeartbeatJob:     sfJob(cfg, jg),
+		jgforce.ResyncContactJob: sfResyncContactJob(cfg, jg),
+	})))), sfCount)
 	sfWorkers.Queue = jgforce.SalesForceQueue
-	sfWorkers.Interval = 30 * time.Second // our heartbeat is set in minutes so no point polling too often
+	sfWorkers.Interval = sfInterval // the listener wakes us when jobs are added, so polling is just a fallback
+
+	// Wake the pools as soon as jobs are added to their queues
+	listener, err := jgforce.NewListener(dbURL, jgWorkers, sfWorkers)
+	if err != nil {
+		log.WithField("DATABASE_URL", dbURL).Fatal("Error setting up the queue listener: ", err)
+	}
+
+	// Serve metrics on METRICS_PORT (default 9090), the jobs worked, failed and their durations
+	// are recorded for every job type along with the justgiving api calls made by the jobs
+	metricsPort := cfg.MetricsPort
+	if metricsPort == "" {
+		metricsPort = "9090"
+	}
+	jgforce.CollectQueueDepth(pgxpool)
+	metrics.Serve(":" + metricsPort)
 
 	// Catch signal so we can shutdown gracefully
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 
-	go jgWorkers.Start()
-	go sfWorkers.Start()
+	jgWorkers.Start()
+	sfWorkers.Start()
+	listener.Start()
 
 	// Wait for a signal
 	sig := <-sigCh
 	log.WithField("signal", sig).Info("Signal received. Shutting down.")
 
-	justgiving.Shutdown()
+	cancel()
 
+	listener.Stop()
 	jgWorkers.Shutdown()
 	sfWorkers.Shutdown()
 }
@@ -1,267 +1,308 @@
 package salesforce
 
 import (
-	"errors"
 	"fmt"
-	"math"
 	"net/mail"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
 
+	"github.com/homemade/jgforce"
 	"github.com/homemade/jgforce/cmd/worker/justgiving"
-	"github.com/homemade/justin"
-
-	"github.com/jackc/pgx"
+	"github.com/homemade/jgforce/cmd/worker/store"
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/jgforce/decimal"
+	"github.com/homemade/jgforce/metrics"
 )
 
-func HeartBeat() error {
+var donationStatsInserted = metrics.NewCounter("jgforce_donation_stats_inserted_total",
+	"Records inserted into salesforce.donation_stats__c, by kind (master or detail).", "kind")
 
-	// create justin service
-	key := os.Getenv("JUSTIN_APIKEY")
-	if key == "" {
-		return errors.New("missing justin api key")
-	}
-	ctx := justin.APIKeyContext{
-		APIKey:         key,
-		Env:            justin.Live,
-		Timeout:        (time.Second * 20),
-		SkipValidation: true,
+// HeartBeat searches for the justgiving pages of new salesforce contacts and syncs the donation stats of matched pages,
+// ctx bounds the justgiving api calls and database queries, cancelling it stops the heartbeat
+func HeartBeat(ctx context.Context, cfg *config.Config, jg justgiving.Client) error {
+
+	st, disconnect, err := store.Connect(ctx, cfg)
+	if err != nil {
+		return err
 	}
-	svc, err := justin.CreateWithAPIKey(ctx)
+	defer disconnect()
+
+	return heartBeat(ctx, cfg, st, jg)
+}
+
+func heartBeat(ctx context.Context, cfg *config.Config, st store.Store, jg justgiving.Client) error {
+
+	ts := make(teams)
+
+	// next, retrieve new contacts
+	contacts, err := st.NewContacts()
 	if err != nil {
-		return fmt.Errorf("error creating justin service %v", err)
+		return err
+	}
+	var crecs []store.Contact
+	for _, r := range contacts {
+		if r.ID != nil && *r.ID != "" {
+			crecs = append(crecs, r)
+		}
 	}
+	jgforce.AddProgress(ctx, "new contacts", len(crecs))
 
-	// connect to database
-	dbURL := os.Getenv("DATABASE_URL")
-	connCfg, err := pgx.ParseURI(dbURL)
+	// try and find a justgiving fundraising page for the new contacts
+	for _, c := range crecs {
+		if err = searchForPage(ctx, cfg, jg, st, ts, c); err != nil {
+			return err
+		}
+		jgforce.AddProgress(ctx, "contacts searched", 1)
+	}
+	// NOTE: the search functions handle creation of donation stats master records when a matching page is found
+
+	// update donation stats detail records (and check if the page name needs updating on the master record)
+	// first get a list of the page ids and their last update timestamp
+	pages, err := st.DonationStatsPages("")
 	if err != nil {
-		return fmt.Errorf("error configuring connection to database %v", err)
+		return err
 	}
-	conn, err := pgx.Connect(connCfg)
+	jgforce.AddProgress(ctx, "pages to sync", len(pages))
+	if err = refreshTeams(ctx, jg, st, ts, pages); err != nil {
+		return err
+	}
+
+	// then sync the results for each page
+	for _, p := range pages {
+		if err = syncDonationStats(ctx, cfg, st, p); err != nil {
+			return err
+		}
+		jgforce.AddProgress(ctx, "pages synced", 1)
+	}
+
+	return nil
+}
+
+// ResyncContact re-runs the page search for a single salesforce contact
+func ResyncContact(ctx context.Context, cfg *config.Config, jg justgiving.Client, contactID string) error {
+
+	st, disconnect, err := store.Connect(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("error connecting to database %v", err)
+		return err
 	}
-	defer conn.Close()
+	defer disconnect()
 
-	// next, retrieve new contacts
-	sql := `SELECT c.sfid, c.jg_charity_id__c, c.event_id__c, c.fundraising_page_id__c,
- c.fundraising_page_url__c, c.fundraising_team_page_url__c,
- CASE WHEN c.fundraiser_jg_email__c IS NULL OR c.fundraiser_jg_email__c='' THEN c.email
- 	ELSE c.fundraiser_jg_email__c
- END AS email
- FROM salesforce.contact c LEFT OUTER JOIN salesforce.donation_stats__c d
- ON (c.sfid = d.related_contact_record__c)
- WHERE d.sfid IS NULL ORDER BY c.systemmodstamp DESC;`
-	contacts, err := conn.Query(sql)
+	return resyncContact(ctx, cfg, st, jg, contactID)
+}
+
+func resyncContact(ctx context.Context, cfg *config.Config, st store.Store, jg justgiving.Client, contactID string) error {
+
+	c, err := st.Contact(contactID)
 	if err != nil {
-		return fmt.Errorf("error querying new salesforce.contacts %v", err)
+		return err
+	}
+	if c == nil {
+		return fmt.Errorf("unknown salesforce contact %s", contactID)
 	}
 
-	var crecs []ContactRecord
-	for contacts.Next() {
-		var r ContactRecord
-		if err = contacts.Scan(&r.ID, &r.CharityID, &r.EventID, &r.PageID, &r.PageURL, &r.TeamPageURL, &r.Email); err != nil {
-			return fmt.Errorf("error reading from new salesforce.contacts %v", err)
-		}
-		// TODO handle team pages
-		if r.ID != nil && *r.ID != "" && (r.TeamPageURL == nil || *r.TeamPageURL == "") {
-			crecs = append(crecs, r)
+	ts := make(teams)
+	// NOTE: a master record is only ever created once for a page, so this is safe to repeat for an already matched contact
+	if err = searchForPage(ctx, cfg, jg, st, ts, *c); err != nil {
+		return err
+	}
+
+	pages, err := st.DonationStatsPages(contactID)
+	if err != nil {
+		return err
+	}
+	jgforce.AddProgress(ctx, "pages to sync", len(pages))
+	if err = refreshTeams(ctx, jg, st, ts, pages); err != nil {
+		return err
+	}
+	for _, p := range pages {
+		if err = syncDonationStats(ctx, cfg, st, p); err != nil {
+			return err
 		}
+		jgforce.AddProgress(ctx, "pages synced", 1)
 	}
-	contacts.Close()
 
-	// try and find a justgiving fundraising page for the new contacts
+	return nil
+}
 
-	for _, c := range crecs {
-		// get salesforce contact id for reference
-		sfcid := ""
-		if c.ID != nil {
-			sfcid = *c.ID
-		}
-		// our order of precedence for the search is:
-		// 1. Try ids
-
-		// try and use default charity id if none is provided
-		rawCharityID := 0
-		if c.CharityID == nil || *c.CharityID == "" {
-			rawCharityID, err = strconv.Atoi(os.Getenv("JUSTIN_CHARITY"))
-			if err != nil {
-				log.Warnf("failed to set charity id from default %s %v", os.Getenv("JUSTIN_CHARITY"), err)
-			}
-		} else {
-			rawCharityID, err = strconv.Atoi(*c.CharityID)
-			if err != nil {
-				log.Warnf("invalid charity id in salesforce contact %s %v", sfcid, err)
-			}
+// searchForPage tries to find a justgiving fundraising page for the contact
+// (contacts without a charity id fall back to the configured JUSTIN_CHARITY).
+// For a contact with a team page url we look for the contact's own page amongst the team's members,
+// or match the contact with the team itself if TEAM_DONATION_STATS is team.
+func searchForPage(ctx context.Context, cfg *config.Config, jg justgiving.Client, st store.Store, ts teams, c store.Contact) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	// get salesforce contact id for reference
+	sfcid := ""
+	if c.ID != nil {
+		sfcid = *c.ID
+	}
+	// our order of precedence for the search is:
+	// 1. Try ids
+
+	// try and use default charity id if none is provided
+	rawCharityID := 0
+	if c.CharityID == nil || *c.CharityID == "" {
+		rawCharityID = int(cfg.JustinCharity)
+		if rawCharityID == 0 {
+			log.Warnf("failed to set charity id from default for salesforce contact %s, JUSTIN_CHARITY is not set", sfcid)
 		}
-		charityID := uint(rawCharityID)
-
-		rawEventID := 0
-		if c.EventID != nil && *c.EventID != "" {
-			rawEventID, err = strconv.Atoi(*c.EventID)
-			if err != nil {
-				log.Warnf("invalid event id in salesforce contact %s %v", sfcid, err)
-			}
+	} else {
+		rawCharityID, err = strconv.Atoi(*c.CharityID)
+		if err != nil {
+			log.Warnf("invalid charity id in salesforce contact %s %v", sfcid, err)
 		}
-		eventID := uint(rawEventID)
+	}
+	charityID := uint(rawCharityID)
 
-		rawPageID := 0
-		if c.PageID != nil && *c.PageID != "" {
-			rawPageID, err = strconv.Atoi(*c.PageID)
-			if err != nil {
-				log.Warnf("invalid page id in salesforce contact %s %v", sfcid, err)
-			}
+	rawEventID := 0
+	if c.EventID != nil && *c.EventID != "" {
+		rawEventID, err = strconv.Atoi(*c.EventID)
+		if err != nil {
+			log.Warnf("invalid event id in salesforce contact %s %v", sfcid, err)
 		}
-		pageID := uint(rawPageID)
+	}
+	eventID := uint(rawEventID)
 
-		var found bool
-		found, err = searchForPageUsingID(svc, conn, charityID, eventID, pageID, c.ID)
+	rawPageID := 0
+	if c.PageID != nil && *c.PageID != "" {
+		rawPageID, err = strconv.Atoi(*c.PageID)
 		if err != nil {
+			log.Warnf("invalid page id in salesforce contact %s %v", sfcid, err)
+		}
+	}
+	pageID := uint(rawPageID)
+
+	// members are the pages of the contact's team (nil if the contact isn't in a team)
+	var members []uint
+	if c.TeamPageURL != nil && *c.TeamPageURL != "" {
+		shortName, ok := teamShortName(*c.TeamPageURL)
+		if !ok {
+			log.Warnf("invalid team page url %s in salesforce contact %s", *c.TeamPageURL, sfcid)
+			return nil
+		}
+		team, err := ts.refresh(ctx, jg, st, shortName)
+		if err != nil || team == nil {
 			return err
 		}
-		if !found {
-			// 2. If we couldn't find a match with the id, if we can, try the short name
-			shortName := ""
-			// TODO pending data import
-			found, err = searchForPageUsingShortName(svc, conn, shortName)
-			if err != nil {
+		if cfg.TeamDonationStats == "team" {
+			return handleTeamMatch(ctx, cfg, st, team.ID, c.ID)
+		}
+		members = make([]uint, 0, len(team.Members))
+		for _, m := range team.Members {
+			members = append(members, m.PageID)
+		}
+		if pageID > 0 && !in(members, pageID) {
+			log.Warnf("page id %d in salesforce contact %s isn't a member of team %s", pageID, sfcid, shortName)
+			pageID = 0
+		}
+	}
+
+	var found bool
+	found, err = searchForPageUsingID(ctx, cfg, jg, st, charityID, eventID, pageID, c.ID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// 2. If we couldn't find a match with the id, if we can, try the short name in the contact's page url
+		if c.PageURL != nil && *c.PageURL != "" {
+			shortName, ok := pageShortName(*c.PageURL)
+			if !ok {
+				log.Warnf("invalid page url %s in salesforce contact %s", *c.PageURL, sfcid)
+			} else if found, err = searchForPageUsingShortName(ctx, cfg, jg, st, shortName, members, c.ID); err != nil {
 				return err
 			}
-			if !found {
-				// 3. Finally as a fallback try and use the email address of the contact
-				if c.Email != nil {
-					_, err = searchForPageUsingEmail(svc, conn, charityID, c)
-					if err != nil {
-						return err
-					}
+		}
+		if !found {
+			// 3. Finally as a fallback try and use the email address of the contact
+			if c.Email != nil {
+				_, err = searchForPageUsingEmail(ctx, cfg, jg, st, charityID, c, members)
+				if err != nil {
+					return err
 				}
 			}
 		}
 	}
-	// NOTE: the search functions handle creation of donation stats master records when a matching page is found
+	return nil
+}
 
-	// update donation stats detail records (and check if the page name needs updating on the master record)
-	// first get a list of the page ids and their last update timestamp
-	rows, err := conn.Query("SELECT fundraising_page_id__c,MAX(transaction_date__c) FROM salesforce.donation_stats__c GROUP BY fundraising_page_id__c;")
-	if err != nil {
-		return fmt.Errorf("error querying pages from salesforce.donation_stats__c %v", err)
-	}
-	var pages []struct {
-		id string
-		ts *time.Time
-	}
-	for rows.Next() {
-		var pageID *string
-		var transDate *time.Time
-		if err = rows.Scan(&pageID, &transDate); err != nil {
-			return fmt.Errorf("error reading page id and transaction date from salesforce.donation_stats__c %v", err)
+// refreshTeams refreshes the totals of the teams amongst the pages (see store.TeamPageID) from the justgiving api,
+// unless they have already been refreshed by the job
+func refreshTeams(ctx context.Context, jg justgiving.Client, st store.Store, ts teams, pages []store.DonationStatsPage) error {
+	for _, p := range pages {
+		teamID, ok := store.ParseTeamPageID(p.PageID)
+		if !ok {
+			continue
+		}
+		shortName, found, err := st.TeamShortName(teamID)
+		if err != nil {
+			return err
 		}
-		if pageID != nil && *pageID != "" {
-			pages = append(pages,
-				struct {
-					id string
-					ts *time.Time
-				}{*pageID, transDate})
+		if found {
+			if _, err = ts.refresh(ctx, jg, st, shortName); err != nil {
+				return err
+			}
 		}
 	}
-	rows.Close()
+	return nil
+}
 
-	// then fetch the results for each page
-	for _, p := range pages {
-		var results []justgiving.FundraisingResults
-		var pid int
-		pid, err = strconv.Atoi(p.id)
+// syncDonationStats fetches the results for the page and inserts any donation stats detail records
+// for results newer than the page's last update (it also checks if the page name needs updating on the master record).
+// The totals of a team (see store.TeamPageID) are those last refreshed by refreshTeams.
+func syncDonationStats(ctx context.Context, cfg *config.Config, st store.Store, p store.DonationStatsPage) error {
+	var results []store.FundraisingResults
+	if teamID, ok := store.ParseTeamPageID(p.PageID); ok {
+		var err error
+		if results, err = st.TeamResults(teamID, 0); err != nil {
+			return err
+		}
+	} else {
+		pid, err := strconv.Atoi(p.PageID)
 		if err != nil {
-			return fmt.Errorf("error reading justgiving fundraising results for page %s %v", p.id, err)
-		}
-		results, err = justgiving.Results(conn, uint(pid), "")
-		if len(results) > 0 {
-			// check if the page name needs updating on the master record (all items in the results have the latest page name through the view that is used)
-			if results[0].PageShortName != "" {
-				psn := "https://www.justgiving.com/fundraising/" + results[0].PageShortName
-				sql = `UPDATE salesforce.donation_stats__c SET fundraising_page_url__c = $2
-			 WHERE fundraising_page_id__c = $1 AND transaction_date__c IS NULL
-			 AND (fundraising_page_url__c IS NULL OR fundraising_page_url__c <> $2);`
-				_, err = conn.Exec(sql, p.id, psn)
-				if err != nil {
-					return fmt.Errorf("error updating page short name for page id %s on initial salesforce.donation_stats__c record %v", p.id, err)
-				}
+			return fmt.Errorf("error reading justgiving fundraising results for page %s %v", p.PageID, err)
+		}
+		if results, err = st.Results(uint(pid), 0); err != nil {
+			return err
+		}
+	}
+	for i := range results {
+		var ok bool
+		if results[i], ok = inSalesForceCurrency(cfg, results[i]); !ok {
+			log.Warnf("skipping donation stats for page id %s, there is no %s rate for its currency %s", p.PageID, config.CurrencyRates, results[i].Currency)
+			return nil
+		}
+	}
+	if len(results) > 0 {
+		// check if the page name needs updating on the master record (all items in the results have the latest page name through the view that is used)
+		if results[0].PageShortName != "" {
+			psn := "https://www.justgiving.com/fundraising/" + results[0].PageShortName
+			if results[0].TeamID > 0 {
+				psn = "https://www.justgiving.com/teams/" + results[0].PageShortName
 			}
-			// for the non initial results records (incremental records) -  query the salesforce results for the matching year, month, day
-			if len(results) > 1 {
-				// justgiving results are in descending order (we need to handle them in ascending order)
-				// - we also skip the first initial/master record (index length-1)
-				for i := len(results) - 2; i >= 0; i-- {
-					// check if we need to sync this record
-					fr := results[i]
-					if p.ts == nil || fr.Timestamp.After(*p.ts) {
-						// first retrieve the current salesforce amounts
-						var contactID *string
-						var currRaisedOnline, currRaisedSMS, currRaisedOffline, currEstimatedGiftAid, currTargetAmount *float64
-						sql = `SELECT contact_id, raised_online, raised_sms, raised_offline, estimated_gift_aid, target_amount
-		FROM salesforce.contact_page_fundraising_result WHERE page_id = $1;`
-						err = conn.QueryRow(sql, &p.id).Scan(&contactID, &currRaisedOnline, &currRaisedSMS, &currRaisedOffline, &currEstimatedGiftAid, &currTargetAmount)
-						if err != nil {
-							return fmt.Errorf("error reading salesforce.contact_page_fundraising_result record for page id %s %v", p.id, err)
-						}
-						if contactID == nil {
-							return fmt.Errorf("missing contact id when reading salesforce.contact_page_fundraising_result for page id %s", p.id)
-						}
-						if currRaisedOnline == nil {
-							return fmt.Errorf("missing raised online amount reading salesforce.contact_page_fundraising_result record for page id %s", p.id)
-						}
-						if currRaisedSMS == nil {
-							return fmt.Errorf("missing raised sms amount reading salesforce.contact_page_fundraising_result record for page id %s", p.id)
-						}
-						if currRaisedOffline == nil {
-							return fmt.Errorf("missing raised offline amount reading salesforce.contact_page_fundraising_result record for page id %s", p.id)
-						}
-						if currEstimatedGiftAid == nil {
-							return fmt.Errorf("missing estimated gift aid amount reading salesforce.contact_page_fundraising_result record for page id %s", p.id)
-						}
-						if currTargetAmount == nil {
-							return fmt.Errorf("missing target amount reading salesforce.contact_page_fundraising_result record for page id %s", p.id)
-						}
-						// check if anything has changed
-						diffRaisedOnline := fr.TotalRaisedOnline - *currRaisedOnline
-						diffRaisedSMS := fr.TotalRaisedSMS - *currRaisedSMS
-						diffRaisedOffline := fr.TotalRaisedOffline - *currRaisedOffline
-						diffEstimatedGiftAid := fr.TotalEstimatedGiftAid - *currEstimatedGiftAid
-						diffTargetAmount := fr.Target - *currTargetAmount
-
-						if (math.Abs(diffRaisedOnline) > 0.01) || (math.Abs(diffRaisedSMS) > 0.01) || (math.Abs(diffRaisedOffline) > 0.01) || (math.Abs(diffEstimatedGiftAid) > 0.01) || (math.Abs(diffTargetAmount) > 0.01) {
-							log.Infof("inserting donation stats detail record for page id %s and year %d month %d and day %d", p.id, fr.Year, fr.Month, fr.Day)
-							// insert the salesforce record
-							sql = `INSERT INTO salesforce.donation_stats__c
-	 (fundraising_page_id__c, related_contact_record__c, transaction_date__c, raised_online_incremental__c, raised_sms_incremental__c, raised_offline_incremental__c, estimated_gift_aid__c, pledge_amount_revised__c,donation_date__c)
-	 VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9);`
-							_, err = conn.Exec(sql, p.id, *contactID, fr.Timestamp, diffRaisedOnline, diffRaisedSMS, diffRaisedOffline, diffEstimatedGiftAid, diffTargetAmount, fr.Timestamp)
-							if err != nil {
-								return fmt.Errorf("error inserting incremental salesforce.donation_stats__c record for page id %s and year %d month %d and day %d %v", p.id, fr.Year, fr.Month, fr.Day, err)
-							}
-							sql = `SELECT currval(pg_get_serial_sequence('salesforce.donation_stats__c', 'id'));`
-							var donationStatsID int
-							err = conn.QueryRow(sql).Scan(&donationStatsID)
-							if err != nil {
-								return fmt.Errorf("error retreiving inserted id from incremental salesforce.donation_stats__c record %v", err)
-							}
-							sql = `UPDATE salesforce.donation_stats__c SET donation_date__c = date_trunc('second', donation_date__c) WHERE id = $1`
-							_, err = conn.Exec(sql, donationStatsID)
-							if err != nil {
-								return fmt.Errorf("error updating donation_date__c in incremental salesforce.donation_stats__c record %v", err)
-							}
-							log.Infof("rationale: %g %g %g | %g %g %g | %g %g %g | %g %g %g | %g %g %g | %v %v",
-								diffRaisedOnline, fr.TotalRaisedOnline, *currRaisedOnline,
-								diffRaisedSMS, fr.TotalRaisedSMS, *currRaisedSMS,
-								diffRaisedOffline, fr.TotalRaisedOffline, *currRaisedOffline,
-								diffEstimatedGiftAid, fr.TotalEstimatedGiftAid, *currEstimatedGiftAid,
-								diffTargetAmount, fr.Target, *currTargetAmount,
-								fr.Timestamp, p.ts)
-						}
+			if err := st.UpdateDonationStatsPageURL(p.PageID, psn); err != nil {
+				return err
+			}
+		}
+		// for the non initial results records (incremental records) -  query the salesforce results for the matching year, month, day
+		if len(results) > 1 {
+			// justgiving results are in descending order (we need to handle them in ascending order)
+			// - we also skip the first initial/master record (index length-1)
+			for i := len(results) - 2; i >= 0; i-- {
+				// check if we need to sync this record
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				fr := results[i]
+				if p.Updated == nil || fr.Timestamp.After(*p.Updated) {
+					if err := syncDonationStatsDetail(ctx, st, p.PageID, p.ContactID, fr, p.Updated); err != nil {
+						return err
 					}
 				}
 			}
@@ -271,59 +312,151 @@ func HeartBeat() error {
 	return nil
 }
 
-type ContactRecord struct {
-	ID          *string
-	CharityID   *string
-	EventID     *string
-	PageID      *string
-	PageURL     *string
-	TeamPageURL *string
-	Email       *string
+// syncDonationStatsDetail records any change in the page's results since those recorded so far in the page's detail record for the day
+// (keyed by store.DetailKey, so repeating this for the same results is harmless). The totals are read and the detail record saved
+// as a unit so a detail record is never based on stale totals. contactID is the contact of a team's donation stats (blank for a page).
+func syncDonationStatsDetail(ctx context.Context, st store.Store, pageID string, contactID string, fr store.FundraisingResults, updated *time.Time) error {
+	inserted := false
+	err := st.Transact(func(tx store.Store) error {
+		// first retrieve the current salesforce amounts
+		curr, err := tx.DonationStatsTotals(pageID, contactID, "")
+		if err != nil {
+			return err
+		}
+		// check if anything has changed (the amounts are exact, so any difference is a change)
+		diffRaisedOnline := fr.TotalRaisedOnline.Sub(curr.RaisedOnline)
+		diffRaisedSMS := fr.TotalRaisedSMS.Sub(curr.RaisedSMS)
+		diffRaisedOffline := fr.TotalRaisedOffline.Sub(curr.RaisedOffline)
+		diffEstimatedGiftAid := fr.TotalEstimatedGiftAid.Sub(curr.EstimatedGiftAid)
+		diffTargetAmount := fr.Target.Sub(curr.Target)
+
+		if !diffRaisedOnline.IsZero() || !diffRaisedSMS.IsZero() || !diffRaisedOffline.IsZero() || !diffEstimatedGiftAid.IsZero() || !diffTargetAmount.IsZero() {
+			log.Infof("saving donation stats detail record for page id %s and year %d month %d and day %d", pageID, fr.Year, fr.Month, fr.Day)
+			// the day's record holds the whole change since the records of the other days
+			key := store.DetailKey(pageID, contactID, fr.Year, fr.Month, fr.Day)
+			others, err := tx.DonationStatsTotals(pageID, contactID, key)
+			if err != nil {
+				return err
+			}
+			err = tx.SaveDonationStatsDetail(store.DonationStatsDetail{
+				Key:              key,
+				PageID:           pageID,
+				ContactID:        curr.ContactID,
+				Date:             fr.Timestamp,
+				RaisedOnline:     fr.TotalRaisedOnline.Sub(others.RaisedOnline),
+				RaisedSMS:        fr.TotalRaisedSMS.Sub(others.RaisedSMS),
+				RaisedOffline:    fr.TotalRaisedOffline.Sub(others.RaisedOffline),
+				EstimatedGiftAid: fr.TotalEstimatedGiftAid.Sub(others.EstimatedGiftAid),
+				Target:           fr.Target.Sub(others.Target),
+			})
+			if err != nil {
+				return err
+			}
+			inserted = true
+			log.Infof("rationale: %s %s %s | %s %s %s | %s %s %s | %s %s %s | %s %s %s | %v %v",
+				diffRaisedOnline, fr.TotalRaisedOnline, curr.RaisedOnline,
+				diffRaisedSMS, fr.TotalRaisedSMS, curr.RaisedSMS,
+				diffRaisedOffline, fr.TotalRaisedOffline, curr.RaisedOffline,
+				diffEstimatedGiftAid, fr.TotalEstimatedGiftAid, curr.EstimatedGiftAid,
+				diffTargetAmount, fr.Target, curr.Target,
+				fr.Timestamp, updated)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if inserted {
+		donationStatsInserted.Inc("detail")
+		jgforce.AddProgress(ctx, jgforce.DonationStatsInserted, 1)
+	}
+	return nil
 }
 
-func searchForPageUsingID(svc *justin.Service, conn *pgx.Conn, charityID uint, eventID uint, pageID uint, contactID *string) (bool, error) {
+func searchForPageUsingID(ctx context.Context, cfg *config.Config, jg justgiving.Client, st store.Store, charityID uint, eventID uint, pageID uint, contactID *string) (bool, error) {
 	if pageID == 0 {
 		return false, nil
 	}
 	// look for a match in the justgiving database
-	sql := `SELECT page_id FROM justgiving.page_priority WHERE page_id=$1`
-	res := 0
-	err := conn.QueryRow(sql, pageID).Scan(&res)
-	if err == nil && uint(res) == pageID {
+	_, found, err := st.PagePriority(pageID)
+	if err != nil {
+		return false, err
+	}
+	if found {
 		// if there is a match handle it...
-		return true, handleMatch(conn, pageID, contactID)
-	}
-	if err == pgx.ErrNoRows {
-		// if there is no match and we have a charity id and event id
-		// check the event - we might want to add it
-		// (hopefully we will then find a match later - once the events pages are retrieved)
-		if charityID > 0 && eventID > 0 {
-			err = checkEvent(svc, conn, charityID, eventID)
-			if err != nil {
-				return false, err
-			}
+		return true, handleMatch(ctx, cfg, st, pageID, contactID)
+	}
+	// if there is no match and we have a charity id and event id
+	// check the event - we might want to add it
+	// (hopefully we will then find a match later - once the events pages are retrieved)
+	if charityID > 0 && eventID > 0 {
+		err = checkEvent(ctx, jg, st, charityID, eventID)
+		if err != nil {
+			return false, err
 		}
-
 	}
 
 	return false, nil
 }
 
-func searchForPageUsingShortName(svc *justin.Service, conn *pgx.Conn, shortName string) (bool, error) {
-	// TODO
+// searchForPageUsingShortName looks for the page with the short name (amongst just the members' pages if members isn't nil),
+// first in our database and then via the justgiving api
+func searchForPageUsingShortName(ctx context.Context, cfg *config.Config, jg justgiving.Client, st store.Store, shortName string, members []uint, contactID *string) (bool, error) {
 	// look for a match in our database using short name
-	//
-	// if there is a match bump the page priority so we refresh its results more often
-	// and create a donation stats master record
-	//
-	// if there is no match try and retrieve the page via the justgiving api
-	// and check event id is in the database and if not add it
-	// (hopefully we will then find a match later - once the events pages are retrieved)
-
-	return false, nil
+	pageID, found, err := st.PageByShortName(shortName)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// if there is no match try and retrieve the page via the justgiving api
+		page, err := jg.Page(ctx, shortName)
+		if err != nil {
+			return false, fmt.Errorf("error fetching page %s from justgiving %v", shortName, err)
+		}
+		if page == nil || page.ID == 0 {
+			return false, nil
+		}
+		if members != nil && !in(members, page.ID) {
+			return false, nil
+		}
+		// check the event is in the database and if not add it (if it is like our events)
+		if page.CharityID > 0 && page.EventID > 0 {
+			if err = checkEvent(ctx, jg, st, page.CharityID, page.EventID); err != nil {
+				return false, err
+			}
+		}
+		// add the page straight away if we have its event, rather than waiting for the event's pages to be synced
+		eventIDs, err := st.ActiveEvents()
+		if err != nil {
+			return false, err
+		}
+		if !in(eventIDs, page.EventID) {
+			return false, nil
+		}
+		if _, found, err = st.PagePriority(page.ID); err != nil {
+			return false, err
+		}
+		if !found {
+			// store the page's own short name, the one in the contact's url may not be cased as justgiving has it
+			if page.ShortName != "" {
+				shortName = page.ShortName
+			}
+			log.Infof("adding page %s (id %d) found by its short name", shortName, page.ID)
+			if err = st.AddPage(page.CharityID, page.EventID, page.ID, shortName); err != nil {
+				return false, err
+			}
+		}
+		pageID = page.ID
+	} else if members != nil && !in(members, pageID) {
+		return false, nil
+	}
+	// if there is a match handle it, as for a match by id
+	// (a page added above has no results until it is refreshed, its master record is added by a later heartbeat)
+	return true, handleMatch(ctx, cfg, st, pageID, contactID)
 }
 
-func searchForPageUsingEmail(svc *justin.Service, conn *pgx.Conn, charityID uint, c ContactRecord) (bool, error) {
+// searchForPageUsingEmail looks for the contact's page by the contact's email address, amongst just the members' pages if members isn't nil
+func searchForPageUsingEmail(ctx context.Context, cfg *config.Config, jg justgiving.Client, st store.Store, charityID uint, c store.Contact, members []uint) (bool, error) {
 	eml := ""
 	if c.Email != nil {
 		eml = *c.Email
@@ -343,16 +476,24 @@ func searchForPageUsingEmail(svc *justin.Service, conn *pgx.Conn, charityID uint
 		return false, nil
 	}
 
-	fprs, err := svc.FundraisingPagesForCharityAndUser(charityID, *account)
-
+	fprs, err := jg.FundraisingPagesForCharityAndUser(ctx, charityID, *account)
 	if err != nil {
 		return false, err
 	}
+	if members != nil {
+		var teamPages []justgiving.Page
+		for _, p := range fprs {
+			if in(members, p.ID) {
+				teamPages = append(teamPages, p)
+			}
+		}
+		fprs = teamPages
+	}
 	// if we find pages, look for a matching event in our database
 	if len(fprs) > 0 {
 
 		// fetch events
-		events, err := eventIDs(conn)
+		events, err := st.ActiveEvents()
 		if err != nil {
 			return false, err
 		}
@@ -360,14 +501,14 @@ func searchForPageUsingEmail(svc *justin.Service, conn *pgx.Conn, charityID uint
 		matchedIndex := 0
 		matchedCount := 0
 		for i, p := range fprs {
-			if in(events, p.EventID()) {
+			if in(events, p.EventID) {
 				// check page is active (has some donations)
-				var fres []justgiving.FundraisingResults
-				fres, err = justgiving.Results(conn, p.ID(), "LIMIT 1")
+				var fres []store.FundraisingResults
+				fres, err = st.Results(p.ID, 1)
 				if err != nil {
 					return false, err
 				}
-				if len(fres) == 1 && fres[0].TotalRaised > 0 {
+				if len(fres) == 1 && fres[0].TotalRaised.Sign() > 0 {
 					matchedIndex = i
 					matchedCount = matchedCount + 1
 				}
@@ -375,13 +516,13 @@ func searchForPageUsingEmail(svc *justin.Service, conn *pgx.Conn, charityID uint
 		}
 		if matchedCount == 1 {
 			p := fprs[matchedIndex]
-			return searchForPageUsingID(svc, conn, p.CharityID(), p.EventID(), p.ID(), c.ID)
+			return searchForPageUsingID(ctx, cfg, jg, st, p.CharityID, p.EventID, p.ID, c.ID)
 		}
 
 		// if there is no match then check the event - we might want to add it
 		if matchedCount < 1 {
 			for _, p := range fprs {
-				checkEvent(svc, conn, p.CharityID(), p.EventID())
+				err = checkEvent(ctx, jg, st, p.CharityID, p.EventID)
 				if err != nil {
 					return false, err
 				}
@@ -392,25 +533,6 @@ func searchForPageUsingEmail(svc *justin.Service, conn *pgx.Conn, charityID uint
 	return false, nil
 }
 
-func eventIDs(conn *pgx.Conn) ([]uint, error) {
-	rows, err := conn.Query("SELECT event_id FROM justgiving.event WHERE priority > 0 ORDER BY priority;")
-	if err != nil {
-		return nil, fmt.Errorf("error querying justgiving.event %v", err)
-	}
-	defer rows.Close()
-	var events []uint
-	for rows.Next() {
-		var eventID uint
-		if err = rows.Scan(&eventID); err != nil {
-			return nil, fmt.Errorf("error reading from justgiving.event %v", err)
-		}
-		if eventID > 0 {
-			events = append(events, eventID)
-		}
-	}
-	return events, nil
-}
-
 func in(ids []uint, search uint) bool {
 	for _, id := range ids {
 		if search == id {
@@ -420,15 +542,15 @@ func in(ids []uint, search uint) bool {
 	return false
 }
 
-func checkEvent(svc *justin.Service, conn *pgx.Conn, charityID uint, eventID uint) error {
+func checkEvent(ctx context.Context, jg justgiving.Client, st store.Store, charityID uint, eventID uint) error {
 	// make sure this event doesn't already exist in our database
-	eventIDs, err := eventIDs(conn)
+	eventIDs, err := st.ActiveEvents()
 	if err != nil {
 		return err
 	}
 	if !in(eventIDs, eventID) {
 		// retrieve event from justgiving api
-		event, err := svc.Event(eventID)
+		event, err := jg.Event(ctx, eventID)
 		if err != nil {
 			return fmt.Errorf("error fetching event %d from justgiving %v", eventID, err)
 		}
@@ -441,10 +563,11 @@ func checkEvent(svc *justin.Service, conn *pgx.Conn, charityID uint, eventID uin
 			return fmt.Errorf("error parsing event start date %s as returned from from justgiving %v", event.StartDate, err)
 		}
 		// check we have events like this
-		sql := `SELECT event_id FROM justgiving.event WHERE priority > 0 AND start_date=$1 LIMIT 1`
-		res := 0
-		err = conn.QueryRow(sql, eventStartDate).Scan(&res)
-		if err == nil {
+		like, err := st.HasActiveEventStarting(eventStartDate)
+		if err != nil {
+			return err
+		}
+		if like {
 			var eventCompletionDate time.Time
 			eventCompletionDate, err = event.ParseCompletionDate()
 			if err != nil {
@@ -455,69 +578,235 @@ func checkEvent(svc *justin.Service, conn *pgx.Conn, charityID uint, eventID uin
 			if err != nil {
 				return fmt.Errorf("error parsing event expiry date %s as returned from from justgiving %v", event.ExpiryDate, err)
 			}
-			sql := `INSERT INTO justgiving.event (charity_id, event_id, name, event_type, location, completion_date, expiry_date, start_date) VALUES($1,$2,$3,$4,$5,$6,$7,$8);`
-			_, err = conn.Exec(sql, charityID, eventID, event.Name, event.Type, event.Location, eventCompletionDate, eventExpiryDate, eventStartDate)
+			err = st.AddEvent(store.Event{
+				CharityID:      charityID,
+				ID:             eventID,
+				Name:           event.Name,
+				Type:           event.Type,
+				Location:       event.Location,
+				StartDate:      eventStartDate,
+				CompletionDate: eventCompletionDate,
+				ExpiryDate:     eventExpiryDate,
+			})
 			if err != nil {
-				return fmt.Errorf("error inserting justgiving.event %d %d %v", charityID, eventID, err)
+				return err
 			}
-		} else {
-			if err != pgx.ErrNoRows {
-				return fmt.Errorf("error checking event %d against justgiving.event %v", eventID, err)
+		}
+	}
+
+	return nil
+}
+
+func handleMatch(ctx context.Context, cfg *config.Config, st store.Store, pageID uint, contactID *string) error {
+	// the page's priority and its donation stats master record are updated as a unit
+	inserted := false
+	err := st.Transact(func(tx store.Store) error {
+		// bump the page priority so we refresh its results more often (except if the page is cancelled or unserviceable i.e. priority is 0)
+		if err := tx.UpdatePagePriority(pageID, 5); err != nil {
+			return err
+		}
+		// check the page is active (has some donations)
+		fres, err := tx.Results(pageID, 0)
+		if err != nil {
+			return err
+		}
+		// if it is active...
+		if contactID != nil && len(fres) > 0 && fres[0].TotalRaised.Sign() > 0 {
+			// and we haven't already associated this page with someone...
+			// (AddDonationStatsMaster won't add a second master record, this just saves the insert)
+			matched, err := tx.HasDonationStatsMaster(pageID)
+			if err != nil {
+				return err
+			}
+			if !matched { // create a donation stats master record
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				initial, ok := inSalesForceCurrency(cfg, fres[len(fres)-1])
+				if !ok {
+					log.Warnf("skipping donation stats master record for page id %d, there is no %s rate for its currency %s", pageID, config.CurrencyRates, initial.Currency)
+					return nil
+				}
+				log.Infof("inserting donation stats master record for page id %d", pageID)
+				if inserted, err = tx.AddDonationStatsMaster(*contactID, initial); err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	if inserted {
+		donationStatsInserted.Inc("master")
+		jgforce.AddProgress(ctx, jgforce.DonationStatsInserted, 1)
+		jgforce.AddProgress(ctx, jgforce.ContactsMatched, 1)
+	}
+
 	return nil
 }
 
-func handleMatch(conn *pgx.Conn, pageID uint, contactID *string) error {
-	// bump the page priority so we refresh its results more often (except if the page is cancelled or unserviceable i.e. priority is 0)
-	sql := `UPDATE justgiving.page_priority SET priority=5 WHERE page_id=$1 AND priority <> 0`
-	_, err := conn.Exec(sql, pageID)
+// inSalesForceCurrency converts the amounts of the results to the salesforce currency with the configured rate for the page's
+// currency (rounded to 2 decimal places), ok is false if there is no rate for it. Results without a currency were saved before
+// we captured it, they are taken to be in the salesforce currency already.
+func inSalesForceCurrency(cfg *config.Config, fr store.FundraisingResults) (store.FundraisingResults, bool) {
+	if fr.Currency == "" || fr.Currency == cfg.SalesForceCurrency {
+		return fr, true
+	}
+	rate, ok := cfg.CurrencyRates[fr.Currency]
+	if !ok {
+		return fr, false
+	}
+	convert := func(d decimal.Decimal) decimal.Decimal {
+		return d.Mul(rate).Round(2)
+	}
+	fr.TotalRaisedOffline = convert(fr.TotalRaisedOffline)
+	fr.TotalRaisedOnline = convert(fr.TotalRaisedOnline)
+	fr.TotalRaisedSMS = convert(fr.TotalRaisedSMS)
+	fr.TotalEstimatedGiftAid = convert(fr.TotalEstimatedGiftAid)
+	fr.Target = convert(fr.Target)
+	fr.TotalRaised = fr.TotalRaisedOffline.Add(fr.TotalRaisedOnline).Add(fr.TotalRaisedSMS)
+	fr.Currency = cfg.SalesForceCurrency
+	return fr, true
+}
+
+// justGivingPath returns the segments of the path of a justgiving url (the scheme and www are optional),
+// ok is false if it isn't a justgiving url
+func justGivingPath(rawURL string) ([]string, bool) {
+	raw := strings.TrimSpace(rawURL)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
 	if err != nil {
-		return fmt.Errorf("error updating justgiving.page_priority to 5 for page id %d %v", pageID, err)
+		return nil, false
+	}
+	host := strings.ToLower(u.Host)
+	if host != "justgiving.com" && !strings.HasSuffix(host, ".justgiving.com") {
+		return nil, false
+	}
+	return strings.Split(strings.Trim(u.Path, "/"), "/"), true
+}
+
+// teamShortName returns the short name of the team in a justgiving team page url e.g. https://www.justgiving.com/teams/park-runners,
+// ok is false if the url isn't a justgiving team page
+func teamShortName(teamPageURL string) (string, bool) {
+	parts, ok := justGivingPath(teamPageURL)
+	if !ok || len(parts) != 2 || (parts[0] != "teams" && parts[0] != "team") || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// pageShortName returns the short name of the page in a justgiving fundraising page url e.g. https://www.justgiving.com/fundraising/alice-runs
+// (or the older https://www.justgiving.com/alice-runs), ok is false if the url isn't a justgiving fundraising page
+func pageShortName(pageURL string) (string, bool) {
+	parts, ok := justGivingPath(pageURL)
+	if !ok {
+		return "", false
+	}
+	if len(parts) == 2 && parts[0] == "fundraising" && parts[1] != "" {
+		return parts[1], true
 	}
-	// check the page is active (has some donations)
-	var fres []justgiving.FundraisingResults
-	fres, err = justgiving.Results(conn, pageID, "")
+	// the older urls are the short name alone
+	if len(parts) == 1 && parts[0] != "" && parts[0] != "fundraising" && parts[0] != "teams" && parts[0] != "team" {
+		return parts[0], true
+	}
+	return "", false
+}
+
+// teams are the teams refreshed so far by a job by short name (nil if justgiving has no such team),
+// so a team is fetched from the justgiving api once a job however many of its contacts are searched for or synced
+type teams map[string]*store.Team
+
+// refresh the team with refreshTeam, unless it has already been refreshed
+func (ts teams) refresh(ctx context.Context, jg justgiving.Client, st store.Store, shortName string) (*store.Team, error) {
+	if t, ok := ts[shortName]; ok {
+		return t, nil
+	}
+	t, err := refreshTeam(ctx, jg, st, shortName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// if it is active...
-	if contactID != nil && len(fres) > 0 && fres[0].TotalRaised > 0 {
-		// and we haven't already associated this page with someone...
-		var rec *int
-		sql = `SELECT 1 FROM salesforce.donation_stats__c WHERE fundraising_page_id__c = $1 AND transaction_date__c IS NULL;`
-		err = conn.QueryRow(sql, strconv.FormatInt(int64(pageID), 10)).Scan(&rec)
-		if err == pgx.ErrNoRows { // create a donation stats master record
-			initRes := fres[len(fres)-1]
-			log.Infof("inserting donation stats master record for page id %d", pageID)
-			sql = `INSERT INTO salesforce.donation_stats__c
-	 (fundraising_page_id__c, related_contact_record__c, initial_raised_online__c,
-		initial_raised_sms__c, initial_raised_offline__c, intial_estimated_gift_aid__c, initial_pledge_amount__c,
-		fundraising_portal_used__c, event_id__c, jg_charity_id__c, event_name__c, donation_date__c)
-	VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12);`
-			_, err = conn.Exec(sql, strconv.FormatInt(int64(pageID), 10), *contactID, initRes.TotalRaisedOnline,
-				initRes.TotalRaisedSMS, initRes.TotalRaisedOffline, initRes.TotalEstimatedGiftAid, initRes.Target,
-				"Just Giving", strconv.FormatInt(int64(initRes.EventID), 10), strconv.FormatInt(int64(initRes.CharityID), 10), initRes.EventName, initRes.Timestamp)
-			if err != nil {
-				return fmt.Errorf("error creating initial salesforce.donation_stats__c %v", err)
-			}
-			sql = `SELECT currval(pg_get_serial_sequence('salesforce.donation_stats__c', 'id'));`
-			var donationStatsID int
-			err = conn.QueryRow(sql).Scan(&donationStatsID)
-			if err != nil {
-				return fmt.Errorf("error retreiving inserted id from initial salesforce.donation_stats__c record %v", err)
+	ts[shortName] = t
+	return t, nil
+}
+
+// refreshTeam fetches the team and its members from the justgiving api and saves them along with its totals for today,
+// it returns nil if there is no such team
+func refreshTeam(ctx context.Context, jg justgiving.Client, st store.Store, shortName string) (*store.Team, error) {
+	jt, err := jg.Team(ctx, shortName)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching team %s from justgiving %v", shortName, err)
+	}
+	if jt == nil {
+		log.Warnf("team %s not found in justgiving", shortName)
+		return nil, nil
+	}
+	t := store.Team{
+		ID:        jt.ID,
+		ShortName: jt.ShortName,
+		Name:      jt.Name,
+		Currency:  jt.CurrencyCode,
+	}
+	for _, a := range []struct {
+		name  string
+		value string
+		dest  *decimal.Decimal
+	}{{"target", jt.Target, &t.Target}, {"raised so far", jt.RaisedSoFar, &t.Raised}} {
+		if a.value == "" {
+			continue
+		}
+		if *a.dest, err = decimal.Parse(a.value); err != nil {
+			log.Warnf("skipping team %s, invalid %s %v", shortName, a.name, err)
+			return nil, nil
+		}
+	}
+	for _, m := range jt.Members {
+		t.Members = append(t.Members, store.TeamMember{PageID: m.PageID, ShortName: m.ShortName})
+	}
+	now := time.Now()
+	if err = st.SaveTeam(t, now.Year(), int(now.Month()), now.Day()); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// handleTeamMatch is handleMatch for a contact matched with a team rather than a page (see TEAM_DONATION_STATS), the team's
+// totals are recorded in salesforce against its store.TeamPageID. Every contact matched with the team gets donation stats of their own
+// (keyed by the team and the contact, see store.MasterKey), the contact is counted as matched once their master record is inserted.
+func handleTeamMatch(ctx context.Context, cfg *config.Config, st store.Store, teamID uint, contactID *string) error {
+	inserted := false
+	err := st.Transact(func(tx store.Store) error {
+		fres, err := tx.TeamResults(teamID, 0)
+		if err != nil {
+			return err
+		}
+		// AddDonationStatsMaster won't add a second master record for the contact's team
+		if contactID != nil && len(fres) > 0 && fres[0].TotalRaised.Sign() > 0 {
+			if err = ctx.Err(); err != nil {
+				return err
 			}
-			sql = `UPDATE salesforce.donation_stats__c SET donation_date__c = date_trunc('second', donation_date__c) WHERE id = $1`
-			_, err = conn.Exec(sql, donationStatsID)
-			if err != nil {
-				return fmt.Errorf("error updating donation_date__c in initial salesforce.donation_stats__c record %v", err)
+			initial, ok := inSalesForceCurrency(cfg, fres[len(fres)-1])
+			if !ok {
+				log.Warnf("skipping donation stats master record for team id %d, there is no %s rate for its currency %s", teamID, config.CurrencyRates, initial.Currency)
+				return nil
 			}
-		} else {
-			if err != nil {
-				return fmt.Errorf("error checking for existing association with salesforce.donation_stats__c %v", err)
+			log.Infof("inserting donation stats master record for team id %d", teamID)
+			if inserted, err = tx.AddDonationStatsMaster(*contactID, initial); err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if inserted {
+		donationStatsInserted.Inc("master")
+		jgforce.AddProgress(ctx, jgforce.DonationStatsInserted, 1)
+		jgforce.AddProgress(ctx, jgforce.ContactsMatched, 1)
 	}
 
 	return nil
@@ -0,0 +1,261 @@
+package salesforce
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce/cmd/worker/justgiving"
+	"github.com/homemade/jgforce/cmd/worker/justgiving/jgtest"
+	"github.com/homemade/jgforce/cmd/worker/store"
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/jgforce/decimal"
+	justin_models "github.com/homemade/justin/models"
+)
+
+func contact(id string, pageID string, email string) store.Contact {
+	c := store.Contact{ID: &id, Email: &email}
+	if pageID != "" {
+		c.PageID = &pageID
+	}
+	return c
+}
+
+func TestHeartBeat(t *testing.T) {
+	fixtures, err := jgtest.ReadFixtures("../../../testdata/justgiving.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := jgtest.NewServer(fixtures)
+	defer srv.Close()
+	cfg := &config.Config{JustinAPIKey: "test", JustinBaseURL: srv.URL, JustinCharity: 1000,
+		SalesForceCurrency: "GBP", CurrencyRates: map[string]decimal.Decimal{"EUR": decimal.MustParse("0.86")}}
+	jg, err := justgiving.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// event 2000 with pages 1 and 2 (and their results) as synced by the justgiving worker
+	st := store.NewMemory()
+	st.AddEvent(store.Event{CharityID: 1000, ID: 2000, Name: "Royal Parks Half Marathon", StartDate: time.Unix(1476000000, 0)})
+	now := time.Now()
+	for _, p := range fixtures.Pages[:2] {
+		st.AddPage(p.CharityID, p.EventID, p.ID, p.ShortName)
+		st.SaveResults(p.ID, now.Year(), int(now.Month()), now.Day(), p.CurrencyCode, p.Results)
+	}
+
+	// alice is matched by her page id and bob by his email, dave's page is for event 2001 which starts with event 2000 so we add it
+	st.AddContact(contact("003000000000001", "1", "alice@example.com"))
+	st.AddContact(contact("003000000000002", "", "bob@example.com"))
+	st.AddContact(contact("003000000000004", "", "dave@example.com"))
+	if err = heartBeat(ctx, cfg, st, jg); err != nil {
+		t.Fatal(err)
+	}
+	for _, pageID := range []uint{1, 2} {
+		if matched, _ := st.HasDonationStatsMaster(pageID); !matched {
+			t.Errorf("expected a donation stats master record for page %d", pageID)
+		}
+		if priority, _, _ := st.PagePriority(pageID); priority != 5 {
+			t.Errorf("expected matched page %d to have priority 5 but have %d", pageID, priority)
+		}
+	}
+	// bob's page is in euros, so his donation stats are converted to pounds
+	if totals, _ := st.DonationStatsTotals("2", "", ""); totals.RaisedOffline.String() != "43.00" || totals.EstimatedGiftAid.String() != "10.75" {
+		t.Errorf("expected bob's euro results to be converted to pounds but have %+v", totals)
+	}
+	if events, _ := st.ActiveEvents(); len(events) != 2 || events[1] != 2001 {
+		t.Errorf("expected event 2001 to be added but have %v", events)
+	}
+	if details := st.DonationStats("1"); len(details) != 0 {
+		t.Errorf("expected no detail records before alice raises more but have %+v", details)
+	}
+
+	// once alice raises more a detail record is added with the difference, just the once
+	st.SaveResults(1, now.Year(), int(now.Month()), now.Day(), "GBP", justin_models.FundraisingResults{Target: "500.00",
+		TotalRaisedOffline: "0.00", TotalRaisedOnline: "150.00", TotalRaisedSMS: "0.00", TotalEstimatedGiftAid: "37.50"})
+	for i := 0; i < 2; i++ {
+		if err = heartBeat(ctx, cfg, st, jg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	details := st.DonationStats("1")
+	if len(details) != 1 || details[0].RaisedOnline.String() != "50.00" || details[0].EstimatedGiftAid.String() != "12.50" || details[0].ContactID != "003000000000001" {
+		t.Errorf("expected a detail record for alice's extra 50 but have %+v", details)
+	}
+	if details = st.DonationStats("2"); len(details) != 0 {
+		t.Errorf("expected no detail records for bob but have %+v", details)
+	}
+}
+
+func TestSyncDonationStatsDetail(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	st.AddEvent(store.Event{CharityID: 1000, ID: 2000})
+	st.AddPage(1000, 2000, 1, "alice-runs")
+	st.SaveResults(1, 2016, 10, 9, "", justin_models.FundraisingResults{TotalRaisedOnline: "100.10"})
+	results, _ := st.Results(1, 0)
+	st.AddDonationStatsMaster("003000000000001", results[len(results)-1])
+
+	// the day's results are synced (twice, as by a retried job) and then change later the same day
+	day := store.FundraisingResults{PageID: 1, Year: 2016, Month: 10, Day: 10, Timestamp: time.Now(), TotalRaisedOnline: decimal.MustParse("150.20")}
+	for i := 0; i < 2; i++ {
+		if err := syncDonationStatsDetail(ctx, st, "1", "", day, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day.TotalRaisedOnline, day.Timestamp = decimal.MustParse("175.30"), day.Timestamp.Add(time.Hour)
+	if err := syncDonationStatsDetail(ctx, st, "1", "", day, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	details := st.DonationStats("1")
+	if len(details) != 1 || details[0].Key != "1:2016-10-10" || details[0].RaisedOnline.String() != "75.20" {
+		t.Errorf("expected a single detail record of 75.20 for the day but have %+v", details)
+	}
+	if totals, _ := st.DonationStatsTotals("1", "", ""); !totals.RaisedOnline.Equal(day.TotalRaisedOnline) || totals.ContactID != "003000000000001" {
+		t.Errorf("expected totals of 175.30 but have %+v", totals)
+	}
+	if added, _ := st.AddDonationStatsMaster("003000000000002", results[len(results)-1]); added {
+		t.Error("expected a second master record for the page not to be added")
+	}
+}
+
+func TestTeamPages(t *testing.T) {
+	fixtures, err := jgtest.ReadFixtures("../../../testdata/justgiving.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := jgtest.NewServer(fixtures)
+	defer srv.Close()
+	cfg := &config.Config{JustinAPIKey: "test", JustinBaseURL: srv.URL, JustinCharity: 1000, SalesForceCurrency: "GBP", TeamDonationStats: "member"}
+	jg, err := justgiving.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	newStore := func() *store.Memory {
+		st := store.NewMemory()
+		st.AddEvent(store.Event{CharityID: 1000, ID: 2000, StartDate: time.Unix(1476000000, 0)})
+		now := time.Now()
+		p := fixtures.Pages[0]
+		st.AddPage(p.CharityID, p.EventID, p.ID, p.ShortName)
+		st.SaveResults(p.ID, now.Year(), int(now.Month()), now.Day(), p.CurrencyCode, p.Results)
+		return st
+	}
+	teamContact := func(id string, email string) store.Contact {
+		c := contact(id, "", email)
+		url := "www.justgiving.com/teams/park-runners"
+		c.TeamPageURL = &url
+		return c
+	}
+
+	// by member, alice is matched with her own page in the team by her email
+	st := newStore()
+	st.AddContact(teamContact("003000000000001", "alice@example.com"))
+	if err = heartBeat(ctx, cfg, st, jg); err != nil {
+		t.Fatal(err)
+	}
+	if matched, _ := st.HasDonationStatsMaster(1); !matched {
+		t.Error("expected a donation stats master record for alice's page")
+	}
+	if totals, _ := st.DonationStatsTotals(store.TeamPageID(3000), "", ""); totals.ContactID != "" {
+		t.Errorf("expected no donation stats for the team but have %+v", totals)
+	}
+
+	// by team, each contact is matched with the team's totals which are kept up to date by the heartbeat
+	cfg.TeamDonationStats = "team"
+	st = newStore()
+	teamContacts := []string{"003000000000003", "003000000000005"}
+	st.AddContact(teamContact(teamContacts[0], "carol@example.com"))
+	st.AddContact(teamContact(teamContacts[1], "erin@example.com"))
+	if err = heartBeat(ctx, cfg, st, jg); err != nil {
+		t.Fatal(err)
+	}
+	for _, contactID := range teamContacts {
+		if totals, _ := st.DonationStatsTotals("T3000", contactID, ""); totals.RaisedOnline.String() != "200.00" || totals.ContactID != contactID {
+			t.Errorf("expected the team's 200.00 for contact %s but have %+v", contactID, totals)
+		}
+	}
+	srv.SetTeamRaised("park-runners", "250.00")
+	teamRequests := srv.Requests("Team")
+	if err = heartBeat(ctx, cfg, st, jg); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("Team") - teamRequests; n != 1 {
+		t.Errorf("expected the team to be refreshed once by the heartbeat but have %d requests", n)
+	}
+	details := st.DonationStats("T3000")
+	if len(details) != 2 || details[0].RaisedOnline.String() != "50.00" || details[1].RaisedOnline.String() != "50.00" || details[0].ContactID == details[1].ContactID {
+		t.Errorf("expected a detail record for the team's extra 50 for each contact but have %+v", details)
+	}
+
+	if _, ok := teamShortName("https://www.justgiving.com/fundraising/alice-runs"); ok {
+		t.Error("expected a fundraising page url not to be a team page url")
+	}
+	if short, ok := teamShortName("http://justgiving.com/team/park-runners/"); !ok || short != "park-runners" {
+		t.Errorf("expected park-runners but have %q", short)
+	}
+}
+
+func TestSearchForPageUsingShortName(t *testing.T) {
+	fixtures, err := jgtest.ReadFixtures("../../../testdata/justgiving.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := jgtest.NewServer(fixtures)
+	defer srv.Close()
+	cfg := &config.Config{JustinAPIKey: "test", JustinBaseURL: srv.URL, JustinCharity: 1000,
+		SalesForceCurrency: "GBP", CurrencyRates: map[string]decimal.Decimal{"EUR": decimal.MustParse("0.86")}}
+	jg, err := justgiving.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// we have alice's page but not bob's (though we have its event), neither contact's email has a page
+	// and neither url has the short name cased as justgiving has it
+	st := store.NewMemory()
+	st.AddEvent(store.Event{CharityID: 1000, ID: 2000, StartDate: time.Unix(1476000000, 0)})
+	now := time.Now()
+	alice, bob := fixtures.Pages[0], fixtures.Pages[1]
+	st.AddPage(alice.CharityID, alice.EventID, alice.ID, alice.ShortName)
+	st.SaveResults(alice.ID, now.Year(), int(now.Month()), now.Day(), alice.CurrencyCode, alice.Results)
+	withURL := func(c store.Contact, url string) store.Contact {
+		c.PageURL = &url
+		return c
+	}
+	st.AddContact(withURL(contact("003000000000001", "", "a@example.com"), "https://www.justgiving.com/fundraising/Alice-Runs"))
+	st.AddContact(withURL(contact("003000000000002", "", "b@example.com"), "www.justgiving.com/Bob-Runs"))
+	if err = heartBeat(ctx, cfg, st, jg); err != nil {
+		t.Fatal(err)
+	}
+	if matched, _ := st.HasDonationStatsMaster(alice.ID); !matched {
+		t.Error("expected a donation stats master record for alice's page")
+	}
+	// bob's page is added (and bumped so it is refreshed soon), its master record follows once it has results
+	if priority, found, _ := st.PagePriority(bob.ID); !found || priority != 5 {
+		t.Errorf("expected bob's page to be added with priority 5 but have %d %t", priority, found)
+	}
+	if short, _, _ := st.PageShortName(bob.ID); short != bob.ShortName {
+		t.Errorf("expected bob's page to be added with its own short name but have %q", short)
+	}
+	if matched, _ := st.HasDonationStatsMaster(bob.ID); matched {
+		t.Error("expected no donation stats master record for bob's page before it has results")
+	}
+	st.SaveResults(bob.ID, now.Year(), int(now.Month()), now.Day(), bob.CurrencyCode, bob.Results)
+	if err = heartBeat(ctx, cfg, st, jg); err != nil {
+		t.Fatal(err)
+	}
+	if totals, _ := st.DonationStatsTotals("2", "", ""); totals.ContactID != "003000000000002" {
+		t.Errorf("expected bob's page to be matched but have %+v", totals)
+	}
+
+	for url, want := range map[string]string{"justgiving.com/fundraising/alice-runs/": "alice-runs", "https://www.justgiving.com/teams/park-runners": "",
+		"https://www.example.com/fundraising/alice-runs": "", "http://www.justgiving.com/bob-runs": "bob-runs"} {
+		if short, _ := pageShortName(url); short != want {
+			t.Errorf("expected %s to have the short name %q but have %q", url, want, short)
+		}
+	}
+}
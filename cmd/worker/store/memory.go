@@ -0,0 +1,690 @@
+package store
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/homemade/jgforce/decimal"
+	justin_models "github.com/homemade/justin/models"
+)
+
+// DefaultPriority of new events and pages (the default of the priority columns)
+const DefaultPriority = 9
+
+// Memory is a Store kept in memory, for tests. It has no job queue, so no events or pages are skipped for having a job waiting.
+// Contacts are synced by heroku connect rather than the workers, so they are added with AddContact.
+type Memory struct {
+	mu            sync.Mutex
+	now           func() time.Time
+	events        []memEvent
+	pages         []memPage
+	results       []memResult
+	teams         []Team
+	teamResults   []memTeamResult
+	contacts      []Contact
+	donationStats []memDonationStats
+}
+
+type memEvent struct {
+	Event
+	priority int
+}
+
+type memPage struct {
+	charityID     uint
+	eventID       uint
+	id            uint
+	shortName     string
+	priority      int
+	unserviceable bool
+	refreshed     *time.Time
+}
+
+type memResult struct {
+	pageID           uint
+	year, month, day int
+	updated          time.Time
+	currency         string
+	fr               justin_models.FundraisingResults
+}
+
+type memTeamResult struct {
+	teamID           uint
+	year, month, day int
+	updated          time.Time
+	currency         string
+	target, raised   decimal.Decimal
+}
+
+type memDonationStats struct {
+	key       string
+	contactID string
+	pageID    string
+	pageURL   string
+	// master records have no transaction date, and only the initial amounts (detail records only the incremental ones)
+	transactionDate *time.Time
+	initial         FundraisingResults
+	detail          DonationStatsDetail
+}
+
+// NewMemory creates an empty Memory store
+func NewMemory() *Memory {
+	return &Memory{now: time.Now}
+}
+
+// Transact runs f with the store itself, restoring the store as it was before if f returns an error
+// (changes made concurrently by other go routines are lost too, the store isn't isolated as a database transaction is)
+func (m *Memory) Transact(f func(tx Store) error) error {
+	m.mu.Lock()
+	events := append([]memEvent(nil), m.events...)
+	pages := append([]memPage(nil), m.pages...)
+	results := append([]memResult(nil), m.results...)
+	teams := append([]Team(nil), m.teams...)
+	teamResults := append([]memTeamResult(nil), m.teamResults...)
+	contacts := append([]Contact(nil), m.contacts...)
+	donationStats := append([]memDonationStats(nil), m.donationStats...)
+	m.mu.Unlock()
+
+	err := f(m)
+	if err != nil {
+		m.mu.Lock()
+		m.events, m.pages, m.results, m.contacts, m.donationStats = events, pages, results, contacts, donationStats
+		m.teams, m.teamResults = teams, teamResults
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// AddContact adds (or replaces) the salesforce contact
+func (m *Memory) AddContact(c Contact) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.contacts {
+		if existing.ID != nil && c.ID != nil && *existing.ID == *c.ID {
+			m.contacts[i] = c
+			return
+		}
+	}
+	m.contacts = append(m.contacts, c)
+}
+
+// SetEventPriority of the event (0 stops tracking it)
+func (m *Memory) SetEventPriority(eventID uint, priority int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.events {
+		if m.events[i].ID == eventID {
+			m.events[i].priority = priority
+		}
+	}
+}
+
+func (m *Memory) activeEvents() []uint {
+	events := make([]memEvent, 0, len(m.events))
+	for _, e := range m.events {
+		if e.priority > 0 {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].priority < events[j].priority })
+	ids := make([]uint, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func (m *Memory) ActiveEvents() ([]uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeEvents(), nil
+}
+
+func (m *Memory) EventsToSync() ([]uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeEvents(), nil
+}
+
+func (m *Memory) HasActiveEventStarting(start time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.events {
+		if e.priority > 0 && e.StartDate.Equal(start) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *Memory) AddEvent(e Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, memEvent{e, DefaultPriority})
+	return nil
+}
+
+func (m *Memory) page(pageID uint) *memPage {
+	for i := range m.pages {
+		if m.pages[i].id == pageID {
+			return &m.pages[i]
+		}
+	}
+	return nil
+}
+
+func (m *Memory) PageShortName(pageID uint) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil {
+		return p.shortName, true, nil
+	}
+	return "", false, nil
+}
+
+func (m *Memory) PageByShortName(shortName string) (uint, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pages {
+		if strings.EqualFold(p.shortName, shortName) {
+			return p.id, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (m *Memory) AddPage(charityID uint, eventID uint, pageID uint, shortName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pages = append(m.pages, memPage{charityID: charityID, eventID: eventID, id: pageID, shortName: shortName, priority: DefaultPriority})
+	return nil
+}
+
+func (m *Memory) UpdatePageShortName(pageID uint, shortName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil {
+		p.shortName = shortName
+	}
+	return nil
+}
+
+func (m *Memory) DefaultPagePriority() (int, error) {
+	return DefaultPriority, nil
+}
+
+func (m *Memory) PagePriority(pageID uint) (int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil {
+		return p.priority, true, nil
+	}
+	return 0, false, nil
+}
+
+func (m *Memory) PagesToRefresh(maxPriority int, limit int) ([]uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := m.activeEvents()
+	due := m.now().Add(-2 * time.Hour)
+	var pages []memPage
+	for _, p := range m.pages {
+		if p.priority > 0 && p.priority <= maxPriority && (p.refreshed == nil || p.refreshed.Before(due)) && in(active, p.eventID) {
+			pages = append(pages, p)
+		}
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		if pages[i].priority != pages[j].priority {
+			return pages[i].priority < pages[j].priority
+		}
+		if pages[i].refreshed == nil || pages[j].refreshed == nil {
+			return pages[i].refreshed == nil && pages[j].refreshed != nil
+		}
+		return pages[i].refreshed.Before(*pages[j].refreshed)
+	})
+	var ids []uint
+	for _, p := range pages {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, p.id)
+	}
+	return ids, nil
+}
+
+func (m *Memory) SetPagePriority(pageID uint, priority int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil {
+		p.priority, p.unserviceable = priority, false
+	}
+	return nil
+}
+
+func (m *Memory) SetPageUnserviceable(pageID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil {
+		p.priority, p.unserviceable = 0, true
+	}
+	return nil
+}
+
+func (m *Memory) UnserviceablePages(limit int) ([]uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := m.activeEvents()
+	due := m.now().Add(-24 * time.Hour)
+	var pages []memPage
+	for _, p := range m.pages {
+		if p.unserviceable && (p.refreshed == nil || p.refreshed.Before(due)) && in(active, p.eventID) {
+			pages = append(pages, p)
+		}
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		if pages[i].refreshed == nil || pages[j].refreshed == nil {
+			return pages[i].refreshed == nil && pages[j].refreshed != nil
+		}
+		return pages[i].refreshed.Before(*pages[j].refreshed)
+	})
+	var ids []uint
+	for _, p := range pages {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, p.id)
+	}
+	return ids, nil
+}
+
+func (m *Memory) RevivePage(pageID uint, priority int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil && p.unserviceable {
+		p.priority, p.unserviceable = priority, false
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *Memory) UpdatePagePriority(pageID uint, priority int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil && p.priority != 0 {
+		p.priority = priority
+	}
+	return nil
+}
+
+func (m *Memory) BumpPagePriority(pageID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil && p.priority != 0 {
+		p.priority++
+	}
+	return nil
+}
+
+func (m *Memory) ResetPagePriority(pageID uint, def int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil && p.priority > def {
+		p.priority = def
+	}
+	return nil
+}
+
+func (m *Memory) SetResultsRefreshed(pageID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p := m.page(pageID); p != nil {
+		now := m.now()
+		p.refreshed = &now
+	}
+	return nil
+}
+
+func (m *Memory) saveResult(r memResult) {
+	for i, existing := range m.results {
+		if existing.pageID == r.pageID && existing.year == r.year && existing.month == r.month && existing.day == r.day {
+			m.results[i] = r
+			return
+		}
+	}
+	m.results = append(m.results, r)
+}
+
+func (m *Memory) SaveResults(pageID uint, year int, month int, day int, currency string, fr justin_models.FundraisingResults) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	initial := false
+	for _, r := range m.results {
+		if r.pageID == pageID && r.year == 0 && r.month == 0 && r.day == 0 {
+			initial = true
+		}
+	}
+	if !initial {
+		m.saveResult(memResult{pageID, 0, 0, 0, now, currency, fr})
+	}
+	m.saveResult(memResult{pageID, year, month, day, now, currency, fr})
+	return nil
+}
+
+func (m *Memory) Results(pageID uint, limit int) ([]FundraisingResults, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.page(pageID)
+	if p == nil {
+		return nil, nil
+	}
+	var results []FundraisingResults
+	for _, r := range m.results {
+		if r.pageID != pageID {
+			continue
+		}
+		// (joined with the page's event, as the justgiving.event_page_fundraising_result view is)
+		for _, e := range m.events {
+			if e.ID != p.eventID {
+				continue
+			}
+			amounts, _ := parseResults(r.fr)
+			fr := FundraisingResults{
+				CharityID:             p.charityID,
+				EventID:               p.eventID,
+				EventName:             e.Name,
+				PageID:                p.id,
+				PageShortName:         p.shortName,
+				Year:                  r.year,
+				Month:                 r.month,
+				Day:                   r.day,
+				Timestamp:             r.updated,
+				Currency:              r.currency,
+				Target:                amount(amounts[0]),
+				TotalRaisedOffline:    amount(amounts[2]),
+				TotalRaisedOnline:     amount(amounts[3]),
+				TotalRaisedSMS:        amount(amounts[4]),
+				TotalEstimatedGiftAid: amount(amounts[5]),
+			}
+			fr.TotalRaised = fr.TotalRaisedOffline.Add(fr.TotalRaisedOnline).Add(fr.TotalRaisedSMS)
+			results = append(results, fr)
+		}
+	}
+	sortResults(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// sortResults latest first, as the justgiving.event_page_fundraising_result view is
+func sortResults(results []FundraisingResults) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Year != b.Year {
+			return a.Year > b.Year
+		}
+		if a.Month != b.Month {
+			return a.Month > b.Month
+		}
+		return a.Day > b.Day
+	})
+}
+
+// amount as read from the justgiving.event_page_fundraising_result view (an amount which isn't a decimal is 0)
+func amount(d *decimal.Decimal) decimal.Decimal {
+	if d == nil {
+		return decimal.Decimal{}
+	}
+	return *d
+}
+
+func (m *Memory) SaveTeam(t Team, year int, month int, day int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.Members = append([]TeamMember(nil), t.Members...)
+	saved := false
+	for i := range m.teams {
+		if m.teams[i].ID == t.ID {
+			m.teams[i], saved = t, true
+		}
+	}
+	if !saved {
+		m.teams = append(m.teams, t)
+	}
+	now := m.now()
+	r := memTeamResult{t.ID, 0, 0, 0, now, t.Currency, t.Target, t.Raised}
+	initial := false
+	for i := range m.teamResults {
+		if m.teamResults[i].teamID == t.ID && m.teamResults[i].year == 0 && m.teamResults[i].month == 0 && m.teamResults[i].day == 0 {
+			initial = true
+		}
+	}
+	if !initial {
+		m.teamResults = append(m.teamResults, r)
+	}
+	r.year, r.month, r.day = year, month, day
+	for i := range m.teamResults {
+		if m.teamResults[i].teamID == t.ID && m.teamResults[i].year == year && m.teamResults[i].month == month && m.teamResults[i].day == day {
+			m.teamResults[i] = r
+			return nil
+		}
+	}
+	m.teamResults = append(m.teamResults, r)
+	return nil
+}
+
+func (m *Memory) TeamShortName(teamID uint) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.teams {
+		if t.ID == teamID {
+			return t.ShortName, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (m *Memory) TeamResults(teamID uint, limit int) ([]FundraisingResults, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var team *Team
+	for i := range m.teams {
+		if m.teams[i].ID == teamID {
+			team = &m.teams[i]
+		}
+	}
+	if team == nil {
+		return nil, nil
+	}
+	var results []FundraisingResults
+	for _, r := range m.teamResults {
+		if r.teamID != teamID {
+			continue
+		}
+		results = append(results, FundraisingResults{
+			TeamID:            team.ID,
+			PageShortName:     team.ShortName,
+			EventName:         team.Name,
+			Year:              r.year,
+			Month:             r.month,
+			Day:               r.day,
+			Timestamp:         r.updated,
+			Currency:          r.currency,
+			TotalRaisedOnline: r.raised,
+			TotalRaised:       r.raised,
+			Target:            r.target,
+		})
+	}
+	sortResults(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (m *Memory) NewContacts() ([]Contact, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// (with postgres a contact is new until heroku connect has synced its donation stats to salesforce,
+	// we have no sync so every contact is new)
+	contacts := make([]Contact, len(m.contacts))
+	for i := range m.contacts {
+		contacts[len(m.contacts)-1-i] = m.contacts[i]
+	}
+	return contacts, nil
+}
+
+func (m *Memory) Contact(id string) (*Contact, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.contacts {
+		if c.ID != nil && *c.ID == id {
+			c := c
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *Memory) DonationStatsPages(contactID string) ([]DonationStatsPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pages []DonationStatsPage
+	seen := make(map[DonationStatsPage]int)
+	for _, ds := range m.donationStats {
+		if (contactID != "" && ds.contactID != contactID) || ds.pageID == "" {
+			continue
+		}
+		// (a team's donation stats are per contact)
+		p := DonationStatsPage{PageID: ds.pageID}
+		if _, ok := ParseTeamPageID(ds.pageID); ok {
+			p.ContactID = ds.contactID
+		}
+		i, ok := seen[p]
+		if !ok {
+			i = len(pages)
+			seen[p] = i
+			pages = append(pages, p)
+		}
+		if ds.transactionDate != nil && (pages[i].Updated == nil || ds.transactionDate.After(*pages[i].Updated)) {
+			t := *ds.transactionDate
+			pages[i].Updated = &t
+		}
+	}
+	return pages, nil
+}
+
+func (m *Memory) HasDonationStatsMaster(pageID uint) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := strconv.FormatInt(int64(pageID), 10)
+	for _, ds := range m.donationStats {
+		if ds.pageID == id && ds.transactionDate == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *Memory) AddDonationStatsMaster(contactID string, initial FundraisingResults) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pageID := initial.DonationStatsPageID()
+	key := MasterKey(pageID, contactID)
+	for _, ds := range m.donationStats {
+		if ds.key == key {
+			return false, nil
+		}
+	}
+	m.donationStats = append(m.donationStats, memDonationStats{
+		key:       key,
+		contactID: contactID,
+		pageID:    pageID,
+		initial:   initial,
+	})
+	return true, nil
+}
+
+func (m *Memory) UpdateDonationStatsPageURL(pageID string, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, ds := range m.donationStats {
+		if ds.pageID == pageID && ds.transactionDate == nil {
+			m.donationStats[i].pageURL = url
+		}
+	}
+	return nil
+}
+
+func (m *Memory) DonationStatsTotals(pageID string, contactID string, exclude string) (DonationStatsTotals, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var t DonationStatsTotals
+	for _, ds := range m.donationStats {
+		if ds.pageID != pageID || (contactID != "" && ds.contactID != contactID) || (exclude != "" && ds.key == exclude) {
+			continue
+		}
+		if ds.transactionDate == nil {
+			t.ContactID = ds.contactID
+			t.RaisedOnline = t.RaisedOnline.Add(ds.initial.TotalRaisedOnline)
+			t.RaisedSMS = t.RaisedSMS.Add(ds.initial.TotalRaisedSMS)
+			t.RaisedOffline = t.RaisedOffline.Add(ds.initial.TotalRaisedOffline)
+			t.EstimatedGiftAid = t.EstimatedGiftAid.Add(ds.initial.TotalEstimatedGiftAid)
+			t.Target = t.Target.Add(ds.initial.Target)
+		} else {
+			t.RaisedOnline = t.RaisedOnline.Add(ds.detail.RaisedOnline)
+			t.RaisedSMS = t.RaisedSMS.Add(ds.detail.RaisedSMS)
+			t.RaisedOffline = t.RaisedOffline.Add(ds.detail.RaisedOffline)
+			t.EstimatedGiftAid = t.EstimatedGiftAid.Add(ds.detail.EstimatedGiftAid)
+			t.Target = t.Target.Add(ds.detail.Target)
+		}
+	}
+	return t, nil
+}
+
+func (m *Memory) SaveDonationStatsDetail(d DonationStatsDetail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	date := d.Date
+	ds := memDonationStats{
+		key:             d.Key,
+		contactID:       d.ContactID,
+		pageID:          d.PageID,
+		transactionDate: &date,
+		detail:          d,
+	}
+	for i, existing := range m.donationStats {
+		if existing.key == d.Key {
+			m.donationStats[i] = ds
+			return nil
+		}
+	}
+	m.donationStats = append(m.donationStats, ds)
+	return nil
+}
+
+// DonationStats returns the donation stats detail records of the page, in the order they were added
+func (m *Memory) DonationStats(pageID string) []DonationStatsDetail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var details []DonationStatsDetail
+	for _, ds := range m.donationStats {
+		if ds.pageID == pageID && ds.transactionDate != nil {
+			details = append(details, ds.detail)
+		}
+	}
+	return details
+}
+
+func in(ids []uint, search uint) bool {
+	for _, id := range ids {
+		if search == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	justin_models "github.com/homemade/justin/models"
+)
+
+func TestMemoryTransact(t *testing.T) {
+	m := NewMemory()
+	m.AddEvent(Event{CharityID: 1000, ID: 2000})
+	fr := justin_models.FundraisingResults{TotalRaisedOnline: "10.00"}
+
+	err := m.Transact(func(tx Store) error {
+		if err := tx.AddPage(1000, 2000, 1, "alice-runs"); err != nil {
+			return err
+		}
+		return tx.SaveResults(1, 2016, 10, 9, "GBP", fr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, _ := m.Results(1, 0); len(results) != 2 {
+		t.Errorf("expected the committed initial and daily results but have %+v", results)
+	}
+
+	failed := errors.New("failed")
+	err = m.Transact(func(tx Store) error {
+		tx.SetPagePriority(1, 0)
+		tx.SaveResults(1, 2016, 10, 10, "GBP", fr)
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected the error from f but have %v", err)
+	}
+	if priority, _, _ := m.PagePriority(1); priority != DefaultPriority {
+		t.Errorf("expected the priority to be rolled back but have %d", priority)
+	}
+	if results, _ := m.Results(1, 0); len(results) != 2 {
+		t.Errorf("expected the results to be rolled back but have %+v", results)
+	}
+}
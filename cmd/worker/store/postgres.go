@@ -0,0 +1,635 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce"
+	"github.com/homemade/jgforce/config"
+	justin_models "github.com/homemade/justin/models"
+)
+
+// Connect to the database, the store's queries are bounded by ctx (see jgforce.WatchContext)
+// and the returned func closes the connection
+func Connect(ctx context.Context, cfg *config.Config) (Store, func(), error) {
+	connCfg, err := pgx.ParseURI(cfg.DatabaseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error configuring connection to database %v", err)
+	}
+	conn, err := pgx.Connect(connCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to database %v", err)
+	}
+	unwatch, err := jgforce.WatchContext(ctx, connCfg, conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return NewPostgres(conn), func() {
+		unwatch()
+		conn.Close()
+	}, nil
+}
+
+// NewPostgres creates a Store using the connection
+func NewPostgres(conn *pgx.Conn) Store {
+	return &postgres{conn: conn, q: conn}
+}
+
+// querier is implemented by both pgx.Conn and pgx.Tx
+type querier interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+	Query(sql string, args ...interface{}) (*pgx.Rows, error)
+	QueryRow(sql string, args ...interface{}) *pgx.Row
+}
+
+// postgres runs its queries with q, which is the connection or the transaction begun on it by Transact
+type postgres struct {
+	conn *pgx.Conn
+	q    querier
+	inTx bool
+}
+
+func (s *postgres) Transact(f func(tx Store) error) error {
+	if s.inTx {
+		return f(s)
+	}
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction %v", err)
+	}
+	defer tx.Rollback()
+	if err = f(&postgres{conn: s.conn, q: tx, inTx: true}); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction %v", err)
+	}
+	return nil
+}
+
+// eventIDs reads the event ids returned by the query
+func (s *postgres) eventIDs(sql string, args ...interface{}) ([]uint, error) {
+	rows, err := s.q.Query(sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying justgiving.event %v", err)
+	}
+	defer rows.Close()
+	var events []uint
+	for rows.Next() {
+		var eventID uint
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, fmt.Errorf("error reading from justgiving.event %v", err)
+		}
+		if eventID > 0 {
+			events = append(events, eventID)
+		}
+	}
+	return events, nil
+}
+
+func (s *postgres) ActiveEvents() ([]uint, error) {
+	return s.eventIDs(`SELECT event_id FROM justgiving.event WHERE priority > 0 ORDER BY priority;`)
+}
+
+func (s *postgres) EventsToSync() ([]uint, error) {
+	return s.eventIDs(`SELECT e.event_id FROM justgiving.event e WHERE e.priority > 0
+ AND NOT EXISTS (SELECT 1 FROM que_jobs j WHERE j.queue = $1 AND j.job_class = $2 AND j.args->>'event_id' = e.event_id::text)
+ ORDER BY e.priority;`, jgforce.JustGivingQueue, jgforce.SyncEventPagesJob)
+}
+
+func (s *postgres) HasActiveEventStarting(start time.Time) (bool, error) {
+	var res int
+	err := s.q.QueryRow(`SELECT 1 FROM justgiving.event WHERE priority > 0 AND start_date=$1 LIMIT 1`, start).Scan(&res)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking start date %v against justgiving.event %v", start, err)
+	}
+	return true, nil
+}
+
+func (s *postgres) AddEvent(e Event) error {
+	sql := `INSERT INTO justgiving.event (charity_id, event_id, name, event_type, location, completion_date, expiry_date, start_date) VALUES($1,$2,$3,$4,$5,$6,$7,$8);`
+	_, err := s.q.Exec(sql, e.CharityID, e.ID, e.Name, e.Type, e.Location, e.CompletionDate, e.ExpiryDate, e.StartDate)
+	if err != nil {
+		return fmt.Errorf("error inserting justgiving.event %d %d %v", e.CharityID, e.ID, err)
+	}
+	return nil
+}
+
+func (s *postgres) PageShortName(pageID uint) (string, bool, error) {
+	var shortName string
+	err := s.q.QueryRow(`SELECT page_short_name FROM justgiving.page WHERE page_id=$1 LIMIT 1`, pageID).Scan(&shortName)
+	if err == pgx.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error querying justgiving.page %v", err)
+	}
+	return shortName, true, nil
+}
+
+func (s *postgres) PageByShortName(shortName string) (uint, bool, error) {
+	var pageID uint
+	err := s.q.QueryRow(`SELECT page_id FROM justgiving.page WHERE lower(page_short_name)=lower($1) LIMIT 1`, shortName).Scan(&pageID)
+	if err == pgx.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error querying justgiving.page %v", err)
+	}
+	return pageID, true, nil
+}
+
+func (s *postgres) AddPage(charityID uint, eventID uint, pageID uint, shortName string) error {
+	sql := `INSERT INTO justgiving.page (charity_id, event_id, page_id, page_short_name) VALUES($1,$2,$3,$4);`
+	if _, err := s.q.Exec(sql, charityID, eventID, pageID, shortName); err != nil {
+		return fmt.Errorf("error creating justgiving.page %v", err)
+	}
+	sql = `INSERT INTO justgiving.page_priority (page_id) VALUES($1);`
+	if _, err := s.q.Exec(sql, pageID); err != nil {
+		return fmt.Errorf("error creating justgiving.page_priority %v", err)
+	}
+	return nil
+}
+
+func (s *postgres) UpdatePageShortName(pageID uint, shortName string) error {
+	sql := `UPDATE justgiving.page SET page_short_name=$1,updated_timestamp=CURRENT_TIMESTAMP WHERE page_id=$2`
+	if _, err := s.q.Exec(sql, shortName, pageID); err != nil {
+		return fmt.Errorf("error updating justgiving.page %v", err)
+	}
+	return nil
+}
+
+func (s *postgres) DefaultPagePriority() (int, error) {
+	// (pg_get_expr rather than adsrc, which was dropped in postgres 12)
+	sql := `SELECT CAST(COALESCE(pg_get_expr(pad.adbin, pad.adrelid), '0') AS INTEGER) AS default_value
+ FROM pg_catalog.pg_attrdef pad, pg_catalog.pg_attribute pat, pg_catalog.pg_class pc
+ WHERE pc.relname='page_priority'
+ AND pc.oid=pat.attrelid AND pat.attname='priority'
+ AND pat.attrelid=pad.adrelid AND pat.attnum=pad.adnum;`
+	var result int
+	if err := s.q.QueryRow(sql).Scan(&result); err != nil {
+		return 0, fmt.Errorf("error fetching default page priority from justgiving database %v", err)
+	}
+	return result, nil
+}
+
+func (s *postgres) PagePriority(pageID uint) (int, bool, error) {
+	var priority int
+	err := s.q.QueryRow(`SELECT priority FROM justgiving.page_priority WHERE page_id=$1`, pageID).Scan(&priority)
+	if err == pgx.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error querying justgiving.page_priority %v", err)
+	}
+	return priority, true, nil
+}
+
+func (s *postgres) PagesToRefresh(maxPriority int, limit int) ([]uint, error) {
+	// the COALESCE postgres function handles pages never refreshed
+	rows, err := s.q.Query(`SELECT pp.page_id FROM justgiving.page_priority pp
+ WHERE pp.priority > 0 AND pp.priority <= $1 AND (pp.fundraising_result_timestamp IS NULL OR pp.fundraising_result_timestamp < (CURRENT_TIMESTAMP - INTERVAL '2 hours'))
+ AND EXISTS (SELECT 1 FROM justgiving.page p, justgiving.event e WHERE p.page_id = pp.page_id AND p.event_id = e.event_id AND e.priority > 0)
+ AND NOT EXISTS (SELECT 1 FROM que_jobs j WHERE j.queue = $2 AND j.job_class = $3 AND j.args->>'page_id' = pp.page_id::text)
+ ORDER BY pp.priority, COALESCE(pp.fundraising_result_timestamp, TIMESTAMP '1970-01-01 00:00') LIMIT $4;`,
+		maxPriority, jgforce.JustGivingQueue, jgforce.RefreshPageResultsJob, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying justgiving.page_priority %v", err)
+	}
+	defer rows.Close()
+	var pages []uint
+	for rows.Next() {
+		var pageID uint
+		if err = rows.Scan(&pageID); err != nil {
+			return nil, fmt.Errorf("error reading from justgiving.page_priority %v", err)
+		}
+		if pageID > 0 {
+			pages = append(pages, pageID)
+		}
+	}
+	return pages, nil
+}
+
+func (s *postgres) SetPagePriority(pageID uint, priority int) error {
+	if _, err := s.q.Exec(`UPDATE justgiving.page_priority SET priority=$1,unserviceable=FALSE WHERE page_id=$2`, priority, pageID); err != nil {
+		return fmt.Errorf("error updating justgiving.page_priority to %d for page id %d %v", priority, pageID, err)
+	}
+	return nil
+}
+
+func (s *postgres) SetPageUnserviceable(pageID uint) error {
+	if _, err := s.q.Exec(`UPDATE justgiving.page_priority SET priority=0,unserviceable=TRUE WHERE page_id=$1`, pageID); err != nil {
+		return fmt.Errorf("error setting justgiving.page_priority unserviceable for page id %d %v", pageID, err)
+	}
+	return nil
+}
+
+func (s *postgres) UnserviceablePages(limit int) ([]uint, error) {
+	rows, err := s.q.Query(`SELECT pp.page_id FROM justgiving.page_priority pp
+ WHERE pp.unserviceable AND (pp.fundraising_result_timestamp IS NULL OR pp.fundraising_result_timestamp < (CURRENT_TIMESTAMP - INTERVAL '24 hours'))
+ AND EXISTS (SELECT 1 FROM justgiving.page p, justgiving.event e WHERE p.page_id = pp.page_id AND p.event_id = e.event_id AND e.priority > 0)
+ AND NOT EXISTS (SELECT 1 FROM que_jobs j WHERE j.queue = $1 AND j.job_class = $2 AND j.args->>'page_id' = pp.page_id::text)
+ ORDER BY COALESCE(pp.fundraising_result_timestamp, TIMESTAMP '1970-01-01 00:00') LIMIT $3;`,
+		jgforce.JustGivingQueue, jgforce.RefreshPageResultsJob, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying justgiving.page_priority %v", err)
+	}
+	defer rows.Close()
+	var pages []uint
+	for rows.Next() {
+		var pageID uint
+		if err = rows.Scan(&pageID); err != nil {
+			return nil, fmt.Errorf("error reading from justgiving.page_priority %v", err)
+		}
+		pages = append(pages, pageID)
+	}
+	return pages, nil
+}
+
+func (s *postgres) RevivePage(pageID uint, priority int) (bool, error) {
+	ct, err := s.q.Exec(`UPDATE justgiving.page_priority SET priority=$1,unserviceable=FALSE WHERE page_id=$2 AND unserviceable`, priority, pageID)
+	if err != nil {
+		return false, fmt.Errorf("error reviving justgiving.page_priority for page id %d %v", pageID, err)
+	}
+	return ct.RowsAffected() > 0, nil
+}
+
+func (s *postgres) UpdatePagePriority(pageID uint, priority int) error {
+	if _, err := s.q.Exec(`UPDATE justgiving.page_priority SET priority=$1 WHERE page_id=$2 AND priority <> 0`, priority, pageID); err != nil {
+		return fmt.Errorf("error updating justgiving.page_priority to %d for page id %d %v", priority, pageID, err)
+	}
+	return nil
+}
+
+func (s *postgres) BumpPagePriority(pageID uint) error {
+	if _, err := s.q.Exec(`UPDATE justgiving.page_priority SET priority=priority+1 WHERE page_id=$1 AND priority <> 0`, pageID); err != nil {
+		return fmt.Errorf("error bumping justgiving.page_priority for page id %d %v", pageID, err)
+	}
+	return nil
+}
+
+func (s *postgres) ResetPagePriority(pageID uint, def int) error {
+	if _, err := s.q.Exec(`UPDATE justgiving.page_priority SET priority=$1 WHERE page_id=$2 AND priority > $1`, def, pageID); err != nil {
+		return fmt.Errorf("error resetting justgiving.page_priority for page id %d %v", pageID, err)
+	}
+	return nil
+}
+
+func (s *postgres) SetResultsRefreshed(pageID uint) error {
+	sql := `UPDATE justgiving.page_priority SET fundraising_result_timestamp=CURRENT_TIMESTAMP WHERE page_id=$1`
+	if _, err := s.q.Exec(sql, pageID); err != nil {
+		return fmt.Errorf("error updating fundraising_result_timestamp on justgiving.page_priority %v", err)
+	}
+	return nil
+}
+
+func (s *postgres) SaveResults(pageID uint, year int, month int, day int, currency string, fr justin_models.FundraisingResults) error {
+	values, err := resultArgs(fr)
+	if err != nil {
+		return err
+	}
+	values = append(values, nullString(currency))
+	// check if we have already created an initial results record for this page
+	var res uint
+	sql := `SELECT 1 FROM justgiving.fundraising_result WHERE page_id=$1 AND year = 0 and month = 0 and day = 0`
+	err = s.q.QueryRow(sql, pageID).Scan(&res)
+	if err == pgx.ErrNoRows { // if not create one
+		sql = `INSERT INTO justgiving.fundraising_result (page_id,year,month,day,target,total_raised_percentage_of_target,total_raised_offline,total_raised_online,total_raised_sms,total_estimated_gift_aid,unparsed_amounts,currency_code)
+	 VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12);`
+		_, err = s.q.Exec(sql, append([]interface{}{pageID, 0, 0, 0}, values...)...)
+		if err != nil {
+			return fmt.Errorf("error creating initial justgiving.fundraising_result %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("error querying initial justgiving.fundraising_result %v", err)
+	}
+
+	// check if we have already created a results record for this year/month/day
+	sql = `SELECT 1 FROM justgiving.fundraising_result WHERE page_id=$1 AND year = $2 and month = $3 and day = $4`
+	err = s.q.QueryRow(sql, pageID, year, month, day).Scan(&res)
+	if err == pgx.ErrNoRows { // if not create one
+		sql = `INSERT INTO justgiving.fundraising_result (page_id,year,month,day,target,total_raised_percentage_of_target,total_raised_offline,total_raised_online,total_raised_sms,total_estimated_gift_aid,unparsed_amounts,currency_code)
+	 VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12);`
+		_, err = s.q.Exec(sql, append([]interface{}{pageID, year, month, day}, values...)...)
+		if err != nil {
+			return fmt.Errorf("error creating justgiving.fundraising_result %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error querying justgiving.fundraising_result %v", err)
+	}
+	// otherwise update the existing record
+	sql = `UPDATE justgiving.fundraising_result
+	 SET target=$1,total_raised_percentage_of_target=$2,total_raised_offline=$3,total_raised_online=$4,total_raised_sms=$5,total_estimated_gift_aid=$6,unparsed_amounts=$7,currency_code=$8,updated_timestamp=CURRENT_TIMESTAMP
+	 WHERE page_id=$9 AND year=$10 AND month=$11 AND day=$12`
+	_, err = s.q.Exec(sql, append(values, pageID, year, month, day)...)
+	if err != nil {
+		return fmt.Errorf("error updating justgiving.fundraising_result %v", err)
+	}
+	return nil
+}
+
+// nullString is s as a query argument, nil (NULL) if s is blank
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullID is id as a query argument, nil (NULL) if id is 0 (e.g. the event of a team)
+func nullID(id uint) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// resultArgs are the amounts of fr as query arguments (in the order of resultColumns, nil for an amount which isn't a decimal)
+// followed by the json of the unparsed amounts (nil if there are none)
+func resultArgs(fr justin_models.FundraisingResults) ([]interface{}, error) {
+	amounts, unparsed := parseResults(fr)
+	args := make([]interface{}, 0, len(amounts)+1)
+	for _, a := range amounts {
+		if a == nil {
+			args = append(args, nil)
+		} else {
+			args = append(args, *a)
+		}
+	}
+	if unparsed == nil {
+		return append(args, nil), nil
+	}
+	b, err := json.Marshal(unparsed)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding unparsed amounts %v", err)
+	}
+	return append(args, string(b)), nil
+}
+
+func (s *postgres) Results(pageID uint, limit int) ([]FundraisingResults, error) {
+	var results []FundraisingResults
+	sql := `SELECT * FROM justgiving.event_page_fundraising_result r WHERE page_id = $1
+ ORDER BY r.year DESC, r.month DESC, r.day DESC`
+	if limit > 0 {
+		sql = sql + " LIMIT " + strconv.Itoa(limit)
+	}
+	rows, err := s.q.Query(sql, pageID)
+	if err != nil {
+		return results, fmt.Errorf("error querying new justgiving.fundraising_result %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r FundraisingResults
+		var currency *string
+		if err := rows.Scan(&r.CharityID, &r.EventID, &r.EventName, &r.PageID, &r.PageShortName,
+			&r.Year, &r.Month, &r.Day, &r.Timestamp, &r.TotalRaisedOffline, &r.TotalRaisedOnline,
+			&r.TotalRaisedSMS, &r.TotalEstimatedGiftAid, &r.Target, &currency); err != nil {
+			return results, fmt.Errorf("error reading from justgiving.fundraising_result %v", err)
+		}
+		if currency != nil {
+			r.Currency = *currency
+		}
+		r.TotalRaised = r.TotalRaisedOffline.Add(r.TotalRaisedOnline).Add(r.TotalRaisedSMS)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func (s *postgres) SaveTeam(t Team, year int, month int, day int) error {
+	sql := `INSERT INTO justgiving.team (team_id, team_short_name, name, currency_code) VALUES($1,$2,$3,$4)
+ ON CONFLICT (team_id) DO UPDATE SET team_short_name = EXCLUDED.team_short_name, name = EXCLUDED.name,
+ currency_code = EXCLUDED.currency_code, updated_timestamp = CURRENT_TIMESTAMP;`
+	if _, err := s.q.Exec(sql, t.ID, t.ShortName, t.Name, nullString(t.Currency)); err != nil {
+		return fmt.Errorf("error saving justgiving.team %v", err)
+	}
+	if _, err := s.q.Exec(`DELETE FROM justgiving.team_member WHERE team_id = $1`, t.ID); err != nil {
+		return fmt.Errorf("error deleting justgiving.team_member %v", err)
+	}
+	for _, m := range t.Members {
+		sql = `INSERT INTO justgiving.team_member (team_id, page_id, page_short_name) VALUES($1,$2,$3) ON CONFLICT DO NOTHING;`
+		if _, err := s.q.Exec(sql, t.ID, m.PageID, m.ShortName); err != nil {
+			return fmt.Errorf("error creating justgiving.team_member %v", err)
+		}
+	}
+	// the initial totals are only created once, the day's are replaced
+	sql = `INSERT INTO justgiving.team_fundraising_result (team_id, year, month, day, target, raised_so_far, currency_code)
+ VALUES($1,0,0,0,$2,$3,$4) ON CONFLICT DO NOTHING;`
+	if _, err := s.q.Exec(sql, t.ID, t.Target, t.Raised, nullString(t.Currency)); err != nil {
+		return fmt.Errorf("error creating initial justgiving.team_fundraising_result %v", err)
+	}
+	sql = `INSERT INTO justgiving.team_fundraising_result (team_id, year, month, day, target, raised_so_far, currency_code)
+ VALUES($1,$2,$3,$4,$5,$6,$7) ON CONFLICT (team_id, year, month, day) DO UPDATE SET target = EXCLUDED.target,
+ raised_so_far = EXCLUDED.raised_so_far, currency_code = EXCLUDED.currency_code, updated_timestamp = CURRENT_TIMESTAMP;`
+	if _, err := s.q.Exec(sql, t.ID, year, month, day, t.Target, t.Raised, nullString(t.Currency)); err != nil {
+		return fmt.Errorf("error saving justgiving.team_fundraising_result %v", err)
+	}
+	return nil
+}
+
+func (s *postgres) TeamShortName(teamID uint) (string, bool, error) {
+	var shortName string
+	err := s.q.QueryRow(`SELECT team_short_name FROM justgiving.team WHERE team_id=$1`, teamID).Scan(&shortName)
+	if err == pgx.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error querying justgiving.team %v", err)
+	}
+	return shortName, true, nil
+}
+
+func (s *postgres) TeamResults(teamID uint, limit int) ([]FundraisingResults, error) {
+	var results []FundraisingResults
+	sql := `SELECT t.team_id, t.team_short_name, COALESCE(t.name, ''), r.year, r.month, r.day, r.updated_timestamp,
+ r.raised_so_far, r.target, r.currency_code
+ FROM justgiving.team_fundraising_result r, justgiving.team t WHERE t.team_id = r.team_id AND r.team_id = $1
+ ORDER BY r.year DESC, r.month DESC, r.day DESC`
+	if limit > 0 {
+		sql = sql + " LIMIT " + strconv.Itoa(limit)
+	}
+	rows, err := s.q.Query(sql, teamID)
+	if err != nil {
+		return results, fmt.Errorf("error querying justgiving.team_fundraising_result %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r FundraisingResults
+		var currency *string
+		if err := rows.Scan(&r.TeamID, &r.PageShortName, &r.EventName, &r.Year, &r.Month, &r.Day, &r.Timestamp,
+			&r.TotalRaisedOnline, &r.Target, &currency); err != nil {
+			return results, fmt.Errorf("error reading from justgiving.team_fundraising_result %v", err)
+		}
+		if currency != nil {
+			r.Currency = *currency
+		}
+		r.TotalRaised = r.TotalRaisedOnline
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// contactSQL selects the contact fields used in a search, it is completed with a WHERE clause
+const contactSQL = `SELECT c.sfid, c.jg_charity_id__c, c.event_id__c, c.fundraising_page_id__c,
+ c.fundraising_page_url__c, c.fundraising_team_page_url__c,
+ CASE WHEN c.fundraiser_jg_email__c IS NULL OR c.fundraiser_jg_email__c='' THEN c.email
+ 	ELSE c.fundraiser_jg_email__c
+ END AS email
+ FROM salesforce.contact c`
+
+func (s *postgres) NewContacts() ([]Contact, error) {
+	sql := contactSQL + ` LEFT OUTER JOIN salesforce.donation_stats__c d
+ ON (c.sfid = d.related_contact_record__c)
+ WHERE d.sfid IS NULL ORDER BY c.systemmodstamp DESC;`
+	rows, err := s.q.Query(sql)
+	if err != nil {
+		return nil, fmt.Errorf("error querying new salesforce.contacts %v", err)
+	}
+	defer rows.Close()
+	var contacts []Contact
+	for rows.Next() {
+		var c Contact
+		if err = rows.Scan(&c.ID, &c.CharityID, &c.EventID, &c.PageID, &c.PageURL, &c.TeamPageURL, &c.Email); err != nil {
+			return nil, fmt.Errorf("error reading from new salesforce.contacts %v", err)
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
+
+func (s *postgres) Contact(id string) (*Contact, error) {
+	var c Contact
+	err := s.q.QueryRow(contactSQL+` WHERE c.sfid = $1;`, id).Scan(&c.ID, &c.CharityID, &c.EventID, &c.PageID, &c.PageURL, &c.TeamPageURL, &c.Email)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading salesforce.contact %s %v", id, err)
+	}
+	return &c, nil
+}
+
+func (s *postgres) DonationStatsPages(contactID string) ([]DonationStatsPage, error) {
+	var rows *pgx.Rows
+	var err error
+	// (a team's donation stats, see TeamPageID, are per contact)
+	sql := `SELECT fundraising_page_id__c,
+ CASE WHEN fundraising_page_id__c LIKE 'T%' THEN related_contact_record__c END AS team_contact_id,
+ MAX(transaction_date__c) FROM salesforce.donation_stats__c`
+	if contactID == "" {
+		rows, err = s.q.Query(sql + " GROUP BY 1, 2;")
+	} else {
+		rows, err = s.q.Query(sql+" WHERE related_contact_record__c = $1 GROUP BY 1, 2;", contactID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying pages from salesforce.donation_stats__c %v", err)
+	}
+	defer rows.Close()
+	var pages []DonationStatsPage
+	for rows.Next() {
+		var pageID, teamContactID *string
+		var transDate *time.Time
+		if err = rows.Scan(&pageID, &teamContactID, &transDate); err != nil {
+			return nil, fmt.Errorf("error reading page id and transaction date from salesforce.donation_stats__c %v", err)
+		}
+		if pageID != nil && *pageID != "" {
+			p := DonationStatsPage{PageID: *pageID, Updated: transDate}
+			if teamContactID != nil {
+				p.ContactID = *teamContactID
+			}
+			pages = append(pages, p)
+		}
+	}
+	return pages, nil
+}
+
+func (s *postgres) HasDonationStatsMaster(pageID uint) (bool, error) {
+	var rec *int
+	sql := `SELECT 1 FROM salesforce.donation_stats__c WHERE fundraising_page_id__c = $1 AND transaction_date__c IS NULL;`
+	err := s.q.QueryRow(sql, strconv.FormatInt(int64(pageID), 10)).Scan(&rec)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking for existing association with salesforce.donation_stats__c %v", err)
+	}
+	return true, nil
+}
+
+func (s *postgres) AddDonationStatsMaster(contactID string, initial FundraisingResults) (bool, error) {
+	// (donation dates are truncated to the second)
+	pageID := initial.DonationStatsPageID()
+	sql := `INSERT INTO salesforce.donation_stats__c
+	 (jgforce_key__c, fundraising_page_id__c, related_contact_record__c, initial_raised_online__c,
+		initial_raised_sms__c, initial_raised_offline__c, intial_estimated_gift_aid__c, initial_pledge_amount__c,
+		fundraising_portal_used__c, event_id__c, jg_charity_id__c, event_name__c, donation_date__c)
+	VALUES($1,$2,$3,$4::numeric,$5::numeric,$6::numeric,$7::numeric,$8::numeric,$9,$10,$11,$12,date_trunc('second', $13::timestamp))
+	ON CONFLICT (jgforce_key__c) DO NOTHING;`
+	ct, err := s.q.Exec(sql, MasterKey(pageID, contactID), pageID, contactID, initial.TotalRaisedOnline,
+		initial.TotalRaisedSMS, initial.TotalRaisedOffline, initial.TotalEstimatedGiftAid, initial.Target,
+		"Just Giving", nullID(initial.EventID), nullID(initial.CharityID), initial.EventName, initial.Timestamp)
+	if err != nil {
+		return false, fmt.Errorf("error creating initial salesforce.donation_stats__c %v", err)
+	}
+	return ct.RowsAffected() > 0, nil
+}
+
+func (s *postgres) UpdateDonationStatsPageURL(pageID string, url string) error {
+	sql := `UPDATE salesforce.donation_stats__c SET fundraising_page_url__c = $2
+ WHERE fundraising_page_id__c = $1 AND transaction_date__c IS NULL
+ AND (fundraising_page_url__c IS NULL OR fundraising_page_url__c <> $2);`
+	if _, err := s.q.Exec(sql, pageID, url); err != nil {
+		return fmt.Errorf("error updating page short name for page id %s on initial salesforce.donation_stats__c record %v", pageID, err)
+	}
+	return nil
+}
+
+func (s *postgres) DonationStatsTotals(pageID string, contactID string, exclude string) (DonationStatsTotals, error) {
+	// (the sums match the salesforce.contact_page_fundraising_result view, the contact is the one on the master record).
+	// The amounts are DOUBLE PRECISION (heroku connect's type for salesforce currency fields), the sums are cast to NUMERIC
+	// which rounds them to 15 significant digits, dropping any error from adding them up.
+	var t DonationStatsTotals
+	var masterContactID *string
+	sql := `SELECT MAX(CASE WHEN transaction_date__c IS NULL THEN related_contact_record__c END),
+	COALESCE(SUM(COALESCE(initial_raised_online__c,0) + COALESCE(raised_online_incremental__c,0)),0)::numeric,
+	COALESCE(SUM(COALESCE(initial_raised_sms__c,0) + COALESCE(raised_sms_incremental__c,0)),0)::numeric,
+	COALESCE(SUM(COALESCE(initial_raised_offline__c,0) + COALESCE(raised_offline_incremental__c,0)),0)::numeric,
+	COALESCE(SUM(COALESCE(intial_estimated_gift_aid__c,0) + COALESCE(estimated_gift_aid__c,0)),0)::numeric,
+	COALESCE(SUM(COALESCE(initial_pledge_amount__c,0) + COALESCE(pledge_amount_revised__c,0)),0)::numeric
+	FROM salesforce.donation_stats__c WHERE fundraising_page_id__c = $1 AND jgforce_key__c IS DISTINCT FROM $2
+	AND ($3 = '' OR related_contact_record__c = $3);`
+	err := s.q.QueryRow(sql, pageID, exclude, contactID).Scan(&masterContactID, &t.RaisedOnline, &t.RaisedSMS, &t.RaisedOffline, &t.EstimatedGiftAid, &t.Target)
+	if err != nil {
+		return t, fmt.Errorf("error reading salesforce.donation_stats__c totals for page id %s %v", pageID, err)
+	}
+	if masterContactID == nil {
+		return t, fmt.Errorf("missing contact id when reading salesforce.donation_stats__c totals for page id %s", pageID)
+	}
+	t.ContactID = *masterContactID
+	return t, nil
+}
+
+func (s *postgres) SaveDonationStatsDetail(d DonationStatsDetail) error {
+	sql := `INSERT INTO salesforce.donation_stats__c
+ (jgforce_key__c, fundraising_page_id__c, related_contact_record__c, transaction_date__c, raised_online_incremental__c, raised_sms_incremental__c, raised_offline_incremental__c, estimated_gift_aid__c, pledge_amount_revised__c,donation_date__c)
+ VALUES($1,$2,$3,$4,$5::numeric,$6::numeric,$7::numeric,$8::numeric,$9::numeric,date_trunc('second', $4::timestamp))
+ ON CONFLICT (jgforce_key__c) DO UPDATE SET transaction_date__c = EXCLUDED.transaction_date__c,
+ raised_online_incremental__c = EXCLUDED.raised_online_incremental__c, raised_sms_incremental__c = EXCLUDED.raised_sms_incremental__c,
+ raised_offline_incremental__c = EXCLUDED.raised_offline_incremental__c, estimated_gift_aid__c = EXCLUDED.estimated_gift_aid__c,
+ pledge_amount_revised__c = EXCLUDED.pledge_amount_revised__c, donation_date__c = EXCLUDED.donation_date__c;`
+	_, err := s.q.Exec(sql, d.Key, d.PageID, d.ContactID, d.Date, d.RaisedOnline, d.RaisedSMS, d.RaisedOffline, d.EstimatedGiftAid, d.Target)
+	if err != nil {
+		return fmt.Errorf("error saving incremental salesforce.donation_stats__c record %s %v", d.Key, err)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+// Package store is the data access of the workers, the justgiving schema (events, pages, page priorities and fundraising results)
+// and the salesforce contacts and donation stats synced by heroku connect. Store is implemented for postgres (see Connect)
+// and in memory (see NewMemory) so the sync and matching logic can be tested without a database.
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/homemade/jgforce/decimal"
+	justin_models "github.com/homemade/justin/models"
+)
+
+// Event is a justgiving event we track
+type Event struct {
+	CharityID      uint
+	ID             uint
+	Name           string
+	Type           string
+	Location       string
+	StartDate      time.Time
+	CompletionDate time.Time
+	ExpiryDate     time.Time
+}
+
+// FundraisingResults are the results of a page for a day (year, month and day are 0 for the initial results of the page),
+// along with the page's event. Amounts which weren't decimals (see SaveResults) are 0, Currency is the page's currency
+// (an ISO 4217 code e.g. GBP, blank for results saved before we captured it).
+// The totals of a team are results too (see TeamResults), with the team's id, short name and name in place of the page's and event's.
+type FundraisingResults struct {
+	CharityID             uint
+	EventID               uint
+	EventName             string
+	PageID                uint
+	TeamID                uint
+	PageShortName         string
+	Year                  int
+	Month                 int
+	Day                   int
+	Timestamp             time.Time
+	Currency              string
+	TotalRaisedOffline    decimal.Decimal
+	TotalRaisedOnline     decimal.Decimal
+	TotalRaisedSMS        decimal.Decimal
+	TotalRaised           decimal.Decimal
+	TotalEstimatedGiftAid decimal.Decimal
+	Target                decimal.Decimal
+}
+
+// DonationStatsPageID is the page id of the donation stats of the results, a team's is its TeamPageID
+func (fr FundraisingResults) DonationStatsPageID() string {
+	if fr.TeamID > 0 {
+		return TeamPageID(fr.TeamID)
+	}
+	return strconv.FormatUint(uint64(fr.PageID), 10)
+}
+
+// Team is a justgiving team along with the pages of its members, its amounts are in its currency
+type Team struct {
+	ID        uint
+	ShortName string
+	Name      string
+	Currency  string
+	Target    decimal.Decimal
+	Raised    decimal.Decimal
+	Members   []TeamMember
+}
+
+// TeamMember is the page of a member of a team
+type TeamMember struct {
+	PageID    uint
+	ShortName string
+}
+
+// TeamPageID is the page id of the donation stats of a team e.g. T3000, which record the team's totals in place of a page's results
+func TeamPageID(teamID uint) string {
+	return "T" + strconv.FormatUint(uint64(teamID), 10)
+}
+
+// ParseTeamPageID returns the team id of a TeamPageID, ok is false if pageID is the id of a page rather than a team
+func ParseTeamPageID(pageID string) (teamID uint, ok bool) {
+	if !strings.HasPrefix(pageID, "T") {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(pageID[1:], 10, 32)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// Contact is a salesforce contact, with the fields used to search for their justgiving page
+// (Email is the contact's justgiving email falling back to their email)
+type Contact struct {
+	ID          *string
+	CharityID   *string
+	EventID     *string
+	PageID      *string
+	PageURL     *string
+	TeamPageURL *string
+	Email       *string
+}
+
+// DonationStatsPage is a page with donation stats, Updated is the transaction date of its latest detail record (nil if there are none).
+// Every contact matched with a team has donation stats of their own for the team's totals, ContactID is the contact for a team
+// (and blank for a page).
+type DonationStatsPage struct {
+	PageID    string
+	ContactID string
+	Updated   *time.Time
+}
+
+// DonationStatsTotals are the amounts recorded in the donation stats of a page so far (its master record plus every detail record)
+type DonationStatsTotals struct {
+	ContactID        string
+	RaisedOnline     decimal.Decimal
+	RaisedSMS        decimal.Decimal
+	RaisedOffline    decimal.Decimal
+	EstimatedGiftAid decimal.Decimal
+	Target           decimal.Decimal
+}
+
+// DonationStatsDetail records the change in the results of a page on a day, Key is its DetailKey
+type DonationStatsDetail struct {
+	Key              string
+	PageID           string
+	ContactID        string
+	Date             time.Time
+	RaisedOnline     decimal.Decimal
+	RaisedSMS        decimal.Decimal
+	RaisedOffline    decimal.Decimal
+	EstimatedGiftAid decimal.Decimal
+	Target           decimal.Decimal
+}
+
+// MasterKey is the idempotency key of the page's donation stats master record
+// (donation stats records are unique by key, so a retried or concurrent job can't record the same results twice).
+// The donation stats of a team are per contact, so its keys include the contact e.g. T3000:003000000000003:initial
+func MasterKey(pageID string, contactID string) string {
+	return keyPrefix(pageID, contactID) + ":initial"
+}
+
+// DetailKey is the idempotency key of the page's donation stats detail record for the day (see MasterKey)
+func DetailKey(pageID string, contactID string, year int, month int, day int) string {
+	return fmt.Sprintf("%s:%04d-%02d-%02d", keyPrefix(pageID, contactID), year, month, day)
+}
+
+func keyPrefix(pageID string, contactID string) string {
+	if _, ok := ParseTeamPageID(pageID); ok {
+		return pageID + ":" + contactID
+	}
+	return pageID
+}
+
+// resultColumns are the amount columns of justgiving.fundraising_result, in the order of parseResults' amounts
+var resultColumns = [...]string{"target", "total_raised_percentage_of_target", "total_raised_offline",
+	"total_raised_online", "total_raised_sms", "total_estimated_gift_aid"}
+
+// parseResults parses the amounts of results from the justgiving api, in the order of resultColumns. A blank amount is 0,
+// an amount which isn't a decimal is nil and its original value is returned in unparsed (by column), nil if every amount parsed.
+func parseResults(fr justin_models.FundraisingResults) (amounts [len(resultColumns)]*decimal.Decimal, unparsed map[string]string) {
+	values := [len(resultColumns)]string{fr.Target, fr.TotalRaisedPercentageOfTarget, fr.TotalRaisedOffline,
+		fr.TotalRaisedOnline, fr.TotalRaisedSMS, fr.TotalEstimatedGiftAid}
+	for i, v := range values {
+		if v == "" {
+			amounts[i] = &decimal.Decimal{}
+			continue
+		}
+		d, err := decimal.Parse(v)
+		if err != nil {
+			if unparsed == nil {
+				unparsed = make(map[string]string)
+			}
+			unparsed[resultColumns[i]] = v
+			continue
+		}
+		amounts[i] = &d
+	}
+	return amounts, unparsed
+}
+
+// Store is the data used by the workers.
+// Page priorities order the refreshing of page results, 1 is the highest and 0 marks a page as cancelled or unserviceable.
+type Store interface {
+	// Transact runs f as a single unit of work, its changes are committed if f returns nil and rolled back otherwise.
+	// f must make its changes with tx (rather than the store Transact was called on), calling Transact on tx just runs f.
+	Transact(f func(tx Store) error) error
+
+	// ActiveEvents returns the ids of the events with priority > 0, in priority order
+	ActiveEvents() ([]uint, error)
+
+	// EventsToSync returns the active events which don't already have a sync job waiting on the queue
+	EventsToSync() ([]uint, error)
+
+	// HasActiveEventStarting reports whether any active event starts at start
+	HasActiveEventStarting(start time.Time) (bool, error)
+
+	// AddEvent starts tracking the event (with the default priority)
+	AddEvent(e Event) error
+
+	// PageShortName returns the short name of the page, found is false if we don't have the page
+	PageShortName(pageID uint) (shortName string, found bool, err error)
+
+	// PageByShortName returns the id of the page with the short name (ignoring case), found is false if we don't have the page
+	PageByShortName(shortName string) (pageID uint, found bool, err error)
+
+	// AddPage adds the page along with its priority (the default)
+	AddPage(charityID uint, eventID uint, pageID uint, shortName string) error
+
+	// UpdatePageShortName of an existing page
+	UpdatePageShortName(pageID uint, shortName string) error
+
+	// DefaultPagePriority is the priority given to new pages
+	DefaultPagePriority() (int, error)
+
+	// PagePriority returns the priority of the page, found is false if we don't have the page
+	PagePriority(pageID uint) (priority int, found bool, err error)
+
+	// PagesToRefresh returns up to limit pages of active events with priority between 1 and maxPriority whose results haven't been
+	// refreshed in the last 2 hours (and which don't already have a refresh job waiting on the queue),
+	// in priority order followed by the least recently refreshed
+	PagesToRefresh(maxPriority int, limit int) ([]uint, error)
+
+	// SetPagePriority of the page (clearing any unserviceable flag, see SetPageUnserviceable)
+	SetPagePriority(pageID uint, priority int) error
+
+	// SetPageUnserviceable sets the priority of the page to 0 and flags it as unserviceable (justgiving can't give us its results),
+	// unlike a cancelled page it is re-checked every so often (see UnserviceablePages)
+	SetPageUnserviceable(pageID uint) error
+
+	// UnserviceablePages returns up to limit unserviceable pages of active events which haven't been re-checked in the last 24 hours
+	// (and which don't already have a refresh job waiting on the queue), the least recently checked first
+	UnserviceablePages(limit int) ([]uint, error)
+
+	// RevivePage sets the priority of an unserviceable page and clears its flag, revived is false if the page isn't unserviceable
+	RevivePage(pageID uint, priority int) (revived bool, err error)
+
+	// UpdatePagePriority sets the priority of the page unless it is cancelled or unserviceable (priority 0)
+	UpdatePagePriority(pageID uint, priority int) error
+
+	// BumpPagePriority increments the page's priority value (so it is refreshed later) unless it is cancelled or unserviceable (priority 0),
+	// every error on a page bumps it
+	BumpPagePriority(pageID uint) error
+
+	// ResetPagePriority back to def if it has been bumped above it
+	ResetPagePriority(pageID uint, def int) error
+
+	// SetResultsRefreshed records the page's results were refreshed now
+	SetResultsRefreshed(pageID uint) error
+
+	// SaveResults of the page (in the page's currency) against the day, creating the page's initial results first if it has none.
+	// An amount which isn't a decimal is saved as NULL and flagged with its original value (see parseResults).
+	SaveResults(pageID uint, year int, month int, day int, currency string, fr justin_models.FundraisingResults) error
+
+	// Results returns the results of the page, latest first (up to limit if limit > 0)
+	Results(pageID uint, limit int) ([]FundraisingResults, error)
+
+	// SaveTeam saves the team and its members (replacing any previous members) and its totals against the day,
+	// creating the team's initial totals first if it has none
+	SaveTeam(t Team, year int, month int, day int) error
+
+	// TeamShortName returns the short name of the team, found is false if we don't have the team
+	TeamShortName(teamID uint) (shortName string, found bool, err error)
+
+	// TeamResults returns the totals of the team as results, latest first (up to limit if limit > 0). The justgiving api
+	// doesn't break a team's total down, so the amount raised so far is all raised online (and there is no gift aid).
+	TeamResults(teamID uint, limit int) ([]FundraisingResults, error)
+
+	// NewContacts returns the contacts without donation stats synced back to salesforce, latest first
+	NewContacts() ([]Contact, error)
+
+	// Contact returns the contact with the salesforce id, or nil if there is no such contact
+	Contact(id string) (*Contact, error)
+
+	// DonationStatsPages returns the pages (and teams, see TeamPageID, once for each contact) with donation stats,
+	// for every contact or just the one with the salesforce id
+	DonationStatsPages(contactID string) ([]DonationStatsPage, error)
+
+	// HasDonationStatsMaster reports whether the page has a donation stats master record
+	HasDonationStatsMaster(pageID uint) (bool, error)
+
+	// AddDonationStatsMaster records the contact's page (or team) with its initial results,
+	// added is false if the page (or the contact's team) already has a master record
+	AddDonationStatsMaster(contactID string, initial FundraisingResults) (added bool, err error)
+
+	// UpdateDonationStatsPageURL sets the page url on the page's master record
+	UpdateDonationStatsPageURL(pageID string, url string) error
+
+	// DonationStatsTotals returns the totals of the page's donation stats (just the contact's if contactID isn't blank, as for a team),
+	// leaving out the record with the exclude key (if any)
+	DonationStatsTotals(pageID string, contactID string, exclude string) (DonationStatsTotals, error)
+
+	// SaveDonationStatsDetail records a change in the page's results, replacing the amounts of any existing record with the same key
+	SaveDonationStatsDetail(d DonationStatsDetail) error
+}
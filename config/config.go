@@ -0,0 +1,269 @@
+// Package config loads the settings of every process once at startup, from env vars and an optional config file
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/homemade/jgforce"
+	"github.com/homemade/jgforce/decimal"
+)
+
+// The settings, named by the env var they are read from (which is also their key in the config file)
+const (
+	DatabaseURL            = "DATABASE_URL"
+	Port                   = "PORT"
+	WebAPIKey              = "WEB_API_KEY"
+	MetricsPort            = "METRICS_PORT"
+	JustinAPIKey           = "JUSTIN_APIKEY"
+	JustinBaseURL          = "JUSTIN_BASE_URL"
+	JustinCharity          = "JUSTIN_CHARITY"
+	JustinResultsBatch     = "JUSTIN_RESULTS_BATCH"
+	Heartbeat              = "HEARTBEAT"
+	Schedule               = "SCHEDULE"
+	ScheduleFile           = "SCHEDULE_FILE"
+	ScheduleCatchUp        = "SCHEDULE_CATCHUP"
+	JustGivingWorkers      = "JUSTGIVING_WORKERS"
+	JustGivingPollInterval = "JUSTGIVING_POLL_INTERVAL"
+	SalesForceWorkers      = "SALESFORCE_WORKERS"
+	SalesForcePollInterval = "SALESFORCE_POLL_INTERVAL"
+	JobTimeouts            = "JOB_TIMEOUTS"
+	SalesForceCurrency     = "SALESFORCE_CURRENCY"
+	CurrencyRates          = "CURRENCY_RATES"
+	TeamDonationStats      = "TEAM_DONATION_STATS"
+
+	// File names a json file of settings e.g. {"JUSTIN_RESULTS_BATCH": "100"}, env vars take precedence over it
+	File = "CONFIG_FILE"
+)
+
+// Config holds the settings, see Load
+type Config struct {
+	DatabaseURL string
+	Port        string
+	MetricsPort string
+
+	// WebAPIKey is the key every request to the web process must carry, either as a bearer token or the password of basic auth
+	WebAPIKey string
+
+	// JustinAPIKey is the justgiving api key, JustinCharity the default charity id for salesforce contacts without one
+	// and JustinResultsBatch the number of pages refreshed each justgiving heartbeat.
+	// JustinBaseURL points the workers at a stand-in for the live justgiving api (e.g. a fake server in tests)
+	JustinAPIKey       string
+	JustinBaseURL      string
+	JustinCharity      uint
+	JustinResultsBatch int
+
+	// Heartbeat is the interval (in minutes) of the default clock schedule, used when neither Schedule nor ScheduleFile are set
+	Heartbeat       int
+	Schedule        string
+	ScheduleFile    string
+	ScheduleCatchUp string
+
+	JustGivingWorkers      int
+	JustGivingPollInterval time.Duration
+	SalesForceWorkers      int
+	SalesForcePollInterval time.Duration
+	JobTimeouts            map[string]time.Duration
+
+	// SalesForceCurrency is the currency (an ISO 4217 code e.g. GBP) of the donation stats in salesforce, the results of pages
+	// in other currencies are converted with CurrencyRates - the value of one unit of each currency in SalesForceCurrency
+	// e.g. {"USD": 0.79, "EUR": 0.86}
+	SalesForceCurrency string
+	CurrencyRates      map[string]decimal.Decimal
+
+	// TeamDonationStats is what the donation stats of a salesforce contact with a team page url reflect,
+	// member (the default) for the contact's own page in the team or team for the team's totals
+	TeamDonationStats string
+}
+
+// Errors are all the problems found loading the config
+type Errors []string
+
+func (e Errors) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+// Load the settings from the env vars, falling back to the config file named by CONFIG_FILE (if any) and then the defaults.
+// The required settings are those the calling process can't run without, every problem found is reported in the returned Errors.
+func Load(required ...string) (*Config, error) {
+	l := loader{file: make(map[string]string)}
+	if f := os.Getenv(File); f != "" {
+		if err := l.readFile(f); err != nil {
+			return nil, Errors{err.Error()}
+		}
+	}
+	for _, key := range required {
+		if l.get(key) == "" {
+			l.errorf("missing %s", key)
+		}
+	}
+
+	cfg := &Config{
+		DatabaseURL:            l.get(DatabaseURL),
+		Port:                   l.get(Port),
+		WebAPIKey:              l.get(WebAPIKey),
+		MetricsPort:            l.get(MetricsPort),
+		JustinAPIKey:           l.get(JustinAPIKey),
+		JustinBaseURL:          strings.TrimSuffix(l.get(JustinBaseURL), "/"),
+		JustinCharity:          uint(l.int(JustinCharity, 0)),
+		JustinResultsBatch:     l.int(JustinResultsBatch, 0),
+		Heartbeat:              l.int(Heartbeat, 0),
+		Schedule:               l.get(Schedule),
+		ScheduleFile:           l.get(ScheduleFile),
+		ScheduleCatchUp:        l.get(ScheduleCatchUp),
+		JustGivingWorkers:      l.int(JustGivingWorkers, 3),
+		JustGivingPollInterval: l.duration(JustGivingPollInterval, 30*time.Second),
+		SalesForceWorkers:      l.int(SalesForceWorkers, 1),
+		SalesForcePollInterval: l.duration(SalesForcePollInterval, 30*time.Second),
+		SalesForceCurrency:     l.currency(SalesForceCurrency, "GBP"),
+		CurrencyRates:          l.rates(CurrencyRates),
+		TeamDonationStats:      l.get(TeamDonationStats),
+	}
+
+	if cfg.DatabaseURL != "" {
+		if _, err := pgx.ParseURI(cfg.DatabaseURL); err != nil {
+			l.errorf("invalid %s %v", DatabaseURL, err)
+		}
+	}
+	if cfg.JustinBaseURL != "" {
+		if u, err := url.Parse(cfg.JustinBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			l.errorf("invalid %s %s, expected an absolute url", JustinBaseURL, cfg.JustinBaseURL)
+		}
+	}
+	switch cfg.ScheduleCatchUp {
+	case "", "none", "once", "all":
+	default:
+		l.errorf("invalid %s %s, expected none, once or all", ScheduleCatchUp, cfg.ScheduleCatchUp)
+	}
+	switch cfg.TeamDonationStats {
+	case "":
+		cfg.TeamDonationStats = "member"
+	case "member", "team":
+	default:
+		l.errorf("invalid %s %s, expected member or team", TeamDonationStats, cfg.TeamDonationStats)
+	}
+	timeouts, err := jgforce.ParseJobTimeouts(l.get(JobTimeouts))
+	if err != nil {
+		l.errorf("invalid %s %v", JobTimeouts, err)
+	}
+	cfg.JobTimeouts = timeouts
+
+	if len(l.errs) > 0 {
+		return nil, l.errs
+	}
+	return cfg, nil
+}
+
+// loader reads the settings, collecting any problems in errs
+type loader struct {
+	file map[string]string
+	errs Errors
+}
+
+func (l *loader) readFile(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("error reading %s %s %v", File, name, err)
+	}
+	if err = json.Unmarshal(b, &l.file); err != nil {
+		return fmt.Errorf("error reading %s %s, expected a json object of string values %v", File, name, err)
+	}
+	return nil
+}
+
+func (l *loader) errorf(format string, args ...interface{}) {
+	l.errs = append(l.errs, fmt.Sprintf(format, args...))
+}
+
+// get the setting from its env var or the config file
+func (l *loader) get(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return l.file[key]
+}
+
+// int reads an integer >= 1, or returns def if it isn't set
+func (l *loader) int(key string, def int) int {
+	v := l.get(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if i < 1 || err != nil {
+		l.errorf("invalid %s %s, expected integer value >= 1", key, v)
+		return def
+	}
+	return i
+}
+
+// duration reads a duration (e.g. 30s), or returns def if it isn't set
+func (l *loader) duration(key string, def time.Duration) time.Duration {
+	v := l.get(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if d <= 0 || err != nil {
+		l.errorf("invalid %s %s, expected a duration such as 30s", key, v)
+		return def
+	}
+	return d
+}
+
+// isCurrency reports whether code looks like an ISO 4217 currency code (3 upper case letters)
+func isCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// currency reads a currency code (e.g. GBP), or returns def if it isn't set
+func (l *loader) currency(key string, def string) string {
+	v := l.get(key)
+	if v == "" {
+		return def
+	}
+	if !isCurrency(v) {
+		l.errorf("invalid %s %s, expected a currency code such as GBP", key, v)
+		return def
+	}
+	return v
+}
+
+// rates reads exchange rates by currency code (e.g. USD=0.79,EUR=0.86), each rate must be > 0
+func (l *loader) rates(key string) map[string]decimal.Decimal {
+	rates := make(map[string]decimal.Decimal)
+	v := l.get(key)
+	if v == "" {
+		return rates
+	}
+	for _, entry := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 || !isCurrency(kv[0]) {
+			l.errorf("invalid %s entry %q, expected <currency code>=<rate> e.g. USD=0.79", key, entry)
+			continue
+		}
+		rate, err := decimal.Parse(kv[1])
+		if err != nil || rate.Sign() <= 0 {
+			l.errorf("invalid %s rate %q for %s, expected a decimal > 0", key, kv[1], kv[0])
+			continue
+		}
+		rates[kv[0]] = rate
+	}
+	return rates
+}
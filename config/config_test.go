@@ -0,0 +1,96 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setenv(t *testing.T, env map[string]string) {
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func unsetenv(env map[string]string) {
+	for k := range env {
+		os.Unsetenv(k)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(`{"JUSTIN_RESULTS_BATCH": "50", "JUSTIN_CHARITY": "1234"}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	env := map[string]string{
+		File:                   f.Name(),
+		DatabaseURL:            "postgres://localhost/jgforce",
+		JustinCharity:          "5678",
+		JustGivingPollInterval: "1m",
+		JobTimeouts:            "Heartbeat=1h",
+		CurrencyRates:          "USD=0.79, EUR=0.86",
+	}
+	setenv(t, env)
+	defer unsetenv(env)
+
+	cfg, err := Load(DatabaseURL, JustinResultsBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.JustinResultsBatch != 50 {
+		t.Errorf("expected results batch from the config file but have %d", cfg.JustinResultsBatch)
+	}
+	if cfg.JustinCharity != 5678 {
+		t.Errorf("expected charity from the env var (over the config file) but have %d", cfg.JustinCharity)
+	}
+	if cfg.JustGivingWorkers != 3 || cfg.JustGivingPollInterval != time.Minute {
+		t.Errorf("expected default workers and 1m poll interval but have %d %v", cfg.JustGivingWorkers, cfg.JustGivingPollInterval)
+	}
+	if cfg.JobTimeouts["Heartbeat"] != time.Hour {
+		t.Errorf("expected Heartbeat job timeout of 1h but have %v", cfg.JobTimeouts)
+	}
+	if cfg.SalesForceCurrency != "GBP" || len(cfg.CurrencyRates) != 2 || cfg.CurrencyRates["EUR"].String() != "0.86" {
+		t.Errorf("expected GBP and rates for USD and EUR but have %s %v", cfg.SalesForceCurrency, cfg.CurrencyRates)
+	}
+	if cfg.TeamDonationStats != "member" {
+		t.Errorf("expected member team donation stats by default but have %s", cfg.TeamDonationStats)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	env := map[string]string{
+		JustinResultsBatch: "none",
+		SalesForceWorkers:  "0",
+		ScheduleCatchUp:    "sometimes",
+		SalesForceCurrency: "pounds",
+		CurrencyRates:      "USD=0.79,EUR=-1",
+	}
+	setenv(t, env)
+	defer unsetenv(env)
+
+	_, err := Load(DatabaseURL, JustinAPIKey, JustinResultsBatch, WebAPIKey)
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected Errors but have %v", err)
+	}
+	for _, e := range []string{"missing DATABASE_URL", "missing JUSTIN_APIKEY", "missing WEB_API_KEY", "invalid JUSTIN_RESULTS_BATCH",
+		"invalid SALESFORCE_WORKERS", "invalid SCHEDULE_CATCHUP", "invalid SALESFORCE_CURRENCY", "invalid CURRENCY_RATES rate \"-1\" for EUR"} {
+		if !strings.Contains(errs.Error(), e) {
+			t.Errorf("expected %q in %v", e, errs)
+		}
+	}
+	if len(errs) != 8 {
+		t.Errorf("expected 8 errors but have %d %v", len(errs), errs)
+	}
+}
@@ -0,0 +1,49 @@
+package jgforce
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+// WatchContext bounds the queries run on conn by ctx, pgx doesn't support contexts so instead statement_timeout
+// is set from ctx's deadline (if it has one) and if ctx is done while a query is running it is cancelled
+// with pg_cancel_backend from a separate connection. The returned func stops the watch, call it before closing conn.
+func WatchContext(ctx context.Context, connCfg pgx.ConnConfig, conn *pgx.Conn) (func(), error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := int64(deadline.Sub(time.Now()) / time.Millisecond)
+		if ms < 1 {
+			return nil, context.DeadlineExceeded
+		}
+		if _, err := conn.Exec(fmt.Sprintf("SET statement_timeout = %d", ms)); err != nil {
+			return nil, fmt.Errorf("error setting statement_timeout %v", err)
+		}
+	}
+
+	pid := conn.Pid
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-ctx.Done():
+			if err := cancelBackend(connCfg, pid); err != nil {
+				log.Warnf("error cancelling query on backend %d %v", pid, err)
+			}
+		}
+	}()
+	return func() { close(stop) }, nil
+}
+
+// cancelBackend cancels the query (if any) running on the backend with the pid
+func cancelBackend(connCfg pgx.ConnConfig, pid int32) error {
+	conn, err := pgx.Connect(connCfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`SELECT pg_cancel_backend($1)`, pid)
+	return err
+}
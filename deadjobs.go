@@ -0,0 +1,166 @@
+package jgforce
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+// DefaultMaxAttempts is the number of times a job is worked before it is moved to the dead jobs table,
+// unless overridden for its type in MaxAttempts
+const DefaultMaxAttempts = 10
+
+// MaxAttempts per job type
+var MaxAttempts = map[string]int{
+	// the clock adds a fresh heartbeat every tick, so there is no point retrying a failed one
+	HeartbeatJob:          1,
+	SyncEventPagesJob:     10,
+	RefreshPageResultsJob: 10,
+	ResyncContactJob:      5,
+}
+
+// ErrDeadJobNotFound is returned when requeueing or purging a job which is not in the dead jobs table
+var ErrDeadJobNotFound = errors.New("dead job not found")
+
+// DeadJob is a job that exceeded its max attempts
+type DeadJob struct {
+	ID         int64     `json:"job_id"`
+	Queue      string    `json:"queue"`
+	Priority   int16     `json:"priority"`
+	RunAt      time.Time `json:"run_at"`
+	Type       string    `json:"job_class"`
+	Args       []byte    `json:"-"`
+	ErrorCount int32     `json:"error_count"`
+	LastError  *string   `json:"last_error,omitempty"`
+	DiedAt     time.Time `json:"died_at"`
+}
+
+// maxAttempts for the job type
+func maxAttempts(jobType string) int {
+	if m, ok := MaxAttempts[jobType]; ok && m > 0 {
+		return m
+	}
+	return DefaultMaxAttempts
+}
+
+// WithDeadLetter wraps each of the work funcs so that a job which fails on its final attempt
+// is moved to the dead jobs table rather than being retried by que. ctx is the worker's context (as given to WithTimeout),
+// a job which fails because it is cancelled on shutdown is never moved, que retries it once the worker is back up
+func WithDeadLetter(ctx context.Context, wm que.WorkMap) que.WorkMap {
+	wrapped := make(que.WorkMap, len(wm))
+	for jobType, wf := range wm {
+		wrapped[jobType] = deadLetter(ctx, wf)
+	}
+	return wrapped
+}
+
+func deadLetter(ctx context.Context, wf que.WorkFunc) que.WorkFunc {
+	return func(j *que.Job) error {
+		err := wf(j)
+		if err == nil {
+			return nil
+		}
+		// the job's error may wrap context.Canceled (or be whatever the job made of being cancelled mid query / api call)
+		// so it is the worker's context which tells us we are shutting down
+		if ctx.Err() == context.Canceled {
+			return err
+		}
+		attempts := int(j.ErrorCount) + 1
+		if attempts < maxAttempts(j.Type) {
+			return err
+		}
+		if derr := killJob(j, err.Error()); derr != nil {
+			// leave the job with que so it is retried rather than lost
+			return fmt.Errorf("%v (and failed to move job to que_dead_jobs after %d attempts %v)", err, attempts, derr)
+		}
+		// returning nil lets que delete the (already moved) job
+		return nil
+	}
+}
+
+// killJob moves the job from que_jobs to que_dead_jobs, it runs on the job's connection
+// (which holds the job's advisory lock)
+func killJob(j *que.Job, lastError string) error {
+	tx, err := j.Conn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO que_dead_jobs (job_id, queue, priority, run_at, job_class, args, error_count, last_error)
+ SELECT job_id, queue, priority, run_at, job_class, args, $2, $3 FROM que_jobs WHERE job_id = $1`, j.ID, j.ErrorCount+1, lastError)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM que_jobs WHERE job_id = $1`, j.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListDeadJobs returns the most recently killed jobs, optionally filtered by queue
+func ListDeadJobs(pool *pgx.ConnPool, queue string, limit int) ([]DeadJob, error) {
+	rows, err := pool.Query(`SELECT job_id, queue, priority, run_at, job_class, args, error_count, last_error, died_at FROM que_dead_jobs
+ WHERE ($1 = '' OR queue = $1) ORDER BY died_at DESC, job_id LIMIT $2`, queue, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying que_dead_jobs %v", err)
+	}
+	defer rows.Close()
+	var jobs []DeadJob
+	for rows.Next() {
+		var j DeadJob
+		if err = rows.Scan(&j.ID, &j.Queue, &j.Priority, &j.RunAt, &j.Type, &j.Args, &j.ErrorCount, &j.LastError, &j.DiedAt); err != nil {
+			return nil, fmt.Errorf("error reading from que_dead_jobs %v", err)
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// RequeueDeadJob moves the job back onto its queue, to run now with a clean error count
+func RequeueDeadJob(pool *pgx.ConnPool, id int64) error {
+	tx, err := pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ct, err := tx.Exec(`INSERT INTO que_jobs (queue, priority, job_class, args)
+ SELECT queue, priority, job_class, args FROM que_dead_jobs WHERE job_id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error requeueing dead job %d %v", id, err)
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrDeadJobNotFound
+	}
+	if _, err = tx.Exec(`DELETE FROM que_dead_jobs WHERE job_id = $1`, id); err != nil {
+		return fmt.Errorf("error deleting requeued dead job %d %v", id, err)
+	}
+	return tx.Commit()
+}
+
+// PurgeDeadJob deletes a single dead job
+func PurgeDeadJob(pool *pgx.ConnPool, id int64) error {
+	ct, err := pool.Exec(`DELETE FROM que_dead_jobs WHERE job_id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error purging dead job %d %v", id, err)
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrDeadJobNotFound
+	}
+	return nil
+}
+
+// PurgeDeadJobs deletes all dead jobs which died before the given time, returning the number purged
+func PurgeDeadJobs(pool *pgx.ConnPool, before time.Time) (int64, error) {
+	ct, err := pool.Exec(`DELETE FROM que_dead_jobs WHERE died_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("error purging dead jobs %v", err)
+	}
+	return ct.RowsAffected(), nil
+}
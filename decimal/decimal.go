@@ -0,0 +1,194 @@
+// Package decimal is an exact decimal number for amounts of money, so totals and the differences between them
+// are never out by a rounding error as they can be with float64. A Decimal is read from and written to postgres
+// NUMERIC columns (it is a database/sql Scanner and Valuer, which pgx uses with NUMERIC's text format).
+package decimal
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is the number coef * 10^-scale, the zero value is 0.
+// Decimals are values, the operations return a new Decimal and never change their operands.
+type Decimal struct {
+	coef  *big.Int
+	scale int32
+}
+
+var ten = big.NewInt(10)
+
+// New returns the Decimal value * 10^-scale e.g. New(1250, 2) is 12.50
+func New(value int64, scale int32) Decimal {
+	if scale < 0 {
+		return Decimal{coef: new(big.Int).Mul(big.NewInt(value), pow10(-scale))}
+	}
+	return Decimal{coef: big.NewInt(value), scale: scale}
+}
+
+// Parse a plain decimal number, with an optional sign and fraction e.g. "150.00" or "-12.5"
+// (exponents, separators and currency symbols aren't accepted)
+func Parse(s string) (Decimal, error) {
+	digits := s
+	if len(digits) > 0 && (digits[0] == '-' || digits[0] == '+') {
+		digits = digits[1:]
+	}
+	whole, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		whole, frac = digits[:i], digits[i+1:]
+	}
+	if whole == "" && frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	coef, ok := new(big.Int).SetString(s[:len(s)-len(digits)]+whole+frac, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	return Decimal{coef: coef, scale: int32(len(frac))}, nil
+}
+
+// MustParse is Parse for constants, it panics if s isn't a decimal
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(ten, big.NewInt(int64(n)), nil)
+}
+
+func (d Decimal) int() *big.Int {
+	if d.coef == nil {
+		return new(big.Int)
+	}
+	return d.coef
+}
+
+// rescale returns the coefficients of a and b at the larger of their scales
+func rescale(a Decimal, b Decimal) (*big.Int, *big.Int, int32) {
+	x, y := a.int(), b.int()
+	switch {
+	case a.scale < b.scale:
+		x = new(big.Int).Mul(x, pow10(b.scale-a.scale))
+		return x, y, b.scale
+	case b.scale < a.scale:
+		y = new(big.Int).Mul(y, pow10(a.scale-b.scale))
+	}
+	return x, y, a.scale
+}
+
+// Add returns d + other, at the larger of their scales
+func (d Decimal) Add(other Decimal) Decimal {
+	x, y, scale := rescale(d, other)
+	return Decimal{coef: new(big.Int).Add(x, y), scale: scale}
+}
+
+// Sub returns d - other, at the larger of their scales
+func (d Decimal) Sub(other Decimal) Decimal {
+	x, y, scale := rescale(d, other)
+	return Decimal{coef: new(big.Int).Sub(x, y), scale: scale}
+}
+
+// Mul returns d * other, at the sum of their scales (see Round)
+func (d Decimal) Mul(other Decimal) Decimal {
+	return Decimal{coef: new(big.Int).Mul(d.int(), other.int()), scale: d.scale + other.scale}
+}
+
+// Round d to places decimal places, halves are rounded away from zero (e.g. 2.345 is 2.35 and -2.345 is -2.35)
+func (d Decimal) Round(places int32) Decimal {
+	if d.scale <= places {
+		return Decimal{coef: new(big.Int).Mul(d.int(), pow10(places-d.scale)), scale: places}
+	}
+	div := pow10(d.scale - places)
+	q, r := new(big.Int).QuoRem(d.int(), div, new(big.Int))
+	// |r| * 2 >= div rounds away from zero
+	if new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(div) >= 0 {
+		q.Add(q, big.NewInt(int64(d.Sign())))
+	}
+	return Decimal{coef: q, scale: places}
+}
+
+// Cmp compares d and other, returning -1, 0 or +1 (the scale doesn't matter, 12.5 and 12.50 are equal)
+func (d Decimal) Cmp(other Decimal) int {
+	x, y, _ := rescale(d, other)
+	return x.Cmp(y)
+}
+
+// Equal reports whether d and other are the same number
+func (d Decimal) Equal(other Decimal) bool {
+	return d.Cmp(other) == 0
+}
+
+// Sign returns -1, 0 or +1
+func (d Decimal) Sign() int {
+	return d.int().Sign()
+}
+
+// IsZero reports whether d is 0
+func (d Decimal) IsZero() bool {
+	return d.Sign() == 0
+}
+
+// Float64 is the nearest float64 to d, for metrics and logs only
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// String formats d with its scale e.g. "150.00"
+func (d Decimal) String() string {
+	s := d.int().String()
+	if d.scale <= 0 {
+		return s
+	}
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	if n := int(d.scale) + 1 - len(s); n > 0 {
+		s = strings.Repeat("0", n) + s
+	}
+	return sign + s[:len(s)-int(d.scale)] + "." + s[len(s)-int(d.scale):]
+}
+
+// MarshalJSON implements json.Marshaler, d is written as a json number with its scale e.g. 150.00
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Scan implements sql.Scanner, NULL is 0
+func (d *Decimal) Scan(src interface{}) error {
+	var err error
+	switch src := src.(type) {
+	case nil:
+		*d = Decimal{}
+	case []byte:
+		*d, err = Parse(string(src))
+	case string:
+		*d, err = Parse(src)
+	case int64:
+		*d = New(src, 0)
+	default:
+		return fmt.Errorf("cannot scan %T into a decimal", src)
+	}
+	return err
+}
+
+// Value implements driver.Valuer, d is written as text so its parameter must be (or be cast to) NUMERIC
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
@@ -0,0 +1,82 @@
+package decimal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"150.00", "150.00"},
+		{"-12.5", "-12.5"},
+		{"+7", "7"},
+		{".05", "0.05"},
+		{"3.", "3"},
+		{"0.001", "0.001"},
+	}
+	for _, tt := range tests {
+		d, err := Parse(tt.s)
+		if err != nil {
+			t.Errorf("error parsing %q %v", tt.s, err)
+			continue
+		}
+		if d.String() != tt.want {
+			t.Errorf("expected %q to parse as %s but have %s", tt.s, tt.want, d)
+		}
+	}
+	for _, s := range []string{"", ".", "-", "1e5", "£10.00", "1,000.00", "1.2.3", " 1"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	// the sum a float64 gets wrong
+	if sum := MustParse("0.1").Add(MustParse("0.2")); !sum.Equal(MustParse("0.3")) || sum.String() != "0.3" {
+		t.Errorf("expected 0.1 + 0.2 to be 0.3 but have %s", sum)
+	}
+	if diff := MustParse("150.00").Sub(MustParse("100.005")); diff.String() != "49.995" {
+		t.Errorf("expected 49.995 but have %s", diff)
+	}
+	if diff := MustParse("12.5").Sub(MustParse("12.50")); !diff.IsZero() {
+		t.Errorf("expected 12.5 and 12.50 to be equal but the difference is %s", diff)
+	}
+	if neg := New(5, 2).Sub(MustParse("1")); neg.String() != "-0.95" || neg.Sign() != -1 {
+		t.Errorf("expected -0.95 but have %s", neg)
+	}
+	if product := MustParse("123.45").Mul(MustParse("0.79")); product.String() != "97.5255" || product.Round(2).String() != "97.53" {
+		t.Errorf("expected 97.5255 (97.53 rounded) but have %s", product)
+	}
+	for s, want := range map[string]string{"2.345": "2.35", "-2.345": "-2.35", "2.344": "2.34", "7": "7.00", "-0.004": "0.00"} {
+		if r := MustParse(s).Round(2); r.String() != want {
+			t.Errorf("expected %s to round to %s but have %s", s, want, r)
+		}
+	}
+	var zero Decimal
+	if zero.String() != "0" || !zero.Add(New(25, 1)).Equal(MustParse("2.5")) {
+		t.Errorf("expected the zero value to be 0")
+	}
+}
+
+func TestScan(t *testing.T) {
+	var d Decimal
+	if err := d.Scan([]byte("37.50")); err != nil || d.String() != "37.50" {
+		t.Errorf("expected 37.50 but have %s %v", d, err)
+	}
+	if err := d.Scan(nil); err != nil || !d.IsZero() {
+		t.Errorf("expected NULL to scan as 0 but have %s %v", d, err)
+	}
+	if err := d.Scan(1.5); err == nil {
+		t.Error("expected an error scanning a float64")
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(map[string]Decimal{"raised": MustParse("0.10"), "zero": {}})
+	if err != nil || string(b) != `{"raised":0.10,"zero":0}` {
+		t.Errorf("expected exact json numbers but have %s %v", b, err)
+	}
+}
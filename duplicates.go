@@ -0,0 +1,42 @@
+package jgforce
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx"
+
+	"github.com/homemade/jgforce/decimal"
+)
+
+// DonationStatsDuplicate is a set of salesforce.donation_stats__c records for the same page and day
+// (or page master records), which double count the money raised in salesforce
+type DonationStatsDuplicate struct {
+	Key    string `json:"key"`
+	PageID string `json:"page_id"`
+
+	// Records is the number of records, IDs their ids (comma separated)
+	Records int64  `json:"records"`
+	IDs     string `json:"ids"`
+
+	// ExcessRaised is the amount raised double counted by every record but the first
+	ExcessRaised decimal.Decimal `json:"excess_raised"`
+}
+
+// DonationStatsDuplicates returns the duplicated donation stats records, from the jgforce.donation_stats_duplicates view
+func DonationStatsDuplicates(pool *pgx.ConnPool, limit int) ([]DonationStatsDuplicate, error) {
+	rows, err := pool.Query(`SELECT key, page_id, records, ids, excess_raised::numeric FROM jgforce.donation_stats_duplicates
+ ORDER BY excess_raised DESC, key LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying jgforce.donation_stats_duplicates %v", err)
+	}
+	defer rows.Close()
+	var dups []DonationStatsDuplicate
+	for rows.Next() {
+		var d DonationStatsDuplicate
+		if err = rows.Scan(&d.Key, &d.PageID, &d.Records, &d.IDs, &d.ExcessRaised); err != nil {
+			return nil, fmt.Errorf("error reading from jgforce.donation_stats_duplicates %v", err)
+		}
+		dups = append(dups, d)
+	}
+	return dups, rows.Err()
+}
@@ -0,0 +1,436 @@
+package jgforce_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce"
+	"github.com/homemade/jgforce/cmd/worker/justgiving"
+	"github.com/homemade/jgforce/cmd/worker/justgiving/jgtest"
+	"github.com/homemade/jgforce/cmd/worker/salesforce"
+	"github.com/homemade/jgforce/cmd/worker/store"
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/jgforce/decimal"
+	"github.com/homemade/jgforce/migrations"
+	justin_models "github.com/homemade/justin/models"
+)
+
+// resetSQL drops everything the migrations create (and the heroku connect tables) so each run starts from scratch
+const resetSQL = `
+DROP SCHEMA IF EXISTS justgiving CASCADE;
+DROP SCHEMA IF EXISTS salesforce CASCADE;
+DROP SCHEMA IF EXISTS jgforce CASCADE;
+DROP TABLE IF EXISTS schema_migrations, que_jobs, que_dead_jobs, clock_schedule_state CASCADE;
+DROP FUNCTION IF EXISTS que_jobs_notify() CASCADE;`
+
+// herokuConnectSQL creates the salesforce tables heroku connect syncs (just the columns we use),
+// they are created before migrating so the salesforce views are too
+const herokuConnectSQL = `
+CREATE SCHEMA salesforce;
+
+CREATE TABLE salesforce.contact(
+	id                           SERIAL,
+	sfid                         VARCHAR(18),
+	systemmodstamp               TIMESTAMP,
+	email                        VARCHAR(80),
+	fundraiser_jg_email__c       VARCHAR(80),
+	jg_charity_id__c             VARCHAR(10),
+	event_id__c                  VARCHAR(10),
+	fundraising_page_id__c       VARCHAR(10),
+	fundraising_page_url__c      VARCHAR(255),
+	fundraising_team_page_url__c VARCHAR(255),
+	PRIMARY KEY (id)
+);
+
+CREATE TABLE salesforce.donation_stats__c(
+	id                            SERIAL,
+	sfid                          VARCHAR(18),
+	name                          VARCHAR(80),
+	createddate                   TIMESTAMP,
+	related_contact_record__c     VARCHAR(18),
+	fundraising_page_id__c        VARCHAR(10),
+	fundraising_page_url__c       VARCHAR(255),
+	fundraising_portal_used__c    VARCHAR(255),
+	event_id__c                   VARCHAR(10),
+	event_name__c                 VARCHAR(255),
+	jg_charity_id__c              VARCHAR(10),
+	donation_date__c              TIMESTAMP,
+	transaction_date__c           TIMESTAMP,
+	initial_raised_online__c      DOUBLE PRECISION,
+	initial_raised_sms__c         DOUBLE PRECISION,
+	initial_raised_offline__c     DOUBLE PRECISION,
+	intial_estimated_gift_aid__c  DOUBLE PRECISION,
+	initial_pledge_amount__c      DOUBLE PRECISION,
+	raised_online_incremental__c  DOUBLE PRECISION,
+	raised_sms_incremental__c     DOUBLE PRECISION,
+	raised_offline_incremental__c DOUBLE PRECISION,
+	estimated_gift_aid__c         DOUBLE PRECISION,
+	pledge_amount_revised__c      DOUBLE PRECISION,
+	PRIMARY KEY (id)
+);`
+
+// TestEndToEnd runs both workers against the fake justgiving api and the (throwaway) database at TEST_DATABASE_URL,
+// which is reset by the test
+func TestEndToEnd(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	fixtures, err := jgtest.ReadFixtures("testdata/justgiving.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := jgtest.NewServer(fixtures)
+	defer srv.Close()
+	srv.PageSize = 2
+
+	cfg := &config.Config{
+		DatabaseURL:        dbURL,
+		JustinAPIKey:       "test",
+		JustinBaseURL:      srv.URL,
+		JustinCharity:      1000,
+		JustinResultsBatch: 10,
+		SalesForceCurrency: "GBP",
+		CurrencyRates:      map[string]decimal.Decimal{"EUR": decimal.MustParse("0.86")},
+	}
+	jg, err := justgiving.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connect(t, dbURL)
+	defer conn.Close()
+	exec(t, conn, resetSQL)
+	exec(t, conn, herokuConnectSQL)
+	if err = migrations.Migrate(dbURL); err != nil {
+		t.Fatal(err)
+	}
+	pgxpool, qc, err := jgforce.Setup(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgxpool.Close()
+
+	ctx := context.Background()
+	work := func(queue string, jm jgforce.JobMap) {
+		w := que.NewWorker(qc, jgforce.WithTimeout(ctx, jm))
+		w.Queue = queue
+		for w.WorkOne() {
+		}
+	}
+	jgJobs := jgforce.JobMap{
+		jgforce.HeartbeatJob: func(ctx context.Context, j *que.Job) error {
+			return justgiving.HeartBeat(ctx, cfg, qc)
+		},
+		jgforce.SyncEventPagesJob: func(ctx context.Context, j *que.Job) error {
+			var args jgforce.SyncEventPagesArgs
+			if err := json.Unmarshal(j.Args, &args); err != nil {
+				return err
+			}
+			return justgiving.SyncEventPages(ctx, cfg, jg, args.EventID)
+		},
+		jgforce.RefreshPageResultsJob: func(ctx context.Context, j *que.Job) error {
+			var args jgforce.RefreshPageResultsArgs
+			if err := json.Unmarshal(j.Args, &args); err != nil {
+				return err
+			}
+			return justgiving.RefreshPageResults(ctx, cfg, jg, args.PageID)
+		},
+	}
+
+	// the justgiving worker syncs the pages of the events we track (only 2000 to begin with)...
+	exec(t, conn, `INSERT INTO justgiving.event (charity_id, event_id, name) VALUES (1000, 2000, 'Royal Parks Half Marathon')`)
+	enqueue(t, qc, jgforce.JustGivingQueue, jgforce.HeartbeatJob, nil)
+	work(jgforce.JustGivingQueue, jgJobs)
+	if n := count(t, conn, `SELECT count(*) FROM justgiving.page`); n != 3 {
+		t.Fatalf("expected the 3 pages of event 2000 to be synced but have %d", n)
+	}
+	if n := srv.Requests("FundraisingPagesForEvent"); n != 2 {
+		t.Errorf("expected the event's pages to be fetched over 2 requests but have %d", n)
+	}
+
+	// ...and then refreshes their results, cancelled pages are given priority 0
+	enqueue(t, qc, jgforce.JustGivingQueue, jgforce.HeartbeatJob, nil)
+	work(jgforce.JustGivingQueue, jgJobs)
+	if n := count(t, conn, `SELECT count(*) FROM justgiving.fundraising_result WHERE page_id IN (1, 2)`); n != 4 {
+		t.Errorf("expected initial and daily results for pages 1 and 2 but have %d results", n)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM justgiving.page_priority WHERE page_id = 3 AND priority = 0`); n != 1 {
+		t.Errorf("expected cancelled page 3 to have priority 0")
+	}
+	if n := count(t, conn, `SELECT count(*) FROM justgiving.event_page_fundraising_result WHERE page_id = 1
+ AND raised_online = 100.00 AND estimated_gift_aid = 25.00 AND target_amount = 500.00 AND currency_code = 'GBP'`); n != 2 {
+		t.Errorf("expected exact amounts in pounds in the results for page 1 but have %d results", n)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM justgiving.fundraising_result WHERE page_id = 2 AND currency_code = 'EUR'`); n != 2 {
+		t.Errorf("expected the results for page 2 to be in euros but have %d results", n)
+	}
+
+	// an amount which isn't a decimal is saved as NULL (0 in the view) and flagged with its original value
+	srv.SetResults("bob-runs", justin_models.FundraisingResults{Target: "250.00", TotalRaisedPercentageOfTarget: "40",
+		TotalRaisedOffline: "50.00", TotalRaisedOnline: "50.00", TotalRaisedSMS: "n/a", TotalEstimatedGiftAid: "12.50"}, false)
+	if err = justgiving.RefreshPageResults(ctx, cfg, jg, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM justgiving.fundraising_result WHERE page_id = 2 AND year > 0
+ AND total_raised_sms IS NULL AND unparsed_amounts->>'total_raised_sms' = 'n/a' AND total_raised_online = 50`); n != 1 {
+		t.Errorf("expected page 2's sms amount to be flagged")
+	}
+
+	// the salesforce worker matches contacts by page id and by email, creating a donation stats master record for each
+	exec(t, conn, `INSERT INTO salesforce.contact (sfid, systemmodstamp, email, fundraising_page_id__c) VALUES
+ ('003000000000001', now(), 'alice@example.com', '1'),
+ ('003000000000002', now(), 'bob@example.com', NULL)`)
+	if err = salesforce.HeartBeat(ctx, cfg, jg); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM salesforce.donation_stats__c WHERE transaction_date__c IS NULL
+ AND ((related_contact_record__c = '003000000000001' AND fundraising_page_id__c = '1' AND initial_raised_online__c = 100)
+ OR (related_contact_record__c = '003000000000002' AND fundraising_page_id__c = '2' AND initial_raised_offline__c = 43))`); n != 2 {
+		t.Errorf("expected master records for alice and bob (converted from euros) but have %d", n)
+	}
+
+	// once alice raises more the salesforce worker adds a detail record with the difference
+	srv.SetResults("alice-runs", justin_models.FundraisingResults{Target: "500.00", TotalRaisedPercentageOfTarget: "30",
+		TotalRaisedOffline: "0.00", TotalRaisedOnline: "150.00", TotalRaisedSMS: "0.00", TotalEstimatedGiftAid: "37.50"}, false)
+	if err = justgiving.RefreshPageResults(ctx, cfg, jg, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = salesforce.HeartBeat(ctx, cfg, jg); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM salesforce.donation_stats__c WHERE fundraising_page_id__c = '1'
+ AND transaction_date__c IS NOT NULL AND raised_online_incremental__c = 50 AND estimated_gift_aid__c = 12.5`); n != 1 {
+		t.Errorf("expected a detail record for alice's extra 50 but have %d", n)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM salesforce.donation_stats__c WHERE fundraising_page_id__c = '2' AND transaction_date__c IS NOT NULL`); n != 0 {
+		t.Errorf("expected no detail records for bob (who hasn't raised more) but have %d", n)
+	}
+
+	// running the salesforce worker again (as a retried job would) records nothing twice
+	if err = salesforce.HeartBeat(ctx, cfg, jg); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM salesforce.donation_stats__c`); n != 3 {
+		t.Errorf("expected 2 master records and a detail record but have %d records", n)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM jgforce.donation_stats_duplicates`); n != 0 {
+		t.Errorf("expected no duplicates but have %d", n)
+	}
+}
+
+// TestShutdown cancels a heartbeat mid-run as the worker does on SIGTERM, the heartbeat has just the one attempt
+// but is left for que to retry rather than moved to que_dead_jobs
+func TestShutdown(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	conn := connect(t, dbURL)
+	defer conn.Close()
+	exec(t, conn, resetSQL)
+	if err := migrations.Migrate(dbURL); err != nil {
+		t.Fatal(err)
+	}
+	pgxpool, qc, err := jgforce.Setup(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgxpool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	w := que.NewWorker(qc, jgforce.WithDeadLetter(ctx, jgforce.WithTimeout(ctx, jgforce.JobMap{
+		jgforce.HeartbeatJob: func(ctx context.Context, j *que.Job) error {
+			close(started)
+			<-ctx.Done()
+			return fmt.Errorf("error querying justgiving.event %v", ctx.Err())
+		},
+	})))
+	w.Queue = jgforce.JustGivingQueue
+
+	enqueue(t, qc, jgforce.JustGivingQueue, jgforce.HeartbeatJob, nil)
+	done := make(chan bool)
+	go func() { done <- w.WorkOne() }()
+	<-started
+	cancel()
+	if !<-done {
+		t.Fatal("expected the heartbeat to be worked")
+	}
+	if n := count(t, conn, `SELECT count(*) FROM que_jobs WHERE job_class = 'Heartbeat' AND error_count = 1`); n != 1 {
+		t.Errorf("expected the cancelled heartbeat to be left in que_jobs to be retried but have %d", n)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM que_dead_jobs`); n != 0 {
+		t.Errorf("expected no dead jobs but have %d", n)
+	}
+}
+
+// TestEnqueueUnique replaces a waiting heartbeat but never one a worker holds the lock on
+func TestEnqueueUnique(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	conn := connect(t, dbURL)
+	defer conn.Close()
+	exec(t, conn, resetSQL)
+	if err := migrations.Migrate(dbURL); err != nil {
+		t.Fatal(err)
+	}
+	pgxpool, qc, err := jgforce.Setup(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgxpool.Close()
+
+	heartbeat := func() bool {
+		added, err := jgforce.EnqueueUnique(pgxpool, qc, &que.Job{Queue: jgforce.JustGivingQueue, Type: jgforce.HeartbeatJob}, jgforce.ReplaceDuplicate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return added
+	}
+	jobID := func() int64 {
+		var id int64
+		if err := conn.QueryRow(`SELECT job_id FROM que_jobs WHERE job_class = 'Heartbeat'`).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	if !heartbeat() || !heartbeat() {
+		t.Fatal("expected the waiting heartbeat to be replaced")
+	}
+	if n := count(t, conn, `SELECT count(*) FROM que_jobs`); n != 1 {
+		t.Errorf("expected a single heartbeat but have %d", n)
+	}
+
+	// a worker takes the heartbeat (que locks the job id for as long as it works the job)
+	id := jobID()
+	worker := connect(t, dbURL)
+	defer worker.Close()
+	if _, err = worker.Exec(`SELECT pg_advisory_lock($1)`, id); err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat() {
+		t.Error("expected the enqueue to be skipped while the heartbeat is being worked")
+	}
+	if n := count(t, conn, `SELECT count(*) FROM que_jobs`); n != 1 || jobID() != id {
+		t.Errorf("expected the heartbeat being worked to be left alone but have %d jobs", n)
+	}
+}
+
+// TestDonationStatsKeys rekeys a record keyed by migration 8 from its transaction date as the worker keys it
+// (by the day of its result), and restores the keys after heroku connect remaps salesforce.donation_stats__c
+func TestDonationStatsKeys(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	conn := connect(t, dbURL)
+	defer conn.Close()
+	exec(t, conn, resetSQL)
+	exec(t, conn, herokuConnectSQL)
+	if err := migrations.Migrate(dbURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// page 1's result for 1 October was last updated just after midnight, and the detail record made from it was keyed
+	// by migration 8 with the day of its transaction date (the result's updated timestamp, to the millisecond in salesforce)
+	exec(t, conn, `INSERT INTO justgiving.fundraising_result (page_id, year, month, day, target, total_raised_percentage_of_target,
+ total_raised_offline, total_raised_online, total_raised_sms, total_estimated_gift_aid, updated_timestamp)
+ VALUES (1, 2016, 10, 1, 0, 0, 0, 10, 0, 0, '2016-10-02 00:30:00.123456')`)
+	exec(t, conn, `INSERT INTO salesforce.donation_stats__c (jgforce_key__c, fundraising_page_id__c, transaction_date__c, raised_online_incremental__c)
+ VALUES ('1:2016-10-02', '1', '2016-10-02 00:30:00.123', 10)`)
+	exec(t, conn, `INSERT INTO salesforce.donation_stats__c (jgforce_key__c, fundraising_page_id__c, related_contact_record__c, initial_raised_online__c)
+ VALUES ('T3000:003000000000003:initial', 'T3000', '003000000000003', 200)`)
+	if err := migrations.Rekey(conn); err != nil {
+		t.Fatal(err)
+	}
+	dayKey := store.DetailKey("1", "", 2016, 10, 1)
+	keys := fmt.Sprintf(`SELECT count(*) FROM salesforce.donation_stats__c WHERE jgforce_key__c IN ('%s', '%s')`,
+		dayKey, store.MasterKey("T3000", "003000000000003"))
+	if n := count(t, conn, keys); n != 2 {
+		t.Fatalf("expected the detail record to be rekeyed as %s but have %d records keyed as the worker keys them", dayKey, n)
+	}
+
+	// so the worker's next save of the day updates the record rather than adding a second one
+	st := store.NewPostgres(conn)
+	detail := store.DonationStatsDetail{Key: dayKey, PageID: "1", Date: time.Date(2016, time.October, 2, 1, 0, 0, 0, time.UTC),
+		RaisedOnline: decimal.MustParse("15.00")}
+	if err := st.SaveDonationStatsDetail(detail); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM salesforce.donation_stats__c WHERE fundraising_page_id__c = '1'`); n != 1 {
+		t.Errorf("expected a single detail record for the day but have %d", n)
+	}
+
+	// heroku connect remaps the table, dropping the unmapped key column (and so its index and our views), donation stats
+	// can't be saved until the keys are restored rather than being saved without them
+	exec(t, conn, `ALTER TABLE salesforce.donation_stats__c DROP COLUMN jgforce_key__c CASCADE`)
+	if err := st.SaveDonationStatsDetail(detail); err == nil {
+		t.Error("expected saving donation stats without the key to fail")
+	}
+	if err := migrations.Rekey(conn); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, conn, keys); n != 2 {
+		t.Errorf("expected the keys to be restored but have %d records keyed as the worker keys them", n)
+	}
+	if err := st.SaveDonationStatsDetail(detail); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM salesforce.donation_stats__c`); n != 2 {
+		t.Errorf("expected no new records but have %d", n)
+	}
+	if n := count(t, conn, `SELECT count(*) FROM jgforce.donation_stats_duplicates`); n != 0 {
+		t.Errorf("expected no duplicates but have %d", n)
+	}
+}
+
+func connect(t *testing.T, dbURL string) *pgx.Conn {
+	connCfg, err := pgx.ParseURI(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pgx.Connect(connCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func exec(t *testing.T, conn *pgx.Conn, sql string) {
+	if _, err := conn.Exec(sql); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func count(t *testing.T, conn *pgx.Conn, sql string) int {
+	var n int64
+	if err := conn.QueryRow(sql).Scan(&n); err != nil {
+		t.Fatalf("%v running %s", err, sql)
+	}
+	return int(n)
+}
+
+func enqueue(t *testing.T, qc *que.Client, queue string, jobType string, args interface{}) {
+	if args == nil {
+		args = struct{}{}
+	}
+	if err := jgforce.Enqueue(qc, queue, jobType, args); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,63 @@
+package jgforce
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+
+	"github.com/homemade/jgforce/metrics"
+)
+
+var (
+	jobsWorked  = metrics.NewCounter("jgforce_jobs_worked_total", "Jobs worked, by queue and type.", "queue", "type")
+	jobsFailed  = metrics.NewCounter("jgforce_jobs_failed_total", "Jobs which returned an error, by queue and type.", "queue", "type")
+	jobDuration = metrics.NewHistogram("jgforce_job_duration_seconds", "Time taken to work a job (including heartbeats), by queue and type.",
+		metrics.DefBuckets, "queue", "type")
+	queueDepth = metrics.NewGauge("jgforce_que_jobs", "Jobs on the queue (including those waiting to retry), by queue.", "queue")
+)
+
+// WithMetrics wraps each of the work funcs so that the jobs worked, failed and their durations are recorded
+func WithMetrics(wm que.WorkMap) que.WorkMap {
+	wrapped := make(que.WorkMap, len(wm))
+	for jobType, wf := range wm {
+		wrapped[jobType] = instrument(wf)
+	}
+	return wrapped
+}
+
+func instrument(wf que.WorkFunc) que.WorkFunc {
+	return func(j *que.Job) error {
+		stopwatch := time.Now()
+		err := wf(j)
+		jobDuration.Observe(time.Since(stopwatch).Seconds(), j.Queue, j.Type)
+		jobsWorked.Inc(j.Queue, j.Type)
+		if err != nil {
+			jobsFailed.Inc(j.Queue, j.Type)
+		}
+		return err
+	}
+}
+
+// CollectQueueDepth sets the queue depth gauge from que_jobs whenever the metrics are scraped
+func CollectQueueDepth(pool *pgx.ConnPool) {
+	metrics.OnScrape(func() {
+		rows, err := pool.Query(`SELECT queue, count(*) FROM que_jobs GROUP BY queue`)
+		if err != nil {
+			log.Errorf("error querying que_jobs depth %v", err)
+			return
+		}
+		defer rows.Close()
+		queueDepth.Reset()
+		for rows.Next() {
+			var queue string
+			var depth int64
+			if err = rows.Scan(&queue, &depth); err != nil {
+				log.Errorf("error reading que_jobs depth %v", err)
+				return
+			}
+			queueDepth.Set(float64(depth), queue)
+		}
+	})
+}
@@ -1,6 +1,9 @@
 package jgforce
 
 import (
+	"encoding/json"
+	"errors"
+
 	que "github.com/bgentry/que-go"
 	"github.com/jackc/pgx"
 )
@@ -10,47 +13,83 @@ const (
 	// HeartbeatJob queue name
 	HeartbeatJob = "Heartbeat"
 
+	// SyncEventPagesJob fetches the fundraising pages for a single event (args are SyncEventPagesArgs)
+	SyncEventPagesJob = "SyncEventPages"
+
+	// RefreshPageResultsJob refreshes the fundraising results for a single page (args are RefreshPageResultsArgs)
+	RefreshPageResultsJob = "RefreshPageResults"
+
+	// ResyncContactJob re-runs the page search and donation stats sync for a single salesforce contact (args are ResyncContactArgs)
+	ResyncContactJob = "ResyncContact"
+
 	JustGivingQueue = "JustGiving"
 
 	SalesForceQueue = "SalesForce"
+)
 
-	QueTableSQL = `
-		CREATE TABLE IF NOT EXISTS que_jobs
-		(
-			priority    smallint    NOT NULL DEFAULT 100,
-			run_at      timestamptz NOT NULL DEFAULT now(),
-			job_id      bigserial   NOT NULL,
-			job_class   text        NOT NULL,
-			args        json        NOT NULL DEFAULT '[]'::json,
-			error_count integer     NOT NULL DEFAULT 0,
-			last_error  text,
-			queue       text        NOT NULL DEFAULT '',
-
-			CONSTRAINT que_jobs_pkey PRIMARY KEY (queue, priority, run_at, job_id)
-		);` // QueTableSQL to create table idempotently
+// advisory lock classes, used with the two key form of the postgres advisory lock functions
+// so they never clash with que's single key job locks
+const (
+	uniqueLockClass = 1
+	leaderLockClass = 2
 )
 
-// prepQue ensures that the que table exists and que's prepared statements are
-// run. It is meant to be used in a pgx.ConnPool's AfterConnect hook.
-func prepQue(conn *pgx.Conn) error {
-	_, err := conn.Exec(QueTableSQL)
+// SyncEventPagesArgs are the json args of a SyncEventPagesJob
+type SyncEventPagesArgs struct {
+	EventID uint `json:"event_id"`
+}
+
+// RefreshPageResultsArgs are the json args of a RefreshPageResultsJob
+type RefreshPageResultsArgs struct {
+	PageID uint `json:"page_id"`
+}
+
+// ResyncContactArgs are the json args of a ResyncContactJob
+type ResyncContactArgs struct {
+	ContactID string `json:"contact_id"`
+}
+
+// Enqueue a job of the given type onto the queue, the args are encoded as json
+func Enqueue(qc *que.Client, queue string, jobType string, args interface{}) error {
+	b, err := json.Marshal(args)
 	if err != nil {
 		return err
 	}
+	return qc.Enqueue(&que.Job{
+		Queue: queue,
+		Type:  jobType,
+		Args:  b,
+	})
+}
+
+// ErrNotMigrated is returned by Setup when the database hasn't been migrated (so que_jobs is missing),
+// only the worker migrates at startup so the other processes need the migrate command to have been run first
+var ErrNotMigrated = errors.New("que_jobs doesn't exist, run migrate (or start the worker) first")
 
+// prepQue ensures que's prepared statements are run, the tables they use are created by the migrations package.
+// It is meant to be used in a pgx.ConnPool's AfterConnect hook.
+func prepQue(conn *pgx.Conn) error {
+	var exists bool
+	if err := conn.QueryRow(`SELECT to_regclass('que_jobs') IS NOT NULL`).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotMigrated
+	}
 	return que.PrepareStatements(conn)
 }
 
-// GetPgxPool based on the provided database URL
-func GetPgxPool(dbURL string) (*pgx.ConnPool, error) {
+// GetPgxPool based on the provided database URL, maxConnections of 0 uses the pgx default (5)
+func GetPgxPool(dbURL string, maxConnections int) (*pgx.ConnPool, error) {
 	pgxcfg, err := pgx.ParseURI(dbURL)
 	if err != nil {
 		return nil, err
 	}
 
 	pgxpool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
-		ConnConfig:   pgxcfg,
-		AfterConnect: prepQue,
+		ConnConfig:     pgxcfg,
+		MaxConnections: maxConnections,
+		AfterConnect:   prepQue,
 	})
 
 	if err != nil {
@@ -64,7 +103,13 @@ func GetPgxPool(dbURL string) (*pgx.ConnPool, error) {
 // This is here so that setup routines can easily be shared between web and
 // workers
 func Setup(dbURL string) (*pgx.ConnPool, *que.Client, error) {
-	pgxpool, err := GetPgxPool(dbURL)
+	return SetupWithMaxConnections(dbURL, 0)
+}
+
+// SetupWithMaxConnections is Setup with a limit on the pool's connections (0 uses the pgx default of 5),
+// a worker holds a connection for each job it is working so needs at least one per go routine
+func SetupWithMaxConnections(dbURL string, maxConnections int) (*pgx.ConnPool, *que.Client, error) {
+	pgxpool, err := GetPgxPool(dbURL, maxConnections)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1,21 +1,47 @@
-package jgforce
+package jgforce_test
 
 import (
 	"testing"
 
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce"
 	"github.com/homemade/jgforce/cmd/worker/justgiving"
 	"github.com/homemade/jgforce/cmd/worker/salesforce"
+	"github.com/homemade/jgforce/config"
+	"github.com/homemade/jgforce/migrations"
 )
 
 func TestJustGiving(t *testing.T) {
-	err := justgiving.HeartBeat()
+	cfg, err := config.Load(config.DatabaseURL, config.JustinResultsBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrations.Migrate(cfg.DatabaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgxpool, qc, err := jgforce.Setup(cfg.DatabaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgxpool.Close()
+	err = justgiving.HeartBeat(context.Background(), cfg, qc)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
 func TestSalesForce(t *testing.T) {
-	err := salesforce.HeartBeat()
+	cfg, err := config.Load(config.DatabaseURL, config.JustinAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jg, err := justgiving.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = salesforce.HeartBeat(context.Background(), cfg, jg)
 	if err != nil {
 		t.Error(err)
 	}
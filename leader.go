@@ -0,0 +1,99 @@
+package jgforce
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx"
+)
+
+// Leader elects a single leader amongst processes sharing a database, using a session level postgres advisory lock.
+// The lock is held on a connection taken from the pool for as long as we are the leader, so if the leader dies
+// (or loses its connection) the lock is released and another process can take over on its next call to Elect.
+type Leader struct {
+	// Name identifies the lock, processes using the same name compete for leadership
+	Name string
+
+	pool     *pgx.ConnPool
+	mu       sync.Mutex
+	conn     *pgx.Conn
+	resigned bool
+}
+
+// NewLeader for the named lock, no attempt is made to take the lock until Elect is called
+func NewLeader(pool *pgx.ConnPool, name string) *Leader {
+	return &Leader{Name: name, pool: pool}
+}
+
+// Elect tries to take the lock if we don't already hold it, or checks the connection holding it is still alive if we do.
+// It returns true while we are the leader.
+func (l *Leader) Elect() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.resigned {
+		return false, nil
+	}
+
+	if l.conn != nil {
+		var ok bool
+		if err := l.conn.QueryRow(`SELECT true`).Scan(&ok); err != nil {
+			l.drop()
+			return false, fmt.Errorf("lost leadership of %s %v", l.Name, err)
+		}
+		return true, nil
+	}
+
+	conn, err := l.pool.Acquire()
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	if err = conn.QueryRow(`SELECT pg_try_advisory_lock($1, hashtext($2))`, leaderLockClass, l.Name).Scan(&locked); err != nil {
+		l.pool.Release(conn)
+		return false, fmt.Errorf("error trying to take leadership of %s %v", l.Name, err)
+	}
+	if !locked {
+		l.pool.Release(conn)
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+// IsLeader returns true if we held the lock at the last call to Elect
+func (l *Leader) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn != nil
+}
+
+// Resign gives up the lock (if held) and returns its connection to the pool,
+// once resigned we never try to take the lock again
+func (l *Leader) Resign() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.resigned = true
+
+	if l.conn == nil {
+		return nil
+	}
+	var unlocked bool
+	err := l.conn.QueryRow(`SELECT pg_advisory_unlock($1, hashtext($2))`, leaderLockClass, l.Name).Scan(&unlocked)
+	if err != nil {
+		l.drop()
+		return fmt.Errorf("error resigning leadership of %s %v", l.Name, err)
+	}
+	l.pool.Release(l.conn)
+	l.conn = nil
+	return nil
+}
+
+// drop closes the connection holding the lock (which releases the lock if the connection is still alive),
+// closed connections are discarded by the pool on release
+func (l *Leader) drop() {
+	l.conn.Close()
+	l.pool.Release(l.conn)
+	l.conn = nil
+}
@@ -0,0 +1,309 @@
+// Package metrics exposes counters, gauges and histograms in the prometheus text format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/) on a /metrics endpoint
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefBuckets are the default histogram buckets (in seconds), they range from 5ms to 30m to cover
+// everything from a single api call to a full heartbeat
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics  map[string]metric
+	onScrape []func()
+}{metrics: make(map[string]metric)}
+
+func register(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.metrics[m.name()]; ok {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	registry.metrics[m.name()] = m
+}
+
+// OnScrape registers f to be called before the metrics are written, e.g. to set a gauge from a database query
+func OnScrape(f func()) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.onScrape = append(registry.onScrape, f)
+}
+
+// vec holds the values of a metric for each combination of its label values
+type vec struct {
+	metricName string
+	help       string
+	labels     []string
+	mu         sync.Mutex
+	keys       map[string][]string // joined label values to label values
+}
+
+func newVec(name string, help string, labels []string) vec {
+	return vec{metricName: name, help: help, labels: labels, keys: make(map[string][]string)}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// key for the label values (call with v.mu held)
+func (v *vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values but has %d", v.metricName, len(v.labels), len(labelValues)))
+	}
+	k := strings.Join(labelValues, "\xff")
+	if _, ok := v.keys[k]; !ok {
+		v.keys[k] = append([]string(nil), labelValues...)
+	}
+	return k
+}
+
+// sortedKeys (call with v.mu held)
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.keys))
+	for k := range v.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, escape(v.help, false), v.metricName, typ)
+}
+
+// labelPairs formats the labels e.g. {queue="JustGiving",type="Heartbeat"}, extra is appended as is
+func (v *vec) labelPairs(labelValues []string, extra string) string {
+	var pairs []string
+	for i, l := range v.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escape(labelValues[i], true)))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter only goes up, e.g. the number of jobs worked
+type Counter struct {
+	vec
+	values map[string]float64
+}
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, labels), values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[c.key(nil)] = 0
+	}
+	register(c)
+	return c
+}
+
+// Inc adds 1 to the counter with the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add v (which must not be negative) to the counter with the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counters can't go down")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(labelValues)] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelPairs(c.keys[k], ""), formatFloat(c.values[k]))
+	}
+}
+
+// Gauge can go up and down, e.g. the number of jobs on a queue
+type Gauge struct {
+	vec
+	values map[string]float64
+}
+
+// NewGauge registers a gauge with the given label names
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, labels), values: make(map[string]float64)}
+	if len(labels) == 0 {
+		g.values[g.key(nil)] = 0
+	}
+	register(g)
+	return g
+}
+
+// Set the gauge with the label values to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] = v
+}
+
+// Reset removes the values for every combination of label values
+func (g *Gauge) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.keys = make(map[string][]string)
+	g.values = make(map[string]float64)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(w, "gauge")
+	for _, k := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelPairs(g.keys[k], ""), formatFloat(g.values[k]))
+	}
+}
+
+// Histogram counts observations (e.g. durations) in buckets
+type Histogram struct {
+	vec
+	buckets []float64
+	counts  map[string][]uint64 // per bucket (not cumulative), plus one for +Inf
+	sums    map[string]float64
+}
+
+// NewHistogram registers a histogram with the given (sorted) bucket upper bounds and label names
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+	h := &Histogram{vec: newVec(name, help, labels), buckets: buckets,
+		counts: make(map[string][]uint64), sums: make(map[string]float64)}
+	if len(labels) == 0 {
+		h.counts[h.key(nil)] = make([]uint64, len(buckets)+1)
+	}
+	register(h)
+	return h
+}
+
+// Observe v in the histogram with the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(labelValues)
+	counts, ok := h.counts[k]
+	if !ok {
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[k] = counts
+	}
+	counts[sort.SearchFloat64s(h.buckets, v)]++
+	h.sums[k] += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, k := range h.sortedKeys() {
+		labelValues := h.keys[k]
+		var cumulative uint64
+		for i, c := range h.counts[k] {
+			cumulative += c
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(labelValues, `le="`+le+`"`), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelPairs(labelValues, ""), formatFloat(h.sums[k]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelPairs(labelValues, ""), cumulative)
+	}
+}
+
+// Write all the metrics, sorted by name
+func Write(w io.Writer) error {
+	registry.Lock()
+	onScrape := append([]func(){}, registry.onScrape...)
+	metrics := make([]metric, 0, len(registry.metrics))
+	for _, m := range registry.metrics {
+		metrics = append(metrics, m)
+	}
+	registry.Unlock()
+
+	for _, f := range onScrape {
+		f()
+	}
+	sort.Sort(byName(metrics))
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+type byName []metric
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Less(i, j int) bool { return m[i].name() < m[j].name() }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := Write(w); err != nil {
+			log.Errorf("error writing metrics %v", err)
+		}
+	})
+}
+
+// Serve the metrics on /metrics at addr (e.g. :9090) in the background,
+// failing to serve is logged rather than fatal as metrics are not essential to the process
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		log.WithField("addr", addr).Info("Serving metrics")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.WithField("addr", addr).Errorf("error serving metrics %v", err)
+		}
+	}()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape backslashes and new lines (and double quotes in label values)
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
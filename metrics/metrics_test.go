@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounter("test_calls_total", "Calls by method.", "method")
+	c.Inc("Event")
+	c.Add(2, `Say "hi"`)
+	g := NewGauge("test_depth", "Depth.")
+	g.Set(7)
+	h := NewHistogram("test_wait_seconds", "Wait.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var b bytes.Buffer
+	if err := Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"# HELP test_calls_total Calls by method.",
+		"# TYPE test_calls_total counter",
+		`test_calls_total{method="Event"} 1`,
+		`test_calls_total{method="Say \"hi\""} 2`,
+		"# TYPE test_depth gauge",
+		"test_depth 7",
+		"# TYPE test_wait_seconds histogram",
+		`test_wait_seconds_bucket{le="0.1"} 1`,
+		`test_wait_seconds_bucket{le="1"} 2`,
+		`test_wait_seconds_bucket{le="+Inf"} 3`,
+		"test_wait_seconds_sum 3.55",
+		"test_wait_seconds_count 3",
+	}
+	out := b.String()
+	for _, e := range expected {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("expected %q in output\n%s", e, out)
+		}
+	}
+	if strings.Index(out, "test_calls_total") > strings.Index(out, "test_depth") {
+		t.Errorf("expected metrics sorted by name\n%s", out)
+	}
+}
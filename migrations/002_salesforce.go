@@ -0,0 +1,45 @@
+package migrations
+
+// the salesforce schema (and its tables) are synced from salesforce by heroku connect, so we only add our own view
+// and table - the view is skipped if heroku connect hasn't created salesforce.donation_stats__c (e.g. in a dev database)
+func init() {
+	register(Migration{
+		Version: 2,
+		Name:    "salesforce",
+		Up: `
+CREATE SCHEMA IF NOT EXISTS salesforce;
+
+DO $$
+BEGIN
+	IF to_regclass('salesforce.donation_stats__c') IS NOT NULL THEN
+		CREATE OR REPLACE VIEW salesforce.contact_page_fundraising_result AS
+		SELECT related_contact_record__c AS contact_id,fundraising_page_id__c AS page_id,
+		SUM(COALESCE(initial_raised_online__c,0) + COALESCE(raised_online_incremental__c,0)) AS raised_online,
+		SUM(COALESCE(initial_raised_sms__c,0) + COALESCE(raised_sms_incremental__c,0)) AS raised_sms,
+		SUM(COALESCE(initial_raised_offline__c,0) + COALESCE(raised_offline_incremental__c,0)) AS raised_offline,
+		SUM(COALESCE(intial_estimated_gift_aid__c,0) + COALESCE(estimated_gift_aid__c,0)) AS estimated_gift_aid,
+		SUM(COALESCE(initial_pledge_amount__c,0) + COALESCE(pledge_amount_revised__c,0)) AS target_amount,
+		MAX(transaction_date__c) AS updated_timestamp
+		FROM salesforce.donation_stats__c
+		GROUP BY related_contact_record__c, fundraising_page_id__c;
+	END IF;
+END
+$$;
+
+CREATE TABLE IF NOT EXISTS salesforce.jgforce_contact(
+	fundraising_team_page_url__c VARCHAR(255),
+	event_id__c                  VARCHAR(10),
+	fundraiser_jg_email__c       VARCHAR(80),
+	sfid                         VARCHAR(18),
+	jg_charity_id__c             VARCHAR(10),
+	fundraising_page_url__c      VARCHAR(255),
+	systemmodstamp               TIMESTAMP,
+	email                        VARCHAR(80),
+	fundraising_page_id__c       VARCHAR(10),
+	PRIMARY KEY (sfid)
+);`,
+		Down: `
+DROP TABLE IF EXISTS salesforce.jgforce_contact;
+DROP VIEW IF EXISTS salesforce.contact_page_fundraising_result;`,
+	})
+}
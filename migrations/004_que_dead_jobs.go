@@ -0,0 +1,25 @@
+package migrations
+
+// jobs that exceeded their max attempts (see jgforce.WithDeadLetter)
+func init() {
+	register(Migration{
+		Version: 4,
+		Name:    "que_dead_jobs",
+		Up: `
+CREATE TABLE IF NOT EXISTS que_dead_jobs
+(
+	job_id      bigint      NOT NULL,
+	queue       text        NOT NULL,
+	priority    smallint    NOT NULL,
+	run_at      timestamptz NOT NULL,
+	job_class   text        NOT NULL,
+	args        json        NOT NULL DEFAULT '[]'::json,
+	error_count integer     NOT NULL,
+	last_error  text,
+	died_at     timestamptz NOT NULL DEFAULT now(),
+
+	CONSTRAINT que_dead_jobs_pkey PRIMARY KEY (job_id)
+);`,
+		Down: `DROP TABLE IF EXISTS que_dead_jobs;`,
+	})
+}
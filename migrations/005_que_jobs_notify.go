@@ -0,0 +1,24 @@
+package migrations
+
+// notifies the queue's channel whenever a job that is ready to run is added to que_jobs (see jgforce.Listener)
+func init() {
+	register(Migration{
+		Version: 5,
+		Name:    "que_jobs_notify",
+		Up: `
+CREATE OR REPLACE FUNCTION que_jobs_notify() RETURNS trigger AS $$
+BEGIN
+	IF NEW.run_at <= now() THEN
+		PERFORM pg_notify('que_jobs_' || NEW.queue, '');
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS que_jobs_notify ON que_jobs;
+CREATE TRIGGER que_jobs_notify AFTER INSERT ON que_jobs FOR EACH ROW EXECUTE PROCEDURE que_jobs_notify();`,
+		Down: `
+DROP TRIGGER IF EXISTS que_jobs_notify ON que_jobs;
+DROP FUNCTION IF EXISTS que_jobs_notify();`,
+	})
+}
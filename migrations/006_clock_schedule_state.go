@@ -0,0 +1,19 @@
+package migrations
+
+// the last run time of each clock schedule, so a restarted clock carries on from where it left off
+func init() {
+	register(Migration{
+		Version: 6,
+		Name:    "clock_schedule_state",
+		Up: `
+CREATE TABLE IF NOT EXISTS clock_schedule_state
+(
+	name        text        NOT NULL,
+	last_run_at timestamptz NOT NULL,
+	updated_at  timestamptz NOT NULL DEFAULT now(),
+
+	CONSTRAINT clock_schedule_state_pkey PRIMARY KEY (name)
+);`,
+		Down: `DROP TABLE IF EXISTS clock_schedule_state;`,
+	})
+}
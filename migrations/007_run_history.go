@@ -0,0 +1,33 @@
+package migrations
+
+// a row for every job worked (see jgforce.WithRunHistory)
+func init() {
+	register(Migration{
+		Version: 7,
+		Name:    "run_history",
+		Up: `
+CREATE SCHEMA IF NOT EXISTS jgforce;
+
+CREATE TABLE IF NOT EXISTS jgforce.run_history
+(
+	run_id                  bigserial   NOT NULL,
+	job_id                  bigint      NOT NULL,
+	queue                   text        NOT NULL,
+	job_class               text        NOT NULL,
+	started_at              timestamptz NOT NULL,
+	finished_at             timestamptz NOT NULL,
+	outcome                 text        NOT NULL,
+	error                   text,
+	events_scanned          integer     NOT NULL DEFAULT 0,
+	pages_discovered        integer     NOT NULL DEFAULT 0,
+	pages_refreshed         integer     NOT NULL DEFAULT 0,
+	pages_cancelled         integer     NOT NULL DEFAULT 0,
+	contacts_matched        integer     NOT NULL DEFAULT 0,
+	donation_stats_inserted integer     NOT NULL DEFAULT 0,
+
+	CONSTRAINT run_history_pkey PRIMARY KEY (run_id)
+);
+CREATE INDEX IF NOT EXISTS run_history_started_at_idx ON jgforce.run_history (started_at);`,
+		Down: `DROP SCHEMA IF EXISTS jgforce CASCADE;`,
+	})
+}
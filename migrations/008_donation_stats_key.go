@@ -0,0 +1,60 @@
+package migrations
+
+// an idempotency key for salesforce.donation_stats__c (see store.MasterKey and store.DetailKey), unique so a retried
+// or concurrent job can't insert a record twice. jgforce_key__c isn't mapped in heroku connect so it is left alone by the sync.
+// Existing records are keyed from their page and transaction date, except for any duplicates of a key (the later ones)
+// which are left without a key and listed by the jgforce.donation_stats_duplicates view.
+// Like the salesforce view, this is skipped if heroku connect hasn't created salesforce.donation_stats__c.
+func init() {
+	register(Migration{
+		Version: 8,
+		Name:    "donation_stats_key",
+		Up: `
+CREATE SCHEMA IF NOT EXISTS jgforce;
+
+DO $$
+BEGIN
+	IF to_regclass('salesforce.donation_stats__c') IS NOT NULL THEN
+		ALTER TABLE salesforce.donation_stats__c ADD COLUMN IF NOT EXISTS jgforce_key__c VARCHAR(64);
+
+		CREATE OR REPLACE VIEW jgforce.donation_stats_keyed AS
+		SELECT d.*,
+		CASE WHEN d.transaction_date__c IS NULL THEN d.fundraising_page_id__c || ':initial'
+			ELSE d.fundraising_page_id__c || ':' || to_char(d.transaction_date__c, 'YYYY-MM-DD')
+		END AS key
+		FROM salesforce.donation_stats__c d
+		WHERE d.fundraising_page_id__c IS NOT NULL AND d.fundraising_page_id__c <> '';
+
+		UPDATE salesforce.donation_stats__c d SET jgforce_key__c = k.key
+		FROM (SELECT id, key, row_number() OVER (PARTITION BY key ORDER BY id) AS n FROM jgforce.donation_stats_keyed) k
+		WHERE d.id = k.id AND k.n = 1 AND d.jgforce_key__c IS NULL;
+
+		CREATE UNIQUE INDEX IF NOT EXISTS donation_stats_jgforce_key_idx ON salesforce.donation_stats__c (jgforce_key__c);
+
+		-- excess_raised is the amount double counted by the duplicates (every record of the key but the first)
+		CREATE OR REPLACE VIEW jgforce.donation_stats_duplicates AS
+		SELECT k.key, k.fundraising_page_id__c AS page_id, count(*) AS records,
+		string_agg(k.id::text, ',' ORDER BY k.id) AS ids,
+		SUM(CASE WHEN k.n = 1 THEN 0
+			ELSE COALESCE(k.initial_raised_online__c,0) + COALESCE(k.initial_raised_sms__c,0) + COALESCE(k.initial_raised_offline__c,0)
+			+ COALESCE(k.raised_online_incremental__c,0) + COALESCE(k.raised_sms_incremental__c,0) + COALESCE(k.raised_offline_incremental__c,0)
+		END) AS excess_raised
+		FROM (SELECT *, row_number() OVER (PARTITION BY key ORDER BY id) AS n FROM jgforce.donation_stats_keyed) k
+		GROUP BY k.key, k.fundraising_page_id__c
+		HAVING count(*) > 1;
+	END IF;
+END
+$$;`,
+		Down: `
+DROP VIEW IF EXISTS jgforce.donation_stats_duplicates;
+DROP VIEW IF EXISTS jgforce.donation_stats_keyed;
+DROP INDEX IF EXISTS salesforce.donation_stats_jgforce_key_idx;
+DO $$
+BEGIN
+	IF to_regclass('salesforce.donation_stats__c') IS NOT NULL THEN
+		ALTER TABLE salesforce.donation_stats__c DROP COLUMN IF EXISTS jgforce_key__c;
+	END IF;
+END
+$$;`,
+	})
+}
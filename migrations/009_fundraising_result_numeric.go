@@ -0,0 +1,106 @@
+package migrations
+
+// the amounts of justgiving.fundraising_result are stored as NUMERIC (rather than the api's strings) so they are exact,
+// and the view no longer casts them to DOUBLE PRECISION. A blank amount becomes 0, as the view treated it. An amount which
+// isn't a decimal (see decimal.Parse) becomes NULL (counted as 0 by the view) and its original value is kept in
+// unparsed_amounts (by column), which flags the row for fixing by hand - the worker does the same with new results.
+// The down migration converts back, restoring the original values of the flagged amounts.
+func init() {
+	register(Migration{
+		Version: 9,
+		Name:    "fundraising_result_numeric",
+		Up: `
+DROP VIEW IF EXISTS justgiving.event_page_fundraising_result;
+
+CREATE OR REPLACE FUNCTION justgiving.parse_amount(s TEXT) RETURNS NUMERIC AS $$
+BEGIN
+	IF s IS NULL OR s = '' THEN
+		RETURN 0;
+	END IF;
+	IF s !~ '^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)$' THEN
+		RETURN NULL;
+	END IF;
+	RETURN s::NUMERIC;
+END
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+ALTER TABLE justgiving.fundraising_result ADD COLUMN IF NOT EXISTS unparsed_amounts JSONB;
+
+UPDATE justgiving.fundraising_result SET unparsed_amounts = NULLIF(jsonb_strip_nulls(jsonb_build_object(
+	'target', CASE WHEN justgiving.parse_amount(target) IS NULL THEN target END,
+	'total_raised_percentage_of_target', CASE WHEN justgiving.parse_amount(total_raised_percentage_of_target) IS NULL THEN total_raised_percentage_of_target END,
+	'total_raised_offline', CASE WHEN justgiving.parse_amount(total_raised_offline) IS NULL THEN total_raised_offline END,
+	'total_raised_online', CASE WHEN justgiving.parse_amount(total_raised_online) IS NULL THEN total_raised_online END,
+	'total_raised_sms', CASE WHEN justgiving.parse_amount(total_raised_sms) IS NULL THEN total_raised_sms END,
+	'total_estimated_gift_aid', CASE WHEN justgiving.parse_amount(total_estimated_gift_aid) IS NULL THEN total_estimated_gift_aid END
+)), '{}'::JSONB);
+
+ALTER TABLE justgiving.fundraising_result
+	ALTER COLUMN target DROP NOT NULL,
+	ALTER COLUMN target TYPE NUMERIC USING justgiving.parse_amount(target),
+	ALTER COLUMN total_raised_percentage_of_target DROP NOT NULL,
+	ALTER COLUMN total_raised_percentage_of_target TYPE NUMERIC USING justgiving.parse_amount(total_raised_percentage_of_target),
+	ALTER COLUMN total_raised_offline DROP NOT NULL,
+	ALTER COLUMN total_raised_offline TYPE NUMERIC USING justgiving.parse_amount(total_raised_offline),
+	ALTER COLUMN total_raised_online DROP NOT NULL,
+	ALTER COLUMN total_raised_online TYPE NUMERIC USING justgiving.parse_amount(total_raised_online),
+	ALTER COLUMN total_raised_sms DROP NOT NULL,
+	ALTER COLUMN total_raised_sms TYPE NUMERIC USING justgiving.parse_amount(total_raised_sms),
+	ALTER COLUMN total_estimated_gift_aid DROP NOT NULL,
+	ALTER COLUMN total_estimated_gift_aid TYPE NUMERIC USING justgiving.parse_amount(total_estimated_gift_aid);
+
+DROP FUNCTION justgiving.parse_amount(TEXT);
+
+CREATE OR REPLACE VIEW justgiving.event_page_fundraising_result AS
+SELECT p.charity_id, p.event_id, e.name AS event_name, p.page_id, p.page_short_name, r.year, r.month, r.day, r.updated_timestamp,
+COALESCE(r.total_raised_offline, 0) AS raised_offline,
+COALESCE(r.total_raised_online, 0) AS raised_online,
+COALESCE(r.total_raised_sms, 0) AS raised_sms,
+COALESCE(r.total_estimated_gift_aid, 0) AS estimated_gift_aid,
+COALESCE(r.target, 0) AS target_amount
+ FROM justgiving.fundraising_result r, justgiving.page p, justgiving.event e
+WHERE p.page_id = r.page_id AND p.event_id = e.event_id
+ORDER BY r.year DESC, r.month DESC, r.day DESC;`,
+		Down: `
+DROP VIEW IF EXISTS justgiving.event_page_fundraising_result;
+
+ALTER TABLE justgiving.fundraising_result
+	ALTER COLUMN target TYPE VARCHAR(48) USING COALESCE(unparsed_amounts->>'target', target::TEXT, ''),
+	ALTER COLUMN target SET NOT NULL,
+	ALTER COLUMN total_raised_percentage_of_target TYPE VARCHAR(48)
+		USING COALESCE(unparsed_amounts->>'total_raised_percentage_of_target', total_raised_percentage_of_target::TEXT, ''),
+	ALTER COLUMN total_raised_percentage_of_target SET NOT NULL,
+	ALTER COLUMN total_raised_offline TYPE VARCHAR(48) USING COALESCE(unparsed_amounts->>'total_raised_offline', total_raised_offline::TEXT, ''),
+	ALTER COLUMN total_raised_offline SET NOT NULL,
+	ALTER COLUMN total_raised_online TYPE VARCHAR(48) USING COALESCE(unparsed_amounts->>'total_raised_online', total_raised_online::TEXT, ''),
+	ALTER COLUMN total_raised_online SET NOT NULL,
+	ALTER COLUMN total_raised_sms TYPE VARCHAR(48) USING COALESCE(unparsed_amounts->>'total_raised_sms', total_raised_sms::TEXT, ''),
+	ALTER COLUMN total_raised_sms SET NOT NULL,
+	ALTER COLUMN total_estimated_gift_aid TYPE VARCHAR(48)
+		USING COALESCE(unparsed_amounts->>'total_estimated_gift_aid', total_estimated_gift_aid::TEXT, ''),
+	ALTER COLUMN total_estimated_gift_aid SET NOT NULL;
+
+ALTER TABLE justgiving.fundraising_result DROP COLUMN IF EXISTS unparsed_amounts;
+
+CREATE OR REPLACE VIEW justgiving.event_page_fundraising_result AS
+SELECT p.charity_id, p.event_id, e.name AS event_name, p.page_id, p.page_short_name, r.year, r.month, r.day, r.updated_timestamp,
+CASE WHEN r.total_raised_offline IS NULL OR r.total_raised_offline='' THEN 0.0
+	ELSE cast(r.total_raised_offline AS DOUBLE precision)
+END AS raised_offline,
+CASE WHEN r.total_raised_online IS NULL OR r.total_raised_online='' THEN 0.0
+	ELSE cast(r.total_raised_online AS DOUBLE precision)
+END AS raised_online,
+CASE WHEN r.total_raised_sms IS NULL OR r.total_raised_sms='' THEN 0.0
+	ELSE cast(r.total_raised_sms AS DOUBLE precision)
+END AS raised_sms,
+CASE WHEN r.total_estimated_gift_aid IS NULL OR r.total_estimated_gift_aid='' THEN 0.0
+	ELSE cast(r.total_estimated_gift_aid AS DOUBLE precision)
+END AS estimated_gift_aid,
+CASE WHEN r.target IS NULL OR r.target='' THEN 0.0
+	ELSE cast(r.target AS DOUBLE precision)
+END AS target_amount
+ FROM justgiving.fundraising_result r, justgiving.page p, justgiving.event e
+WHERE p.page_id = r.page_id AND p.event_id = e.event_id
+ORDER BY r.year DESC, r.month DESC, r.day DESC;`,
+	})
+}
@@ -0,0 +1,41 @@
+package migrations
+
+// the currency of the page (an ISO 4217 code e.g. GBP) is stored alongside its results, and added to the end of the
+// justgiving.event_page_fundraising_result view. Existing results are left without a currency, the salesforce worker
+// takes them to be in SALESFORCE_CURRENCY (as every result was until we captured the currency), each is filled in
+// the next time the page's results are refreshed.
+func init() {
+	register(Migration{
+		Version: 10,
+		Name:    "fundraising_result_currency",
+		Up: `
+ALTER TABLE justgiving.fundraising_result ADD COLUMN IF NOT EXISTS currency_code VARCHAR(3);
+
+CREATE OR REPLACE VIEW justgiving.event_page_fundraising_result AS
+SELECT p.charity_id, p.event_id, e.name AS event_name, p.page_id, p.page_short_name, r.year, r.month, r.day, r.updated_timestamp,
+COALESCE(r.total_raised_offline, 0) AS raised_offline,
+COALESCE(r.total_raised_online, 0) AS raised_online,
+COALESCE(r.total_raised_sms, 0) AS raised_sms,
+COALESCE(r.total_estimated_gift_aid, 0) AS estimated_gift_aid,
+COALESCE(r.target, 0) AS target_amount,
+r.currency_code
+ FROM justgiving.fundraising_result r, justgiving.page p, justgiving.event e
+WHERE p.page_id = r.page_id AND p.event_id = e.event_id
+ORDER BY r.year DESC, r.month DESC, r.day DESC;`,
+		Down: `
+DROP VIEW IF EXISTS justgiving.event_page_fundraising_result;
+
+ALTER TABLE justgiving.fundraising_result DROP COLUMN IF EXISTS currency_code;
+
+CREATE OR REPLACE VIEW justgiving.event_page_fundraising_result AS
+SELECT p.charity_id, p.event_id, e.name AS event_name, p.page_id, p.page_short_name, r.year, r.month, r.day, r.updated_timestamp,
+COALESCE(r.total_raised_offline, 0) AS raised_offline,
+COALESCE(r.total_raised_online, 0) AS raised_online,
+COALESCE(r.total_raised_sms, 0) AS raised_sms,
+COALESCE(r.total_estimated_gift_aid, 0) AS estimated_gift_aid,
+COALESCE(r.target, 0) AS target_amount
+ FROM justgiving.fundraising_result r, justgiving.page p, justgiving.event e
+WHERE p.page_id = r.page_id AND p.event_id = e.event_id
+ORDER BY r.year DESC, r.month DESC, r.day DESC;`,
+	})
+}
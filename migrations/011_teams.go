@@ -0,0 +1,46 @@
+package migrations
+
+// justgiving teams (as found from the team page urls of salesforce contacts), the pages of their members
+// and their totals by day (year, month and day are 0 for the initial totals, as in justgiving.fundraising_result)
+func init() {
+	register(Migration{
+		Version: 11,
+		Name:    "teams",
+		Up: `
+CREATE TABLE IF NOT EXISTS justgiving.team(
+	team_id           INT          NOT NULL,
+	team_short_name   VARCHAR(255) NOT NULL,
+	name              VARCHAR(255),
+	currency_code     VARCHAR(3),
+	created_timestamp TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_timestamp TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (team_id)
+);
+
+CREATE TABLE IF NOT EXISTS justgiving.team_member(
+	team_id           INT          NOT NULL,
+	page_id           INT          NOT NULL,
+	page_short_name   VARCHAR(255),
+	created_timestamp TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (team_id, page_id)
+);
+CREATE INDEX IF NOT EXISTS team_member_page_index ON justgiving.team_member(page_id);
+
+CREATE TABLE IF NOT EXISTS justgiving.team_fundraising_result(
+	team_id           INT        NOT NULL,
+	year              INT        NOT NULL,
+	month             INT        NOT NULL,
+	day               INT        NOT NULL,
+	target            NUMERIC    NOT NULL,
+	raised_so_far     NUMERIC    NOT NULL,
+	currency_code     VARCHAR(3),
+	created_timestamp TIMESTAMP  NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_timestamp TIMESTAMP  NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (team_id, year, month, day)
+);`,
+		Down: `
+DROP TABLE IF EXISTS justgiving.team_fundraising_result;
+DROP TABLE IF EXISTS justgiving.team_member;
+DROP TABLE IF EXISTS justgiving.team;`,
+	})
+}
@@ -0,0 +1,23 @@
+package migrations
+
+// pages the justgiving api can't give us results for are flagged unserviceable, so they can be re-checked every so often
+// rather than being left at priority 0 forever with the cancelled pages. Until now a page was unserviceable only if it
+// had no short name, so the existing pages at priority 0 without one are flagged.
+func init() {
+	register(Migration{
+		Version: 12,
+		Name:    "page_unserviceable",
+		Up: `
+ALTER TABLE justgiving.page_priority ADD COLUMN IF NOT EXISTS unserviceable BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE justgiving.page_priority pp SET unserviceable = TRUE
+  FROM justgiving.page p
+ WHERE p.page_id = pp.page_id AND pp.priority = 0 AND COALESCE(p.page_short_name, '') = '';
+
+CREATE INDEX IF NOT EXISTS unserviceable_page_priority_index ON justgiving.page_priority(page_id) WHERE unserviceable;`,
+		Down: `
+DROP INDEX IF EXISTS justgiving.unserviceable_page_priority_index;
+
+ALTER TABLE justgiving.page_priority DROP COLUMN IF EXISTS unserviceable;`,
+	})
+}
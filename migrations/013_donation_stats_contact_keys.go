@@ -0,0 +1,68 @@
+package migrations
+
+// the donation stats of a team are per contact, so their keys include the contact (see store.MasterKey) rather than being
+// made from the page id and transaction date alone. The jgforce.donation_stats_keyed view (and so the duplicates view) now takes
+// a record's key as is, only making one up for records without a key, or every team record of a day would look like a duplicate.
+func init() {
+	register(Migration{
+		Version: 13,
+		Name:    "donation_stats_contact_keys",
+		Up: `
+DO $$
+BEGIN
+	IF to_regclass('salesforce.donation_stats__c') IS NOT NULL THEN
+		DROP VIEW IF EXISTS jgforce.donation_stats_duplicates;
+		DROP VIEW IF EXISTS jgforce.donation_stats_keyed;
+
+		CREATE VIEW jgforce.donation_stats_keyed AS
+		SELECT d.*,
+		COALESCE(d.jgforce_key__c, CASE WHEN d.transaction_date__c IS NULL THEN d.fundraising_page_id__c || ':initial'
+			ELSE d.fundraising_page_id__c || ':' || to_char(d.transaction_date__c, 'YYYY-MM-DD')
+		END) AS key
+		FROM salesforce.donation_stats__c d
+		WHERE d.fundraising_page_id__c IS NOT NULL AND d.fundraising_page_id__c <> '';
+
+		-- excess_raised is the amount double counted by the duplicates (every record of the key but the first)
+		CREATE VIEW jgforce.donation_stats_duplicates AS
+		SELECT k.key, k.fundraising_page_id__c AS page_id, count(*) AS records,
+		string_agg(k.id::text, ',' ORDER BY k.id) AS ids,
+		SUM(CASE WHEN k.n = 1 THEN 0
+			ELSE COALESCE(k.initial_raised_online__c,0) + COALESCE(k.initial_raised_sms__c,0) + COALESCE(k.initial_raised_offline__c,0)
+			+ COALESCE(k.raised_online_incremental__c,0) + COALESCE(k.raised_sms_incremental__c,0) + COALESCE(k.raised_offline_incremental__c,0)
+		END) AS excess_raised
+		FROM (SELECT *, row_number() OVER (PARTITION BY key ORDER BY id) AS n FROM jgforce.donation_stats_keyed) k
+		GROUP BY k.key, k.fundraising_page_id__c
+		HAVING count(*) > 1;
+	END IF;
+END
+$$;`,
+		Down: `
+DO $$
+BEGIN
+	IF to_regclass('salesforce.donation_stats__c') IS NOT NULL THEN
+		DROP VIEW IF EXISTS jgforce.donation_stats_duplicates;
+		DROP VIEW IF EXISTS jgforce.donation_stats_keyed;
+
+		CREATE VIEW jgforce.donation_stats_keyed AS
+		SELECT d.*,
+		CASE WHEN d.transaction_date__c IS NULL THEN d.fundraising_page_id__c || ':initial'
+			ELSE d.fundraising_page_id__c || ':' || to_char(d.transaction_date__c, 'YYYY-MM-DD')
+		END AS key
+		FROM salesforce.donation_stats__c d
+		WHERE d.fundraising_page_id__c IS NOT NULL AND d.fundraising_page_id__c <> '';
+
+		CREATE VIEW jgforce.donation_stats_duplicates AS
+		SELECT k.key, k.fundraising_page_id__c AS page_id, count(*) AS records,
+		string_agg(k.id::text, ',' ORDER BY k.id) AS ids,
+		SUM(CASE WHEN k.n = 1 THEN 0
+			ELSE COALESCE(k.initial_raised_online__c,0) + COALESCE(k.initial_raised_sms__c,0) + COALESCE(k.initial_raised_offline__c,0)
+			+ COALESCE(k.raised_online_incremental__c,0) + COALESCE(k.raised_sms_incremental__c,0) + COALESCE(k.raised_offline_incremental__c,0)
+		END) AS excess_raised
+		FROM (SELECT *, row_number() OVER (PARTITION BY key ORDER BY id) AS n FROM jgforce.donation_stats_keyed) k
+		GROUP BY k.key, k.fundraising_page_id__c
+		HAVING count(*) > 1;
+	END IF;
+END
+$$;`,
+	})
+}
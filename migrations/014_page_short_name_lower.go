@@ -0,0 +1,18 @@
+package migrations
+
+// pages are looked up by short name ignoring case (the short name in a contact's page url may not be cased as justgiving
+// has it), so the short name index is on lower(page_short_name)
+func init() {
+	register(Migration{
+		Version: 14,
+		Name:    "page_short_name_lower",
+		Up: `
+DROP INDEX IF EXISTS justgiving.page_short_name_page_index;
+
+CREATE INDEX IF NOT EXISTS page_short_name_page_index ON justgiving.page(lower(page_short_name));`,
+		Down: `
+DROP INDEX IF EXISTS justgiving.page_short_name_page_index;
+
+CREATE INDEX IF NOT EXISTS page_short_name_page_index ON justgiving.page(page_short_name);`,
+	})
+}
@@ -0,0 +1,40 @@
+package migrations
+
+// the donation stats records keyed by migration 8 are rekeyed by the day of the justgiving result they were made from
+// (see donationStatsKeysSQL), as the worker keys them, so the worker's next save of the day updates the record rather than
+// inserting a second record for the day. The down migration restores the views of migration 13, the keys are left as they are.
+func init() {
+	register(Migration{
+		Version: 15,
+		Name:    "donation_stats_result_day_keys",
+		Up:      donationStatsKeysSQL,
+		Down: `
+DO $$
+BEGIN
+	IF to_regclass('salesforce.donation_stats__c') IS NOT NULL THEN
+		DROP VIEW IF EXISTS jgforce.donation_stats_duplicates;
+		DROP VIEW IF EXISTS jgforce.donation_stats_keyed;
+
+		CREATE VIEW jgforce.donation_stats_keyed AS
+		SELECT d.*,
+		COALESCE(d.jgforce_key__c, CASE WHEN d.transaction_date__c IS NULL THEN d.fundraising_page_id__c || ':initial'
+			ELSE d.fundraising_page_id__c || ':' || to_char(d.transaction_date__c, 'YYYY-MM-DD')
+		END) AS key
+		FROM salesforce.donation_stats__c d
+		WHERE d.fundraising_page_id__c IS NOT NULL AND d.fundraising_page_id__c <> '';
+
+		CREATE VIEW jgforce.donation_stats_duplicates AS
+		SELECT k.key, k.fundraising_page_id__c AS page_id, count(*) AS records,
+		string_agg(k.id::text, ',' ORDER BY k.id) AS ids,
+		SUM(CASE WHEN k.n = 1 THEN 0
+			ELSE COALESCE(k.initial_raised_online__c,0) + COALESCE(k.initial_raised_sms__c,0) + COALESCE(k.initial_raised_offline__c,0)
+			+ COALESCE(k.raised_online_incremental__c,0) + COALESCE(k.raised_sms_incremental__c,0) + COALESCE(k.raised_offline_incremental__c,0)
+		END) AS excess_raised
+		FROM (SELECT *, row_number() OVER (PARTITION BY key ORDER BY id) AS n FROM jgforce.donation_stats_keyed) k
+		GROUP BY k.key, k.fundraising_page_id__c
+		HAVING count(*) > 1;
+	END IF;
+END
+$$;`,
+	})
+}
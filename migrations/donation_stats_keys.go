@@ -0,0 +1,88 @@
+package migrations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// donationStatsKeysSQL (re)keys salesforce.donation_stats__c, it is idempotent so it is both migration 15 and Rekey.
+// A record without a key is given the key the worker would have given it (see store.MasterKey and store.DetailKey),
+// the day of a detail record being that of the justgiving result it was made from - its transaction date is the result's
+// updated timestamp, which is a later day for a result updated after midnight - or its transaction date if the result has
+// been updated since. A key given by migration 8 from the transaction date alone which isn't the day of the record's result
+// is taken off it first. Any duplicates of a key (the later ones) are left without a key and listed by the duplicates view.
+// The views are recreated as heroku connect drops them along with the table when it is remapped.
+const donationStatsKeysSQL = `
+CREATE SCHEMA IF NOT EXISTS jgforce;
+
+DO $$
+BEGIN
+	IF to_regclass('salesforce.donation_stats__c') IS NOT NULL THEN
+		ALTER TABLE salesforce.donation_stats__c ADD COLUMN IF NOT EXISTS jgforce_key__c VARCHAR(64);
+
+		DROP VIEW IF EXISTS jgforce.donation_stats_duplicates;
+		DROP VIEW IF EXISTS jgforce.donation_stats_keyed;
+
+		-- (salesforce keeps times to the millisecond, so the times are compared to the second)
+		CREATE VIEW jgforce.donation_stats_keyed AS
+		SELECT d.*,
+		COALESCE(d.jgforce_key__c,
+			CASE WHEN d.fundraising_page_id__c LIKE 'T%' THEN d.fundraising_page_id__c || ':' || COALESCE(d.related_contact_record__c, '')
+				ELSE d.fundraising_page_id__c
+			END || ':' ||
+			CASE WHEN d.transaction_date__c IS NULL THEN 'initial'
+				ELSE to_char(COALESCE((SELECT make_date(r.year, r.month, r.day) FROM justgiving.fundraising_result r
+					WHERE r.page_id::text = d.fundraising_page_id__c AND r.year > 0
+					AND date_trunc('second', r.updated_timestamp) = date_trunc('second', d.transaction_date__c) LIMIT 1),
+					d.transaction_date__c::date), 'YYYY-MM-DD')
+			END) AS key
+		FROM salesforce.donation_stats__c d
+		WHERE d.fundraising_page_id__c IS NOT NULL AND d.fundraising_page_id__c <> '';
+
+		-- excess_raised is the amount double counted by the duplicates (every record of the key but the first)
+		CREATE VIEW jgforce.donation_stats_duplicates AS
+		SELECT k.key, k.fundraising_page_id__c AS page_id, count(*) AS records,
+		string_agg(k.id::text, ',' ORDER BY k.id) AS ids,
+		SUM(CASE WHEN k.n = 1 THEN 0
+			ELSE COALESCE(k.initial_raised_online__c,0) + COALESCE(k.initial_raised_sms__c,0) + COALESCE(k.initial_raised_offline__c,0)
+			+ COALESCE(k.raised_online_incremental__c,0) + COALESCE(k.raised_sms_incremental__c,0) + COALESCE(k.raised_offline_incremental__c,0)
+		END) AS excess_raised
+		FROM (SELECT *, row_number() OVER (PARTITION BY key ORDER BY id) AS n FROM jgforce.donation_stats_keyed) k
+		GROUP BY k.key, k.fundraising_page_id__c
+		HAVING count(*) > 1;
+
+		UPDATE salesforce.donation_stats__c d SET jgforce_key__c = NULL
+		FROM justgiving.fundraising_result r
+		WHERE d.jgforce_key__c IS NOT NULL AND d.transaction_date__c IS NOT NULL
+		AND r.page_id::text = d.fundraising_page_id__c AND r.year > 0
+		AND date_trunc('second', r.updated_timestamp) = date_trunc('second', d.transaction_date__c)
+		AND d.jgforce_key__c <> d.fundraising_page_id__c || ':' || to_char(make_date(r.year, r.month, r.day), 'YYYY-MM-DD');
+
+		UPDATE salesforce.donation_stats__c d SET jgforce_key__c = k.key
+		FROM (SELECT id, key, row_number() OVER (PARTITION BY key ORDER BY id) AS n FROM jgforce.donation_stats_keyed
+			WHERE jgforce_key__c IS NULL) k
+		WHERE d.id = k.id AND k.n = 1 AND NOT EXISTS (SELECT 1 FROM salesforce.donation_stats__c o WHERE o.jgforce_key__c = k.key);
+
+		CREATE UNIQUE INDEX IF NOT EXISTS donation_stats_jgforce_key_idx ON salesforce.donation_stats__c (jgforce_key__c);
+	END IF;
+END
+$$;`
+
+// Rekey restores the idempotency keys of salesforce.donation_stats__c (see donationStatsKeysSQL). When heroku connect
+// remaps the table it drops the jgforce_key__c column (which isn't mapped) along with its unique index, the worker then
+// fails to save any donation stats until this is run (it is the migrate command's rekey).
+func Rekey(conn *pgx.Conn) error {
+	return locked(conn, func(versions map[int]time.Time) error {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err = tx.Exec(donationStatsKeysSQL); err != nil {
+			return fmt.Errorf("error rekeying salesforce.donation_stats__c %v", err)
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,182 @@
+// Package migrations versions the database schema, each migration is an ordered pair of up / down sql scripts
+// (defined in the numbered files of this package) and the versions applied are recorded in schema_migrations
+package migrations
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jackc/pgx"
+)
+
+// Migration changes the schema from the previous version to this one (Up) and back again (Down)
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status of a migration
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// SchemaMigrationsTableSQL to create table idempotently, it records the versions which have been applied
+const SchemaMigrationsTableSQL = `
+		CREATE TABLE IF NOT EXISTS schema_migrations
+		(
+			version    integer     NOT NULL,
+			name       text        NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now(),
+
+			CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+		);`
+
+// migrateLockClass is the advisory lock class held while migrating, so only one process migrates at a time
+// (following on from the lock classes used by jgforce)
+const migrateLockClass = 3
+
+var all []Migration
+
+// register a migration, called from the init func of each numbered file
+func register(m Migration) {
+	all = append(all, m)
+	sort.Sort(byVersion(all))
+}
+
+type byVersion []Migration
+
+func (m byVersion) Len() int           { return len(m) }
+func (m byVersion) Less(i, j int) bool { return m[i].Version < m[j].Version }
+func (m byVersion) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// All the migrations in version order
+func All() []Migration {
+	return append([]Migration(nil), all...)
+}
+
+// Up applies every migration which hasn't been applied yet, in version order, returning those it applied
+func Up(conn *pgx.Conn) ([]Migration, error) {
+	var applied []Migration
+	err := locked(conn, func(versions map[int]time.Time) error {
+		for _, m := range all {
+			if _, ok := versions[m.Version]; ok {
+				continue
+			}
+			if err := apply(conn, m, m.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+				return err
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the latest n applied migrations, in reverse version order, returning those it reverted
+func Down(conn *pgx.Conn, n int) ([]Migration, error) {
+	var reverted []Migration
+	err := locked(conn, func(versions map[int]time.Time) error {
+		for i := len(all) - 1; i >= 0 && len(reverted) < n; i-- {
+			m := all[i]
+			if _, ok := versions[m.Version]; !ok {
+				continue
+			}
+			if err := apply(conn, m, m.Down, `DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+				return err
+			}
+			reverted = append(reverted, m)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Statuses of every migration, in version order
+func Statuses(conn *pgx.Conn) ([]Status, error) {
+	var statuses []Status
+	err := locked(conn, func(versions map[int]time.Time) error {
+		for _, m := range all {
+			s := Status{Migration: m}
+			if t, ok := versions[m.Version]; ok {
+				s.AppliedAt = &t
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Migrate connects to the database and applies any pending migrations, it is run at worker startup
+func Migrate(dbURL string) error {
+	connCfg, err := pgx.ParseURI(dbURL)
+	if err != nil {
+		return fmt.Errorf("error configuring connection to database %v", err)
+	}
+	conn, err := pgx.Connect(connCfg)
+	if err != nil {
+		return fmt.Errorf("error connecting to database %v", err)
+	}
+	defer conn.Close()
+
+	applied, err := Up(conn)
+	for _, m := range applied {
+		log.WithField("version", m.Version).Infof("Applied migration %s", m.Name)
+	}
+	return err
+}
+
+// locked calls f holding the migrate lock, with the versions applied so far
+func locked(conn *pgx.Conn, f func(versions map[int]time.Time) error) error {
+	if _, err := conn.Exec(`SELECT pg_advisory_lock($1, 0)`, migrateLockClass); err != nil {
+		return fmt.Errorf("error acquiring migrate lock %v", err)
+	}
+	defer conn.Exec(`SELECT pg_advisory_unlock($1, 0)`, migrateLockClass)
+
+	if _, err := conn.Exec(SchemaMigrationsTableSQL); err != nil {
+		return fmt.Errorf("error creating schema_migrations %v", err)
+	}
+	rows, err := conn.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("error querying schema_migrations %v", err)
+	}
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int32
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading from schema_migrations %v", err)
+		}
+		versions[int(version)] = appliedAt
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error reading from schema_migrations %v", err)
+	}
+	return f(versions)
+}
+
+// apply the migration's sql, recording it in schema_migrations, in a single transaction
+func apply(conn *pgx.Conn, m Migration, sql string, record string, args ...interface{}) error {
+	if sql == "" {
+		return fmt.Errorf("migration %d %s has no sql", m.Version, m.Name)
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(sql); err != nil {
+		return fmt.Errorf("error running migration %d %s %v", m.Version, m.Name, err)
+	}
+	if _, err = tx.Exec(record, args...); err != nil {
+		return fmt.Errorf("error recording migration %d %s in schema_migrations %v", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,18 @@
+package migrations
+
+import "testing"
+
+func TestAll(t *testing.T) {
+	ms := All()
+	if len(ms) == 0 {
+		t.Fatal("expected migrations to be registered")
+	}
+	for i, m := range ms {
+		if m.Version != i+1 {
+			t.Errorf("expected migration %s to be version %d, got %d", m.Name, i+1, m.Version)
+		}
+		if m.Name == "" || m.Up == "" || m.Down == "" {
+			t.Errorf("expected migration %d to have a name, up and down sql", m.Version)
+		}
+	}
+}
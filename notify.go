@@ -0,0 +1,99 @@
+package jgforce
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jackc/pgx"
+)
+
+// NotifyChannel for the queue, the que_jobs_notify trigger (see the migrations package) notifies it
+// whenever a job that is ready to run is added to que_jobs
+func NotifyChannel(queue string) string {
+	return "que_jobs_" + queue
+}
+
+// Listener wakes worker pools as soon as a job is added to their queue, using postgres LISTEN / NOTIFY.
+// It uses its own connection (rather than one from the pool) and reconnects if that connection is lost,
+// the pools keep polling at their interval so no jobs are missed while it does.
+type Listener struct {
+	connCfg pgx.ConnConfig
+	pools   map[string]*WorkerPool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewListener for the worker pools, call Start to begin listening
+func NewListener(dbURL string, pools ...*WorkerPool) (*Listener, error) {
+	connCfg, err := pgx.ParseURI(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		connCfg: connCfg,
+		pools:   make(map[string]*WorkerPool),
+		stop:    make(chan struct{}),
+	}
+	for _, p := range pools {
+		l.pools[NotifyChannel(p.Queue)] = p
+	}
+	return l, nil
+}
+
+// Start listening
+func (l *Listener) Start() {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		for {
+			if err := l.listen(); err != nil {
+				log.Warnf("error listening for jobs, falling back to polling until reconnected %v", err)
+			}
+			select {
+			case <-l.stop:
+				return
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}()
+}
+
+// listen on a new connection until stopped or the connection fails
+func (l *Listener) listen() error {
+	conn, err := pgx.Connect(l.connCfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for channel := range l.pools {
+		if err = conn.Listen(channel); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-l.stop:
+			return nil
+		default:
+		}
+		n, err := conn.WaitForNotification(time.Second)
+		if err == pgx.ErrNotificationTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if p, ok := l.pools[n.Channel]; ok {
+			p.Wake()
+		}
+	}
+}
+
+// Stop listening
+func (l *Listener) Stop() {
+	close(l.stop)
+	l.wg.Wait()
+}
@@ -0,0 +1,91 @@
+package jgforce
+
+import (
+	"sync"
+	"time"
+
+	que "github.com/bgentry/que-go"
+)
+
+// WorkerPool works the jobs on a queue with a number of go routines, much like que's WorkerPool,
+// except it can also be woken to check the queue straight away (see Listener) rather than only every Interval
+type WorkerPool struct {
+	WorkMap  que.WorkMap
+	Interval time.Duration
+	Queue    string
+
+	c     *que.Client
+	count int
+	wake  chan struct{}
+	stop  chan struct{}
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	done  bool
+}
+
+// NewWorkerPool with count go routines, set the Queue and Interval before calling Start
+func NewWorkerPool(c *que.Client, wm que.WorkMap, count int) *WorkerPool {
+	return &WorkerPool{
+		WorkMap:  wm,
+		Interval: 5 * time.Second,
+		c:        c,
+		count:    count,
+		wake:     make(chan struct{}, count),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start the go routines
+func (w *WorkerPool) Start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := 0; i < w.count; i++ {
+		worker := que.NewWorker(w.c, w.WorkMap)
+		worker.Queue = w.Queue
+		w.wg.Add(1)
+		go w.work(worker)
+	}
+}
+
+// work jobs until there are none left, then sleep until woken or the interval passes
+func (w *WorkerPool) work(worker *que.Worker) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.wake:
+		case <-time.After(w.Interval):
+		}
+		for worker.WorkOne() {
+			select {
+			case <-w.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Wake one of the go routines to check the queue now, if they are all busy this is a no-op
+// (they check the queue again as soon as they finish their current job)
+func (w *WorkerPool) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Shutdown stops the go routines, waiting for any jobs in progress to finish
+func (w *WorkerPool) Shutdown() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done {
+		return
+	}
+	close(w.stop)
+	w.wg.Wait()
+	w.done = true
+}
@@ -0,0 +1,122 @@
+package jgforce
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+// The progress counts recorded in the run history, the jobs record these with AddProgress
+const (
+	EventsScanned         = "events scanned"
+	PagesDiscovered       = "pages discovered"
+	PagesRefreshed        = "pages refreshed"
+	PagesCancelled        = "pages cancelled"
+	ContactsMatched       = "contacts matched"
+	DonationStatsInserted = "donation stats inserted"
+)
+
+// Run outcomes
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunTimedOut  = "timed out"
+	RunCancelled = "cancelled"
+)
+
+// Run is a row from the run history. The justgiving heartbeat fans out its work into SyncEventPages and RefreshPageResults
+// jobs, so its own run only counts the events scanned, the pages discovered, refreshed and cancelled are counted by the runs
+// of the jobs it fanned out into
+type Run struct {
+	ID                    int64     `json:"run_id"`
+	JobID                 int64     `json:"job_id"`
+	Queue                 string    `json:"queue"`
+	Type                  string    `json:"job_class"`
+	StartedAt             time.Time `json:"started_at"`
+	FinishedAt            time.Time `json:"finished_at"`
+	Outcome               string    `json:"outcome"`
+	Error                 *string   `json:"error,omitempty"`
+	EventsScanned         int32     `json:"events_scanned"`
+	PagesDiscovered       int32     `json:"pages_discovered"`
+	PagesRefreshed        int32     `json:"pages_refreshed"`
+	PagesCancelled        int32     `json:"pages_cancelled"`
+	ContactsMatched       int32     `json:"contacts_matched"`
+	DonationStatsInserted int32     `json:"donation_stats_inserted"`
+}
+
+// WithRunHistory wraps each of the job funcs so that every run is recorded in jgforce.run_history,
+// along with the progress counts it recorded. It relies on the Progress added by WithTimeout, so wrap the
+// job funcs with this first i.e. WithTimeout(ctx, WithRunHistory(jm)), a job which timed out is recorded with
+// the *TimeoutError WithTimeout returns for it
+func WithRunHistory(jm JobMap) JobMap {
+	wrapped := make(JobMap, len(jm))
+	for jobType, jf := range jm {
+		wrapped[jobType] = recordRun(jf)
+	}
+	return wrapped
+}
+
+func recordRun(jf JobFunc) JobFunc {
+	return func(ctx context.Context, j *que.Job) error {
+		started := time.Now()
+		err := timeoutError(ctx, jf(ctx, j))
+		finished := time.Now()
+
+		outcome := RunSucceeded
+		var lastError *string
+		if err != nil {
+			_, timedOut := err.(*TimeoutError)
+			switch {
+			case timedOut:
+				outcome = RunTimedOut
+			case ctx.Err() != nil:
+				outcome = RunCancelled
+			default:
+				outcome = RunFailed
+			}
+			e := err.Error()
+			lastError = &e
+		}
+
+		p := progressFrom(ctx)
+		// the job's connection is free to use once the job has been worked (and saves us taking another from the pool)
+		if j.Conn() != nil {
+			_, rerr := j.Conn().Exec(`INSERT INTO jgforce.run_history (job_id, queue, job_class, started_at, finished_at, outcome, error,
+ events_scanned, pages_discovered, pages_refreshed, pages_cancelled, contacts_matched, donation_stats_inserted)
+ VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)`, j.ID, j.Queue, j.Type, started, finished, outcome, lastError,
+				p.Count(EventsScanned), p.Count(PagesDiscovered), p.Count(PagesRefreshed), p.Count(PagesCancelled),
+				p.Count(ContactsMatched), p.Count(DonationStatsInserted))
+			if rerr != nil {
+				// the run history is a record, not a reason to fail the job
+				log.WithField("job_id", j.ID).Errorf("error recording run in jgforce.run_history %v", rerr)
+			}
+		}
+		return err
+	}
+}
+
+// RecentRuns returns the most recent runs, optionally filtered by queue and / or job type
+func RecentRuns(pool *pgx.ConnPool, queue string, jobType string, limit int) ([]Run, error) {
+	rows, err := pool.Query(`SELECT run_id, job_id, queue, job_class, started_at, finished_at, outcome, error,
+ events_scanned, pages_discovered, pages_refreshed, pages_cancelled, contacts_matched, donation_stats_inserted
+ FROM jgforce.run_history WHERE ($1 = '' OR queue = $1) AND ($2 = '' OR job_class = $2)
+ ORDER BY started_at DESC, run_id DESC LIMIT $3`, queue, jobType, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying jgforce.run_history %v", err)
+	}
+	defer rows.Close()
+	var runs []Run
+	for rows.Next() {
+		var r Run
+		if err = rows.Scan(&r.ID, &r.JobID, &r.Queue, &r.Type, &r.StartedAt, &r.FinishedAt, &r.Outcome, &r.Error,
+			&r.EventsScanned, &r.PagesDiscovered, &r.PagesRefreshed, &r.PagesCancelled, &r.ContactsMatched, &r.DonationStatsInserted); err != nil {
+			return nil, fmt.Errorf("error reading from jgforce.run_history %v", err)
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
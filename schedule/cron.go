@@ -0,0 +1,221 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec computes the run times of a schedule
+type Spec interface {
+	// Next returns the first run time after t
+	Next(t time.Time) time.Time
+}
+
+// cronSpec is a parsed 5 field cron expression (minute hour day-of-month month day-of-week),
+// each field is a bit set of the values it matches
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// everySpec runs at a fixed interval
+type everySpec struct {
+	interval time.Duration
+}
+
+type bounds struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dows = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse a cron expression, either the standard 5 fields (minute hour day-of-month month day-of-week)
+// supporting *, lists, ranges, steps and month / day names, or one of the descriptors
+// @yearly, @annually, @monthly, @weekly, @daily, @midnight, @hourly or @every <duration> (e.g. @every 15m)
+func Parse(expr string) (Spec, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(expr[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q %v", expr, err)
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("invalid cron expression %q, interval must be at least 1m", expr)
+		}
+		return everySpec{d}, nil
+	}
+	if d, ok := descriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, expected 5 fields but have %d", expr, len(fields))
+	}
+	var s cronSpec
+	var err error
+	if s.minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, fmt.Errorf("invalid minute in cron expression %q %v", expr, err)
+	}
+	if s.hour, err = parseField(fields[1], hours); err != nil {
+		return nil, fmt.Errorf("invalid hour in cron expression %q %v", expr, err)
+	}
+	if s.dom, err = parseField(fields[2], doms); err != nil {
+		return nil, fmt.Errorf("invalid day of month in cron expression %q %v", expr, err)
+	}
+	if s.month, err = parseField(fields[3], months); err != nil {
+		return nil, fmt.Errorf("invalid month in cron expression %q %v", expr, err)
+	}
+	if s.dow, err = parseField(fields[4], dows); err != nil {
+		return nil, fmt.Errorf("invalid day of week in cron expression %q %v", expr, err)
+	}
+	// 7 is an alias for sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow = (s.dow | 1) &^ (1 << 7)
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseField returns the bit set of values matched by a comma separated list of ranges
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, r := range strings.Split(field, ",") {
+		rbits, err := parseRange(r, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= rbits
+	}
+	return bits, nil
+}
+
+// parseRange handles *, n, a-b and any of these with a /step
+func parseRange(r string, b bounds) (uint64, error) {
+	step := uint(1)
+	if i := strings.Index(r, "/"); i >= 0 {
+		s, err := strconv.ParseUint(r[i+1:], 10, 8)
+		if err != nil || s == 0 {
+			return 0, fmt.Errorf("invalid step %q", r[i+1:])
+		}
+		step = uint(s)
+		r = r[:i]
+	}
+
+	var start, end uint
+	switch {
+	case r == "*":
+		start, end = b.min, b.max
+	case strings.Contains(r, "-"):
+		parts := strings.SplitN(r, "-", 2)
+		var err error
+		if start, err = parseValue(parts[0], b); err != nil {
+			return 0, err
+		}
+		if end, err = parseValue(parts[1], b); err != nil {
+			return 0, err
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid range %q", r)
+		}
+	default:
+		v, err := parseValue(r, b)
+		if err != nil {
+			return 0, err
+		}
+		start, end = v, v
+		if step > 1 {
+			// n/step means from n to the max
+			end = b.max
+		}
+	}
+
+	var bits uint64
+	for v := start; v <= end; v += step {
+		bits |= 1 << v
+	}
+	return bits, nil
+}
+
+func parseValue(v string, b bounds) (uint, error) {
+	if n, ok := b.names[strings.ToLower(v)]; ok {
+		return n, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", v)
+	}
+	if uint(n) < b.min || uint(n) > b.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", n, b.min, b.max)
+	}
+	return uint(n), nil
+}
+
+// Next returns the first time after t matching the expression (to the minute, in t's location)
+func (s cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// an expression that can never match (e.g. 30th of February) gives up after 5 years
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches follows cron's rule that when both day of month and day of week are restricted
+// either one matching is enough
+func (s cronSpec) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns t plus the interval (to the second)
+func (s everySpec) Next(t time.Time) time.Time {
+	return t.Truncate(time.Second).Add(s.interval)
+}
@@ -0,0 +1,53 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNext(t *testing.T) {
+	from := time.Date(2016, time.September, 22, 10, 17, 30, 0, time.UTC) // a thursday
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2016, time.September, 22, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, time.September, 22, 10, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2016, time.September, 22, 11, 0, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2016, time.September, 23, 2, 0, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", time.Date(2016, time.September, 23, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2016, time.September, 25, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2016, time.September, 23, 0, 0, 0, 0, time.UTC)}, // day of month or day of week
+		{"5,10 10-12/2 * * *", time.Date(2016, time.September, 22, 12, 5, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2016, time.September, 22, 11, 47, 30, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		spec, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.expr, err)
+			continue
+		}
+		if next := spec.Next(from); !next.Equal(tt.next) {
+			t.Errorf("%q: expected next run at %v but have %v", tt.expr, tt.next, next)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@every 30s", "@fortnightly"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestNeverRuns(t *testing.T) {
+	spec, err := Parse("0 0 30 feb *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := spec.Next(time.Now()); !next.IsZero() {
+		t.Errorf("expected no next run but have %v", next)
+	}
+}
@@ -0,0 +1,165 @@
+// Package schedule defines when the clock adds jobs to the queues
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/homemade/jgforce"
+	"github.com/homemade/jgforce/config"
+)
+
+// CatchUp policy for runs missed while the clock was down (or restarting)
+type CatchUp string
+
+const (
+	// CatchUpNone skips missed runs and waits for the next one
+	CatchUpNone CatchUp = "none"
+
+	// CatchUpOnce adds a single job for the latest missed run
+	CatchUpOnce CatchUp = "once"
+
+	// CatchUpAll adds a job for every missed run (up to MaxCatchUp of the latest)
+	CatchUpAll CatchUp = "all"
+)
+
+// MaxCatchUp is the most missed runs CatchUpAll will add
+const MaxCatchUp = 100
+
+// Schedule adds a job of the given type to the queue at the times matching the cron expression
+type Schedule struct {
+	Name  string          `json:"name"`
+	Cron  string          `json:"cron"`
+	Queue string          `json:"queue"`
+	Job   string          `json:"job"`
+	Args  json.RawMessage `json:"args,omitempty"`
+
+	// CatchUp policy for this schedule, defaults to SCHEDULE_CATCHUP (or once if that isn't set)
+	CatchUp CatchUp `json:"catchup,omitempty"`
+
+	spec Spec
+}
+
+// Next run time after t
+func (s *Schedule) Next(t time.Time) time.Time {
+	return s.spec.Next(t)
+}
+
+// Missed returns the runs after last and up to now which should be caught up according to the policy,
+// along with the next run after now
+func (s *Schedule) Missed(last time.Time, now time.Time) (missed []time.Time, next time.Time) {
+	next = s.Next(last)
+	for !next.IsZero() && !next.After(now) {
+		missed = append(missed, next)
+		next = s.Next(next)
+	}
+	switch s.CatchUp {
+	case CatchUpNone:
+		missed = nil
+	case CatchUpAll:
+		if len(missed) > MaxCatchUp {
+			missed = missed[len(missed)-MaxCatchUp:]
+		}
+	default:
+		if len(missed) > 1 {
+			missed = missed[len(missed)-1:]
+		}
+	}
+	return missed, next
+}
+
+// Load the schedules, these are read as a json array from either the SCHEDULE setting
+// or the file named by the SCHEDULE_FILE setting, e.g.
+//
+//	[{"name": "justgiving", "cron": "@hourly", "queue": "JustGiving", "job": "Heartbeat"},
+//	 {"name": "salesforce", "cron": "*/15 * * * *", "queue": "SalesForce", "job": "Heartbeat"}]
+//
+// if neither is set we fall back to a heartbeat on both queues every HEARTBEAT minutes
+//
+// SCHEDULE_CATCHUP sets the default catch up policy (none, once or all) for schedules which don't set their own
+func Load(cfg *config.Config) ([]*Schedule, error) {
+	var raw []byte
+	if cfg.Schedule != "" {
+		raw = []byte(cfg.Schedule)
+	} else if cfg.ScheduleFile != "" {
+		var err error
+		raw, err = ioutil.ReadFile(cfg.ScheduleFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading SCHEDULE_FILE %s %v", cfg.ScheduleFile, err)
+		}
+	} else {
+		return heartbeats(cfg)
+	}
+
+	var schedules []*Schedule
+	if err := json.Unmarshal(raw, &schedules); err != nil {
+		return nil, fmt.Errorf("error reading schedules %v", err)
+	}
+	defaultCatchUp(schedules, CatchUp(cfg.ScheduleCatchUp))
+	return schedules, validate(schedules)
+}
+
+// heartbeats is the default schedule, a heartbeat on each queue every HEARTBEAT minutes
+func heartbeats(cfg *config.Config) ([]*Schedule, error) {
+	if cfg.Heartbeat < 1 {
+		return nil, errors.New("missing schedule, expected SCHEDULE, SCHEDULE_FILE or HEARTBEAT (integer value >= 1)")
+	}
+	every := fmt.Sprintf("@every %dm", cfg.Heartbeat)
+	schedules := []*Schedule{
+		{Name: jgforce.JustGivingQueue, Cron: every, Queue: jgforce.JustGivingQueue, Job: jgforce.HeartbeatJob},
+		{Name: jgforce.SalesForceQueue, Cron: every, Queue: jgforce.SalesForceQueue, Job: jgforce.HeartbeatJob},
+	}
+	defaultCatchUp(schedules, CatchUp(cfg.ScheduleCatchUp))
+	return schedules, validate(schedules)
+}
+
+// defaultCatchUp sets the catch up policy of the schedules which don't set their own
+func defaultCatchUp(schedules []*Schedule, catchUp CatchUp) {
+	for _, s := range schedules {
+		if s.CatchUp == "" {
+			s.CatchUp = catchUp
+		}
+	}
+}
+
+// validate the schedules, parse their cron expressions and set their catch up policy (once if they don't have one)
+func validate(schedules []*Schedule) error {
+	if len(schedules) == 0 {
+		return errors.New("no schedules defined")
+	}
+	names := make(map[string]bool)
+	for i, s := range schedules {
+		if s.Name == "" {
+			return fmt.Errorf("missing name for schedule %d", i)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate schedule name %s", s.Name)
+		}
+		names[s.Name] = true
+		if s.Queue == "" || s.Job == "" {
+			return fmt.Errorf("missing queue or job for schedule %s", s.Name)
+		}
+		spec, err := Parse(s.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule %s has an %v", s.Name, err)
+		}
+		if spec.Next(time.Now()).IsZero() {
+			return fmt.Errorf("schedule %s never runs", s.Name)
+		}
+		s.spec = spec
+		if s.CatchUp == "" {
+			s.CatchUp = CatchUpOnce
+		}
+		if !s.CatchUp.valid() {
+			return fmt.Errorf("schedule %s has an invalid catchup %s, expected none, once or all", s.Name, s.CatchUp)
+		}
+	}
+	return nil
+}
+
+func (c CatchUp) valid() bool {
+	return c == CatchUpNone || c == CatchUpOnce || c == CatchUpAll
+}
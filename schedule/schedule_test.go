@@ -0,0 +1,50 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMissed(t *testing.T) {
+	last := time.Date(2016, time.September, 22, 10, 0, 0, 0, time.UTC)
+	now := time.Date(2016, time.September, 22, 10, 50, 0, 0, time.UTC)
+	tests := []struct {
+		catchUp CatchUp
+		missed  int
+	}{
+		{CatchUpNone, 0},
+		{CatchUpOnce, 1},
+		{CatchUpAll, 3},
+	}
+	for _, tt := range tests {
+		s := []*Schedule{{Name: "test", Cron: "*/15 * * * *", Queue: "q", Job: "j", CatchUp: tt.catchUp}}
+		if err := validate(s); err != nil {
+			t.Fatal(err)
+		}
+		missed, next := s[0].Missed(last, now)
+		if len(missed) != tt.missed {
+			t.Errorf("%s: expected %d missed runs but have %v", tt.catchUp, tt.missed, missed)
+		}
+		if len(missed) > 0 && !missed[len(missed)-1].Equal(time.Date(2016, time.September, 22, 10, 45, 0, 0, time.UTC)) {
+			t.Errorf("%s: expected the latest missed run to be 10:45 but have %v", tt.catchUp, missed[len(missed)-1])
+		}
+		if !next.Equal(time.Date(2016, time.September, 22, 11, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: expected next run at 11:00 but have %v", tt.catchUp, next)
+		}
+	}
+}
+
+func TestMissedNothing(t *testing.T) {
+	s := []*Schedule{{Name: "test", Cron: "@hourly", Queue: "q", Job: "j"}}
+	if err := validate(s); err != nil {
+		t.Fatal(err)
+	}
+	last := time.Date(2016, time.September, 22, 10, 0, 0, 0, time.UTC)
+	missed, next := s[0].Missed(last, last.Add(30*time.Minute))
+	if len(missed) != 0 {
+		t.Errorf("expected no missed runs but have %v", missed)
+	}
+	if !next.Equal(last.Add(time.Hour)) {
+		t.Errorf("expected next run at 11:00 but have %v", next)
+	}
+}
@@ -0,0 +1,37 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// LastRuns returns the last run time of each schedule, keyed by name
+func LastRuns(pool *pgx.ConnPool) (map[string]time.Time, error) {
+	rows, err := pool.Query(`SELECT name, last_run_at FROM clock_schedule_state`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying clock_schedule_state %v", err)
+	}
+	defer rows.Close()
+	lastRuns := make(map[string]time.Time)
+	for rows.Next() {
+		var name string
+		var lastRunAt time.Time
+		if err = rows.Scan(&name, &lastRunAt); err != nil {
+			return nil, fmt.Errorf("error reading from clock_schedule_state %v", err)
+		}
+		lastRuns[name] = lastRunAt
+	}
+	return lastRuns, rows.Err()
+}
+
+// SaveLastRun records the last run time of the schedule
+func SaveLastRun(pool *pgx.ConnPool, name string, runAt time.Time) error {
+	_, err := pool.Exec(`INSERT INTO clock_schedule_state (name, last_run_at) VALUES ($1, $2)
+ ON CONFLICT (name) DO UPDATE SET last_run_at = EXCLUDED.last_run_at, updated_at = now()`, name, runAt)
+	if err != nil {
+		return fmt.Errorf("error saving last run of schedule %s to clock_schedule_state %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package jgforce
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	que "github.com/bgentry/que-go"
+	"golang.org/x/net/context"
+)
+
+// DefaultJobTimeout is the longest a job is worked before it is cancelled, unless overridden for its type in JobTimeouts
+const DefaultJobTimeout = 30 * time.Minute
+
+// JobTimeouts per job type
+var JobTimeouts = map[string]time.Duration{
+	HeartbeatJob:          30 * time.Minute,
+	SyncEventPagesJob:     5 * time.Minute,
+	RefreshPageResultsJob: 2 * time.Minute,
+	ResyncContactJob:      10 * time.Minute,
+}
+
+// JobFunc works a job, ctx is done when the job runs past its timeout or the worker is shutting down
+type JobFunc func(ctx context.Context, j *que.Job) error
+
+// JobMap maps job types to the funcs which work them
+type JobMap map[string]JobFunc
+
+// TimeoutError is returned for a job which was cancelled as it ran past its timeout,
+// its message (which que records as the job's last_error) includes the progress the job made
+type TimeoutError struct {
+	Timeout  time.Duration
+	Progress string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v, progress: %s", e.Timeout, e.Progress)
+}
+
+// ParseJobTimeouts reads job timeouts from a comma separated list of type=duration, e.g. Heartbeat=1h,RefreshPageResults=1m
+func ParseJobTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid job timeout %q, expected type=duration", t)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid job timeout %q, expected a duration such as 5m", t)
+		}
+		timeouts[strings.TrimSpace(parts[0])] = d
+	}
+	return timeouts, nil
+}
+
+// jobTimeout for the job type
+func jobTimeout(jobType string) time.Duration {
+	if t, ok := JobTimeouts[jobType]; ok && t > 0 {
+		return t
+	}
+	return DefaultJobTimeout
+}
+
+// WithTimeout turns the job funcs into que work funcs, each job is worked with a context derived from ctx
+// which is cancelled once the job runs past the timeout for its type. A job which fails because it timed out
+// returns a *TimeoutError summarising the progress it recorded with AddProgress.
+func WithTimeout(ctx context.Context, jm JobMap) que.WorkMap {
+	wm := make(que.WorkMap, len(jm))
+	for jobType, jf := range jm {
+		wm[jobType] = timeout(ctx, jf, jobTimeout(jobType))
+	}
+	return wm
+}
+
+func timeout(ctx context.Context, jf JobFunc, d time.Duration) que.WorkFunc {
+	return func(j *que.Job) error {
+		jctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		jctx, _ = WithProgress(jctx)
+		jctx = context.WithValue(jctx, deadlineKey{}, jobDeadline{parent: ctx, timeout: d})
+		err := timeoutError(jctx, jf(jctx, j))
+		if terr, ok := err.(*TimeoutError); ok {
+			log.WithField("job_id", j.ID).Warnf("%s job %v", j.Type, terr)
+		}
+		return err
+	}
+}
+
+type deadlineKey struct{}
+
+// jobDeadline is the timeout WithTimeout gave the job, and the context it is derived from
+type jobDeadline struct {
+	parent  context.Context
+	timeout time.Duration
+}
+
+// timeoutError returns a *TimeoutError in place of err if the job failed because it ran past the timeout WithTimeout
+// gave it (not because the worker is shutting down), otherwise err as is. Job funcs wrapped by WithTimeout can use it
+// to see the error WithTimeout will return, as WithRunHistory does.
+func timeoutError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return err
+	}
+	dl, ok := ctx.Value(deadlineKey{}).(jobDeadline)
+	if !ok || dl.parent.Err() != nil {
+		return err
+	}
+	return &TimeoutError{Timeout: dl.timeout, Progress: progressFrom(ctx).String()}
+}
+
+// Progress counts the work done by a job, so we can say how far it got if it times out
+type Progress struct {
+	mu     sync.Mutex
+	names  []string
+	counts map[string]int
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context carrying a new Progress
+func WithProgress(ctx context.Context) (context.Context, *Progress) {
+	p := &Progress{counts: make(map[string]int)}
+	return context.WithValue(ctx, progressKey{}, p), p
+}
+
+// progressFrom returns the Progress carried by ctx, or an empty one if there isn't one
+func progressFrom(ctx context.Context) *Progress {
+	if p, ok := ctx.Value(progressKey{}).(*Progress); ok {
+		return p
+	}
+	return &Progress{counts: make(map[string]int)}
+}
+
+// AddProgress adds n to the named count of the Progress carried by ctx (if any)
+func AddProgress(ctx context.Context, name string, n int) {
+	if p, ok := ctx.Value(progressKey{}).(*Progress); ok {
+		p.Add(name, n)
+	}
+}
+
+// Add n to the named count
+func (p *Progress) Add(name string, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.counts[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.counts[name] += n
+}
+
+// Count returns the named count
+func (p *Progress) Count(name string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.counts[name]
+}
+
+// String summarises the counts in the order they were first added, e.g. "events enqueued 3, pages enqueued 120"
+func (p *Progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.names) == 0 {
+		return "none recorded"
+	}
+	summary := make([]string, len(p.names))
+	for i, name := range p.names {
+		summary[i] = fmt.Sprintf("%s %d", name, p.counts[name])
+	}
+	return strings.Join(summary, ", ")
+}
@@ -0,0 +1,72 @@
+package jgforce_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"golang.org/x/net/context"
+
+	"github.com/homemade/jgforce"
+)
+
+func TestParseJobTimeouts(t *testing.T) {
+	timeouts, err := jgforce.ParseJobTimeouts("Heartbeat=1h, RefreshPageResults=90s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts[jgforce.HeartbeatJob] != time.Hour || timeouts[jgforce.RefreshPageResultsJob] != 90*time.Second {
+		t.Errorf("unexpected timeouts %v", timeouts)
+	}
+	for _, s := range []string{"Heartbeat", "Heartbeat=soon", "=1m", "Heartbeat=-1m"} {
+		if _, err = jgforce.ParseJobTimeouts(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	jgforce.JobTimeouts["Slow"] = 10 * time.Millisecond
+	defer delete(jgforce.JobTimeouts, "Slow")
+
+	wm := jgforce.WithTimeout(context.Background(), jgforce.JobMap{
+		"Slow": func(ctx context.Context, j *que.Job) error {
+			jgforce.AddProgress(ctx, "pages synced", 2)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	err := wm["Slow"](&que.Job{Type: "Slow"})
+	terr, ok := err.(*jgforce.TimeoutError)
+	if !ok {
+		t.Fatalf("expected a timeout error but have %v", err)
+	}
+	if terr.Progress != "pages synced 2" {
+		t.Errorf("unexpected progress %q", terr.Progress)
+	}
+
+	// the run history (wrapped by WithTimeout) records the timeout error, rather than the deadline being exceeded
+	wm = jgforce.WithTimeout(context.Background(), jgforce.WithRunHistory(jgforce.JobMap{
+		"Slow": func(ctx context.Context, j *que.Job) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}))
+	if err = wm["Slow"](&que.Job{Type: "Slow"}); err == nil || !strings.HasPrefix(err.Error(), "timed out after 10ms") {
+		t.Errorf("expected a timeout error but have %v", err)
+	}
+
+	// cancelling the worker's context isn't a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wm = jgforce.WithTimeout(ctx, jgforce.JobMap{
+		"Slow": func(ctx context.Context, j *que.Job) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	if err = wm["Slow"](&que.Job{Type: "Slow"}); err != context.Canceled {
+		t.Errorf("expected context canceled but have %v", err)
+	}
+}
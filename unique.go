@@ -0,0 +1,110 @@
+package jgforce
+
+import (
+	"sync/atomic"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+// UniqueMode determines what EnqueueUnique does when a duplicate job is already on the queue
+type UniqueMode int
+
+const (
+	// SkipDuplicate leaves the existing job in place and skips the enqueue
+	SkipDuplicate UniqueMode = iota
+
+	// ReplaceDuplicate deletes an existing job which is waiting (or waiting to retry) and enqueues the new job in its place,
+	// if the existing job is currently being worked it is left alone and the enqueue is skipped
+	ReplaceDuplicate
+)
+
+var skippedEnqueues uint64
+
+// SkippedEnqueues is the number of enqueues skipped by EnqueueUnique since the process started
+func SkippedEnqueues() uint64 {
+	return atomic.LoadUint64(&skippedEnqueues)
+}
+
+// UniqueKey identifies duplicate jobs, jobs are duplicates when they share a queue, type and args
+func UniqueKey(j *que.Job) string {
+	return j.Queue + "|" + j.Type + "|" + jobArgs(j)
+}
+
+// jobArgs as they will be stored in que_jobs (que defaults missing args to an empty json array)
+func jobArgs(j *que.Job) string {
+	if len(j.Args) == 0 {
+		return "[]"
+	}
+	return string(j.Args)
+}
+
+// EnqueueUnique adds the job unless a duplicate (see UniqueKey) is already on the queue, in which case the mode decides
+// whether it is skipped or replaces the existing job. It returns true if the job was enqueued.
+func EnqueueUnique(pool *pgx.ConnPool, qc *que.Client, j *que.Job, mode UniqueMode) (bool, error) {
+	tx, err := pool.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// serialise enqueues of the same key until we commit
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2))`, uniqueLockClass, UniqueKey(j)); err != nil {
+		return false, err
+	}
+
+	// find any duplicates, and whether they are currently being worked (que holds an advisory lock on the job id while working it)
+	rows, err := tx.Query(`SELECT j.job_id, EXISTS (SELECT 1 FROM pg_locks l WHERE l.locktype = 'advisory' AND l.objsubid = 1
+ AND ((l.classid::bigint << 32) + l.objid::bigint) = j.job_id) AS working
+ FROM que_jobs j WHERE j.queue = $1 AND j.job_class = $2 AND j.args::text = $3`, j.Queue, j.Type, jobArgs(j))
+	if err != nil {
+		return false, err
+	}
+	var waiting []int64
+	var working bool
+	for rows.Next() {
+		var id int64
+		var w bool
+		if err = rows.Scan(&id, &w); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if w {
+			working = true
+		} else {
+			waiting = append(waiting, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	if working || (len(waiting) > 0 && mode == SkipDuplicate) {
+		atomic.AddUint64(&skippedEnqueues, 1)
+		return false, nil
+	}
+
+	// a worker may have taken a waiting job since we looked, so each is locked (as que locks a job it works) before
+	// it is deleted, a job we can't lock is being worked. The locks are held until we commit, so no worker can take
+	// the job in the meantime
+	for _, id := range waiting {
+		var locked bool
+		if err = tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, id).Scan(&locked); err != nil {
+			return false, err
+		}
+		if !locked {
+			atomic.AddUint64(&skippedEnqueues, 1)
+			return false, nil
+		}
+		if _, err = tx.Exec(`DELETE FROM que_jobs WHERE job_id = $1`, id); err != nil {
+			return false, err
+		}
+	}
+
+	if err = qc.EnqueueInTx(j, tx); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}